@@ -51,6 +51,20 @@ Archive directories and filters file to stdout as compressed stream:
 
 $> tar-formers archive - --specs specs.yaml --compression zstd > /tmp/file.tar.zstd
 
+Archive directories with the max compression level of xz:
+
+$> tar-formers archive /tmp/file.tar.xz /mydir1 --compression xz:9e
+
+Archive directories with the modification times clamped to
+SOURCE_DATE_EPOCH to get the same tarball on every build:
+
+$> SOURCE_DATE_EPOCH=1700000000 tar-formers archive /tmp/file.tar.gz /mydir1 --reproducible
+
+Archive directories with only USTAR headers for legacy consumers
+dropping the times and the PAX records not supported:
+
+$> tar-formers archive /tmp/file.tar /mydir1 --format ustar --drop-unsupported
+
 NOTE: Bzip2 compression is experimental.
 `,
 		Aliases: []string{"a"},
@@ -67,6 +81,9 @@ NOTE: Bzip2 compression is experimental.
 
 			spec, _ := cmd.Flags().GetString("specs")
 			compression, _ := cmd.Flags().GetString("compression")
+			reproducible, _ := cmd.Flags().GetBool("reproducible")
+			format, _ := cmd.Flags().GetString("format")
+			dropUnsupported, _ := cmd.Flags().GetBool("drop-unsupported")
 
 			// Check instance
 			tarformers := executor.NewTarFormers(config)
@@ -87,9 +104,22 @@ NOTE: Bzip2 compression is experimental.
 				s.Writer.ArchiveDirs = args[1:]
 			}
 
-			opts := tools.NewTarCompressionOpts(compression == "")
-			if compression != "" {
-				opts.Mode = tools.ParseCompressionMode(compression)
+			if reproducible && s.Writer != nil {
+				s.Writer.Reproducible = true
+			}
+			if format != "" && s.Writer != nil {
+				s.Writer.Format = format
+			}
+			if dropUnsupported && s.Writer != nil {
+				s.Writer.DropUnsupported = true
+			}
+
+			opts, err := newTarCompressionOpts(config, s, compression)
+			if err != nil {
+				fmt.Println(fmt.Sprintf(
+					"Error on parse compression: %s",
+					err.Error()))
+				os.Exit(1)
 			}
 			defer opts.Close()
 
@@ -125,8 +155,16 @@ NOTE: Bzip2 compression is experimental.
 	flags := cmd.Flags()
 	flags.String("compression", "",
 		"Specify tarball compression and ignoring extension of the file."+
-			" Possible values: gz|gzip|zstd|xz|bz2|bzip2|none.")
+			" Possible values: gz|gzip|zstd|zstd-seekable|xz|bz2|bzip2|lz4|s2|snappy|lz|lzip|none."+
+			" An optional level could be added as <mode>:<level> (for example"+
+			" zstd:19, xz:9e or gz:1) or as :<level> to keep the extension.")
 	flags.String("specs", "", "Define a spec file with the rules to follow.")
+	flags.Bool("reproducible", false,
+		"Write a reproducible tarball (see the reproducible option of the writer).")
+	flags.String("format", "",
+		"Force the format of the tar headers. Possible values: ustar|pax|gnu.")
+	flags.Bool("drop-unsupported", false,
+		"Drop the fields that can't be represented by the ustar and gnu formats instead of fail.")
 
 	return cmd
 }
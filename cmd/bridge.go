@@ -20,9 +20,7 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package cmd
 
 import (
-	"bufio"
 	"fmt"
-	"io"
 	"os"
 
 	executor "github.com/geaaru/tar-formers/pkg/executor"
@@ -53,6 +51,18 @@ compressed with both input and output filters:
 
 $> tar-formers bridge --stdin --file /input.tar --to /tmp/file.tar.xz --out spec.yaml --in spec-reader.yaml
 
+Convert a xz tarball to a zstd tarball applying the rename rules of
+the output spec. The compression of the input is detected from the
+content or defined with --in-compression:
+
+$> tar-formers bridge --file /input.tar.xz --to /tmp/file.tar.zstd --out spec.yaml
+$> cat /input.bin | tar-formers bridge --stdin --in-compression xz --to - --compression zstd
+
+Convert a tarball to a tarball with only GNU headers dropping
+the fields not supported:
+
+$> tar-formers bridge --file /input.tar --to /tmp/file.tar --format gnu --drop-unsupported
+
 `,
 		Aliases: []string{"b"},
 		PreRun: func(cmd *cobra.Command, args []string) {
@@ -85,6 +95,9 @@ $> tar-formers bridge --stdin --file /input.tar --to /tmp/file.tar.xz --out spec
 			stdin, _ := cmd.Flags().GetBool("stdin")
 			file, _ := cmd.Flags().GetString("file")
 			compression, _ := cmd.Flags().GetString("compression")
+			format, _ := cmd.Flags().GetString("format")
+			dropUnsupported, _ := cmd.Flags().GetBool("drop-unsupported")
+			inCompression, _ := cmd.Flags().GetString("in-compression")
 
 			// Check instance
 			tarformers := executor.NewTarFormers(config)
@@ -118,10 +131,20 @@ $> tar-formers bridge --stdin --file /input.tar --to /tmp/file.tar.xz --out spec
 				sWriter.Writer = specs.NewWriter()
 			}
 
+			if format != "" && sWriter.Writer != nil {
+				sWriter.Writer.Format = format
+			}
+			if dropUnsupported && sWriter.Writer != nil {
+				sWriter.Writer.DropUnsupported = true
+			}
+
 			// Prepare the writer
-			opts := tools.NewTarCompressionOpts(compression == "")
-			if compression != "" {
-				opts.Mode = tools.ParseCompressionMode(compression)
+			opts, err := newTarCompressionOpts(config, sWriter, compression)
+			if err != nil {
+				fmt.Println(fmt.Sprintf(
+					"Error on parse compression: %s",
+					err.Error()))
+				os.Exit(1)
 			}
 			defer opts.Close()
 
@@ -140,22 +163,27 @@ $> tar-formers bridge --stdin --file /input.tar --to /tmp/file.tar.xz --out spec
 				tarformers.SetWriter(opts.FileWriter)
 			}
 
-			// Prepare the reader
-			var reader io.Reader
-
+			// Prepare the reader. By default the compression is
+			// detected from the content of the stream.
+			ropts := tools.NewTarReaderCompressionOpts(inCompression == "")
+			if inCompression != "" {
+				ropts.Mode = tools.ParseCompressionMode(inCompression)
+			}
 			if stdin {
-				reader = bufio.NewReader(os.Stdin)
+				file = "-"
+			}
+			err = tools.PrepareTarReader(file, ropts)
+			if err != nil {
+				fmt.Println("Error on prepare reader:", err.Error())
+				os.Exit(1)
+			}
+			defer ropts.Close()
+
+			if ropts.CompressReader != nil {
+				tarformers.SetReader(ropts.CompressReader)
 			} else {
-				f, err := os.OpenFile(file, os.O_RDONLY, 0666)
-				if err != nil {
-					fmt.Println(fmt.Sprintf("Error on open file %s: %s",
-						file, err.Error()))
-					os.Exit(1)
-				}
-				defer f.Close()
-				reader = f
+				tarformers.SetReader(ropts.FileReader)
 			}
-			tarformers.SetReader(reader)
 
 			err = tarformers.RunTaskBridge(sReader, sWriter)
 			if err != nil {
@@ -177,7 +205,16 @@ $> tar-formers bridge --stdin --file /input.tar --to /tmp/file.tar.xz --out spec
 	flags.String("to", "", "File where write the tar flow. Use - for stdout.")
 	flags.String("compression", "",
 		"Specify tarball compression and ignoring extension of the file."+
-			" Possible values: gz|gzip|zstd|xz|bz2|bzip2|none.")
+			" Possible values: gz|gzip|zstd|zstd-seekable|xz|bz2|bzip2|lz4|s2|snappy|lz|lzip|none."+
+			" An optional level could be added as <mode>:<level> (for example"+
+			" zstd:19, xz:9e or gz:1) or as :<level> to keep the extension.")
+	flags.String("in-compression", "",
+		"Specify the compression of the input stream and ignoring the detection"+
+			" from the content. Possible values: auto|gz|gzip|zstd|xz|bz2|bzip2|lz4|s2|snappy|lz|lzip|none.")
+	flags.String("format", "",
+		"Force the format of the tar headers. Possible values: ustar|pax|gnu.")
+	flags.Bool("drop-unsupported", false,
+		"Drop the fields that can't be represented by the ustar and gnu formats instead of fail.")
 
 	return cmd
 }
@@ -0,0 +1,72 @@
+/*
+
+Copyright (C) 2021-2023  Daniele Rondina <geaaru@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.:s
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package cmd
+
+import (
+	"errors"
+
+	specs "github.com/geaaru/tar-formers/pkg/specs"
+	"github.com/geaaru/tar-formers/pkg/tools"
+)
+
+// newTarCompressionOpts returns the options of the compression of the
+// output tarball. The tuning of the config file is overridden by the
+// tuning of the writer of the spec and then by the compression option
+// in the format <mode>[:<level>[e]]. The levels of the config file
+// are defined per mode because the same config is used for all the
+// compressions.
+func newTarCompressionOpts(config *specs.Config, s *specs.SpecFile,
+	compression string) (*tools.TarCompressionOpts, error) {
+
+	opts := tools.NewTarCompressionOpts(true)
+
+	if config != nil {
+		c := config.GetCompression()
+		if c.Level > 0 {
+			return nil, errors.New(
+				"The compression level of the config file must be defined per mode with levels")
+		}
+		opts.SetTuning(0, c.Workers, c.WindowSize, c.BlockSize)
+		err := opts.SetLevels(c.Levels)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if s != nil && s.Writer != nil {
+		if c := s.Writer.Compression; c != nil {
+			opts.SetTuning(c.Level, c.Workers, c.WindowSize, c.BlockSize)
+			err := opts.SetLevels(c.Levels)
+			if err != nil {
+				return nil, err
+			}
+		}
+		opts.Reproducible = s.Writer.Reproducible
+	}
+
+	if compression != "" {
+		err := opts.ParseCompression(compression)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return opts, nil
+}
@@ -0,0 +1,137 @@
+/*
+
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.:s
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	executor "github.com/geaaru/tar-formers/pkg/executor"
+	specs "github.com/geaaru/tar-formers/pkg/specs"
+	"github.com/geaaru/tar-formers/pkg/tools"
+
+	"github.com/spf13/cobra"
+)
+
+func newDiffLayerCommand(config *specs.Config) *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "diff-layer <tarball|-> --lower <dir> --upper <dir> [OPTIONS]",
+		Short: "Create a layer tarball with the differences between two directories.",
+		Long: `Create a layer tarball with the files added or modified in the upper
+directory and the whiteouts of the files removed from the lower directory:
+
+$> tar-formers diff-layer /tmp/layer.tar.gz --lower /rootfs-old --upper /rootfs-new
+
+Write the layer to stdout as tar stream:
+
+$> tar-formers diff-layer - --lower /rootfs-old --upper /rootfs-new | \
+   tar-formers portal --stdin --to /rootfs --specs apply-whiteouts.yaml
+
+The directories of the upper with the overlayfs opaque attribute or
+with all the files of the lower removed are written with the opaque
+marker. The overlayfs whiteouts (char device 0/0) are converted to
+the OCI whiteouts.
+`,
+		Aliases: []string{"dl"},
+		PreRun: func(cmd *cobra.Command, args []string) {
+			lower, _ := cmd.Flags().GetString("lower")
+			upper, _ := cmd.Flags().GetString("upper")
+			if len(args) < 1 || lower == "" || upper == "" {
+				fmt.Println("Missing mandatory arguments")
+				os.Exit(1)
+			}
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			var s *specs.SpecFile = nil
+			var err error
+
+			spec, _ := cmd.Flags().GetString("specs")
+			compression, _ := cmd.Flags().GetString("compression")
+			lower, _ := cmd.Flags().GetString("lower")
+			upper, _ := cmd.Flags().GetString("upper")
+
+			// Check instance
+			tarformers := executor.NewTarFormers(config)
+
+			archiveFile := args[0]
+			if spec != "" {
+				s, err = specs.NewSpecFileFromFile(spec)
+				if err != nil {
+					fmt.Println(fmt.Sprintf(
+						"Error on read file %s: %s",
+						spec, err.Error()))
+					os.Exit(1)
+				}
+			} else {
+				s = specs.NewSpecFile()
+				s.SameChtimes = true
+				s.Writer = specs.NewWriter()
+			}
+
+			opts, err := newTarCompressionOpts(config, s, compression)
+			if err != nil {
+				fmt.Println(fmt.Sprintf(
+					"Error on parse compression: %s",
+					err.Error()))
+				os.Exit(1)
+			}
+			defer opts.Close()
+
+			err = tools.PrepareTarWriter(archiveFile, opts)
+			if err != nil {
+				fmt.Println(fmt.Sprintf(
+					"Error on prepare writer: %s",
+					err.Error()))
+				os.Exit(1)
+			}
+
+			if opts.CompressWriter != nil {
+				tarformers.SetWriter(opts.CompressWriter)
+			} else {
+				tarformers.SetWriter(opts.FileWriter)
+			}
+
+			err = tarformers.RunTaskDiffLayer(s, lower, upper)
+			if err != nil {
+				fmt.Println(fmt.Sprintf(
+					"Error on create layer %s: %s",
+					archiveFile, err.Error()))
+				opts.Close()
+				os.Exit(1)
+			}
+
+			if archiveFile != "-" {
+				fmt.Println("Operation completed.")
+			}
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.String("lower", "", "The lower directory used as base.")
+	flags.String("upper", "", "The upper directory with the changes.")
+	flags.String("compression", "",
+		"Specify tarball compression and ignoring extension of the file."+
+			" Possible values: gz|gzip|zstd|zstd-seekable|xz|bz2|bzip2|lz4|s2|snappy|lz|lzip|none."+
+			" An optional level could be added as <mode>:<level> (for example"+
+			" zstd:19, xz:9e or gz:1) or as :<level> to keep the extension.")
+	flags.String("specs", "", "Define a spec file with the rules to follow.")
+
+	return cmd
+}
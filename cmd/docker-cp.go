@@ -32,7 +32,7 @@ import (
 )
 
 func cpDockerContainer(tarformers *executor.TarFormers,
-	cid, srcPath, dir, file, spec, specOut string) error {
+	cid, srcPath, dir, file, spec, specOut string, secure bool) error {
 	var s *specs.SpecFile = nil
 	var sWriter *specs.SpecFile = nil
 	var err error
@@ -83,13 +83,20 @@ func cpDockerContainer(tarformers *executor.TarFormers,
 	}
 
 	if dir != "" {
+		if secure {
+			s.SecureExtraction = true
+		}
 		err = tarformers.RunTask(s, dir)
 		if err != nil {
 			return fmt.Errorf("Error on process tarball :" + err.Error())
 		}
 	} else {
 		// Prepare the writer
-		opts := tools.NewTarCompressionOpts(true)
+		opts, err := newTarCompressionOpts(tarformers.Config, sWriter, "")
+		if err != nil {
+			return fmt.Errorf("Error on parse compression: %s",
+				err.Error())
+		}
 		defer opts.Close()
 
 		err = tools.PrepareTarWriter(file, opts)
@@ -167,13 +174,14 @@ $> tar-formers docker-cp <container-id> <src-path> --to /mycontainer.tar.gz --sp
 			todir, _ := cmd.Flags().GetString("todir")
 			specfile, _ := cmd.Flags().GetString("specs")
 			out, _ := cmd.Flags().GetString("out")
+			secure, _ := cmd.Flags().GetBool("secure")
 
 			// Check instance
 			tarformers := executor.NewTarFormers(config)
 
 			err := cpDockerContainer(
 				tarformers, args[0], args[1], todir,
-				to, specfile, out)
+				to, specfile, out, secure)
 
 			if err != nil {
 				fmt.Println(err.Error())
@@ -189,6 +197,9 @@ $> tar-formers docker-cp <container-id> <src-path> --to /mycontainer.tar.gz --sp
 	flags.String("specs", "", "Define a spec file with the rules to follow.")
 	flags.String("out", "",
 		"Define a spec file with the rules to follow for the writer. Only used with --to.")
+	flags.Bool("secure", true,
+		"Resolve all paths inside the export directory and check unsafe entries."+
+			" Only used with --todir. Use --secure=false to disable it.")
 
 	return cmd
 }
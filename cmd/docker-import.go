@@ -28,6 +28,7 @@ import (
 
 	executor "github.com/geaaru/tar-formers/pkg/executor"
 	specs "github.com/geaaru/tar-formers/pkg/specs"
+	"github.com/geaaru/tar-formers/pkg/tools"
 
 	"github.com/spf13/cobra"
 )
@@ -101,14 +102,20 @@ func importDockerContainer(tarformers *executor.TarFormers,
 			tarformers.SetFileWriterHandler(hf)
 
 		} else {
-			// Open file to read
-			f, err := os.OpenFile(file, os.O_RDONLY, 0666)
+			// Open file to read. The compression is detected
+			// from the content of the file.
+			opts := tools.NewTarReaderCompressionOpts(true)
+			err := tools.PrepareTarReader(file, opts)
 			if err != nil {
-				return fmt.Errorf("Error on open file %s: %s",
-					file, err.Error())
+				return fmt.Errorf("Error on prepare reader: %s", err.Error())
+			}
+			defer opts.Close()
+
+			if opts.CompressReader != nil {
+				tarformers.SetReader(opts.CompressReader)
+			} else {
+				tarformers.SetReader(opts.FileReader)
 			}
-			defer f.Close()
-			tarformers.SetReader(f)
 
 			sReader = specs.NewSpecFile()
 			sReader.IgnoreFiles = append(sReader.IgnoreFiles, ".dockerenv")
@@ -223,7 +230,7 @@ $> tar-formers di geaaru/tar-formers:latest --file ./alpine.tar --platform amd64
 
 	flags := cmd.Flags()
 	flags.String("dir", "", "Define directory to import in the image as /.")
-	flags.String("file", "", "Read tar flow from specified file (only .tar is supported).")
+	flags.String("file", "", "Read tar flow from specified file (compressed or plain tar).")
 	flags.StringP("message", "m", "",
 		"Set commit message for imported image")
 	flags.String("platform", "",
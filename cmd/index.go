@@ -0,0 +1,94 @@
+/*
+
+Copyright (C) 2021-2023  Daniele Rondina <geaaru@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.:s
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/geaaru/tar-formers/pkg/index"
+	specs "github.com/geaaru/tar-formers/pkg/specs"
+
+	"github.com/spf13/cobra"
+)
+
+func newIndexCommand(config *specs.Config) *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "index <tarball> [OPTIONS]",
+		Short: "Create the index of the entries of a tarball.",
+		Long: `Create the index of the entries of a tarball in the sidecar file
+<tarball>.index.json:
+
+$> tar-formers index /tmp/rootfs.tar
+
+The index permits to read only the entries selected by the
+match_prefix rules with the portal command. The random access is
+available for the uncompressed tarballs and for the tarballs
+compressed with zstd-seekable:
+
+$> tar-formers archive /tmp/rootfs.tar.zst /rootfs --compression zstd-seekable
+$> tar-formers index /tmp/rootfs.tar.zst
+$> tar-formers portal --file /tmp/rootfs.tar.zst --to /tmp/out --specs rules.yaml
+`,
+		PreRun: func(cmd *cobra.Command, args []string) {
+			if len(args) != 1 {
+				fmt.Println("Missing mandatory tarball argument")
+				os.Exit(1)
+			}
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			tarball := args[0]
+			out, _ := cmd.Flags().GetString("out")
+			if out == "" {
+				out = index.GetIndexFile(tarball)
+			}
+
+			idx, err := index.BuildFile(tarball)
+			if err != nil {
+				fmt.Println(fmt.Sprintf(
+					"Error on create index of %s: %s",
+					tarball, err.Error()))
+				os.Exit(1)
+			}
+
+			err = idx.WriteFile(out)
+			if err != nil {
+				fmt.Println(fmt.Sprintf(
+					"Error on write index %s: %s",
+					out, err.Error()))
+				os.Exit(1)
+			}
+
+			if !idx.IsSeekable() {
+				fmt.Println(fmt.Sprintf(
+					"WARNING: random access not supported for the %s compression.",
+					idx.Compression))
+			}
+
+			fmt.Println("Operation completed.")
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.String("out", "",
+		"Define the path of the index file (default <tarball>.index.json).")
+
+	return cmd
+}
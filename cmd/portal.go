@@ -24,6 +24,7 @@ import (
 	"os"
 
 	executor "github.com/geaaru/tar-formers/pkg/executor"
+	"github.com/geaaru/tar-formers/pkg/index"
 	specs "github.com/geaaru/tar-formers/pkg/specs"
 	"github.com/geaaru/tar-formers/pkg/tools"
 
@@ -63,6 +64,8 @@ func newPortalCommand(config *specs.Config) *cobra.Command {
 			stdin, _ := cmd.Flags().GetBool("stdin")
 			file, _ := cmd.Flags().GetString("file")
 			compression, _ := cmd.Flags().GetString("compression")
+			secure, _ := cmd.Flags().GetBool("secure")
+			indexFile, _ := cmd.Flags().GetString("index")
 
 			// Check instance
 			tarformers := executor.NewTarFormers(config)
@@ -80,28 +83,55 @@ func newPortalCommand(config *specs.Config) *cobra.Command {
 				s.IgnoreFiles = append(s.IgnoreFiles, "/.dockerenv")
 			}
 
-			opts := tools.NewTarReaderCompressionOpts(compression == "")
-			if compression != "" {
-				opts.Mode = tools.ParseCompressionMode(compression)
+			if secure {
+				s.SecureExtraction = true
 			}
 
-			if stdin {
-				file = "-"
+			// Read only the entries selected by the match_prefix
+			// rules when the tarball is indexed.
+			var indexReader *index.Reader
+			if !stdin && len(s.MatchPrefix) > 0 && !s.HasJournal() {
+				indexReader, err = openIndexReader(file, indexFile)
+				if err != nil {
+					fmt.Println("Error on open index:", err.Error())
+					os.Exit(1)
+				}
 			}
-			err = tools.PrepareTarReader(file, opts)
-			if err != nil {
-				fmt.Println("Error on prepare reader:", err.Error())
-				os.Exit(1)
+
+			opts := tools.NewTarReaderCompressionOpts(compression == "")
+			if compression != "" {
+				opts.Mode = tools.ParseCompressionMode(compression)
 			}
 
-			if opts.CompressReader != nil {
-				tarformers.SetReader(opts.CompressReader)
+			if indexReader != nil {
+				tarformers.Logger.Debug(fmt.Sprintf(
+					"Using the index of the tarball %s.", file))
+				tarformers.SetReader(indexReader.NewFilteredReader(
+					func(e *index.Entry) bool {
+						return s.IsPathMatched(s.GetRename("/" + e.Name))
+					}))
 			} else {
-				tarformers.SetReader(opts.FileReader)
+				if stdin {
+					file = "-"
+				}
+				err = tools.PrepareTarReader(file, opts)
+				if err != nil {
+					fmt.Println("Error on prepare reader:", err.Error())
+					os.Exit(1)
+				}
+
+				if opts.CompressReader != nil {
+					tarformers.SetReader(opts.CompressReader)
+				} else {
+					tarformers.SetReader(opts.FileReader)
+				}
 			}
 
 			err = tarformers.RunTask(s, to)
 			opts.Close()
+			if indexReader != nil {
+				indexReader.Close()
+			}
 			if err != nil {
 				fmt.Println("Error on process tarball :" + err.Error())
 				os.Exit(1)
@@ -117,8 +147,37 @@ func newPortalCommand(config *specs.Config) *cobra.Command {
 	flags.Bool("stdin", false, "Read tar flow from stdin.")
 	flags.String("file", "", "Read tar flow from specified file.")
 	flags.String("compression", "",
-		"Specify tarball compression and ignoring extension of the file."+
-			" Possible values: gz|gzip|zstd|xz|bz2|bzip2|none.")
+		"Specify tarball compression and ignoring the detection from the content."+
+			" Possible values: auto|gz|gzip|zstd|xz|bz2|bzip2|lz4|s2|snappy|lz|lzip|none.")
+	flags.String("index", "",
+		"Define the index file of the tarball used to read only the entries"+
+			" selected by the match_prefix rules (default <file>.index.json if present).")
+	flags.Bool("secure", true,
+		"Resolve all paths inside the export directory and check unsafe entries."+
+			" Use --secure=false to disable it.")
 
 	return cmd
 }
+
+// openIndexReader opens the tarball with the index file. Without
+// an index file the default sidecar file is used if present and
+// nil is returned if the tarball can't be read with random access.
+func openIndexReader(file, indexFile string) (*index.Reader, error) {
+	if indexFile == "" {
+		indexFile = index.GetIndexFile(file)
+		if _, err := os.Stat(indexFile); err != nil {
+			return nil, nil
+		}
+	}
+
+	idx, err := index.LoadIndex(indexFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if !idx.IsSeekable() {
+		return nil, nil
+	}
+
+	return index.Open(file, idx)
+}
@@ -85,6 +85,8 @@ func initCommand(rootCmd *cobra.Command, config *specs.Config) {
 		newDockerCpCommand(config),
 		newPortalCommand(config),
 		newArchiveCommand(config),
+		newDiffLayerCommand(config),
+		newIndexCommand(config),
 	)
 }
 
@@ -0,0 +1,140 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package executor_test
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+
+	specs "github.com/geaaru/tar-formers/pkg/specs"
+	"github.com/geaaru/tar-formers/pkg/tools"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"golang.org/x/sys/unix"
+)
+
+// readTestAcl returns the access ACL of the path in text format.
+func readTestAcl(path string) string {
+	dest := make([]byte, 1024)
+	sz, err := unix.Lgetxattr(path, tools.AclXattrAccess, dest)
+	Expect(err).ToNot(HaveOccurred())
+
+	ans, err := tools.AclXattrToText(dest[:sz])
+	Expect(err).ToNot(HaveOccurred())
+	return ans
+}
+
+var _ = Describe("Acl", func() {
+
+	Context("ACL qualifiers", func() {
+		var root string
+
+		BeforeEach(func() {
+			root = filepath.Join(GinkgoT().TempDir(), "root")
+			Expect(os.MkdirAll(filepath.Join(root, "etc"), 0755)).To(Succeed())
+
+			probe := filepath.Join(root, "probe")
+			Expect(os.WriteFile(probe, []byte{}, 0644)).To(Succeed())
+			data, err := tools.AclTextToXattr("user::rw-,group::r--,other::r--", nil)
+			Expect(err).ToNot(HaveOccurred())
+			if err := unix.Lsetxattr(probe, tools.AclXattrAccess, data, 0); err != nil {
+				Skip("The filesystem doesn't support the POSIX ACLs: " + err.Error())
+			}
+
+			// The ids of the extraction root are different from the host.
+			Expect(os.WriteFile(filepath.Join(root, "etc", "passwd"),
+				[]byte("root:x:2000:2000::/root:/bin/sh\n"), 0644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(root, "etc", "group"),
+				[]byte("root:x:2000:\nstaff:x:3000:\n"), 0644)).To(Succeed())
+		})
+
+		newAclTarball := func(acl string) []testEntry {
+			return []testEntry{
+				{
+					Header: tar.Header{
+						Name: "file", Typeflag: tar.TypeReg, Mode: 0644,
+						PAXRecords: map[string]string{
+							specs.PaxAclPrefix + "access": acl,
+						},
+						Format: tar.FormatPAX,
+					},
+					Content: "data",
+				},
+			}
+		}
+
+		for _, mapEntities := range []bool{false, true} {
+			mapEntities := mapEntities
+			name := "without map_entities"
+			if mapEntities {
+				name = "with map_entities"
+			}
+
+			It("resolves the names with the extraction root "+name, func() {
+				s := specs.NewSpecFile()
+				s.SameOwner = false
+				s.MapEntities = mapEntities
+
+				buf := newTestTarball(newAclTarball(
+					"user::rw-,user:root:r--,group::r--,group:staff:r--,mask::r--,other::---"))
+				Expect(extractTestTarball(s, buf, root)).To(Succeed())
+
+				Expect(readTestAcl(filepath.Join(root, "file"))).To(Equal(
+					"user::rw-,user:2000:r--,group::r--,group:3000:r--,mask::r--,other::---"))
+			})
+		}
+
+		It("uses the numeric ids of the star format without map_entities", func() {
+			s := specs.NewSpecFile()
+			s.SameOwner = false
+
+			buf := newTestTarball(newAclTarball(
+				"user::rw-,user:root:r--:100,group::r--,mask::r--,other::---"))
+			Expect(extractTestTarball(s, buf, root)).To(Succeed())
+
+			Expect(readTestAcl(filepath.Join(root, "file"))).To(Equal(
+				"user::rw-,user:100:r--,group::r--,mask::r--,other::---"))
+		})
+
+		It("applies the remap rules", func() {
+			s := specs.NewSpecFile()
+			s.SameOwner = false
+			s.RemapUids = map[string]string{"1000-1999": "101000"}
+			s.RemapGids = map[string]string{"100": "5000"}
+			s.RemapUsers = map[string]string{"foo": "root"}
+
+			buf := newTestTarball(newAclTarball(
+				"user::rw-,user:1005:r--,user:foo:r--,group::r--,group:100:r--,mask::r--,other::---"))
+			Expect(extractTestTarball(s, buf, root)).To(Succeed())
+
+			Expect(readTestAcl(filepath.Join(root, "file"))).To(Equal(
+				"user::rw-,user:2000:r--,user:101005:r--,group::r--,group:5000:r--,mask::r--,other::---"))
+		})
+
+		It("fails on the unknown names", func() {
+			s := specs.NewSpecFile()
+			s.SameOwner = false
+
+			buf := newTestTarball(newAclTarball(
+				"user::rw-,user:nobody:r--,group::r--,mask::r--,other::---"))
+			err := extractTestTarball(s, buf, root)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("nobody"))
+		})
+	})
+})
@@ -0,0 +1,480 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package executor
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	specs "github.com/geaaru/tar-formers/pkg/specs"
+
+	"golang.org/x/sys/unix"
+)
+
+const atomicStagingPrefix = ".tar-formers-staging-"
+
+type atomicEntry struct {
+	// The final path of the file
+	Path string
+	// The path of the file on the staging directory
+	Staged string
+	// The path where the replaced file is moved when
+	// RENAME_EXCHANGE is not supported.
+	Backup string
+
+	committed bool
+	exchanged bool
+}
+
+// atomicDir contains the properties of an existing directory
+// before the changes of the extraction.
+type atomicDir struct {
+	Path   string
+	Mode   uint32
+	Uid    int
+	Gid    int
+	Atime  unix.Timespec
+	Mtime  unix.Timespec
+	Xattrs map[string]string
+}
+
+// atomicStage contains the state of an atomic extraction.
+// If the target directory doesn't exist all the files are
+// extracted in a staging directory that is renamed to the target
+// directory on success. Instead, if the target directory exists,
+// the files are extracted in a staging directory inside the target
+// directory and on success they are moved file by file with
+// RENAME_EXCHANGE. In this way the existing target directory, that
+// could be a mount point, is never replaced.
+type atomicStage struct {
+	Root     string
+	Dir      string
+	WholeDir bool
+
+	counter     int
+	entries     []*atomicEntry
+	staged      map[string]*atomicEntry
+	removed     []*atomicEntry
+	createdDirs []string
+	dirs        []*atomicDir
+	savedDirs   map[string]bool
+}
+
+func (t *TarFormers) newAtomicStage(dir string) (*atomicStage, error) {
+	var err error
+
+	dir = filepath.Clean(dir)
+	ans := &atomicStage{
+		Root:        dir,
+		entries:     []*atomicEntry{},
+		staged:      make(map[string]*atomicEntry, 0),
+		removed:     []*atomicEntry{},
+		createdDirs: []string{},
+		dirs:        []*atomicDir{},
+		savedDirs:   make(map[string]bool, 0),
+	}
+
+	_, err = os.Stat(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if os.IsNotExist(err) {
+		ans.WholeDir = true
+		parent := filepath.Dir(dir)
+
+		err = os.MkdirAll(parent, 0755)
+		if err != nil {
+			return nil, err
+		}
+
+		ans.Dir, err = os.MkdirTemp(parent,
+			"."+filepath.Base(dir)+atomicStagingPrefix)
+		if err != nil {
+			return nil, fmt.Errorf("Error on create staging directory: %s",
+				err.Error())
+		}
+
+		err = os.Chmod(ans.Dir, 0755)
+	} else {
+		ans.Dir, err = os.MkdirTemp(dir, atomicStagingPrefix)
+		if err != nil {
+			return nil, fmt.Errorf("Error on create staging directory: %s",
+				err.Error())
+		}
+	}
+
+	if err != nil {
+		os.RemoveAll(ans.Dir)
+		return nil, err
+	}
+
+	t.Logger.Debug(fmt.Sprintf("Using staging directory %s for %s.",
+		ans.Dir, dir))
+
+	return ans, nil
+}
+
+func (s *atomicStage) nextPath(prefix string) string {
+	s.counter++
+	return filepath.Join(s.Dir, prefix+strconv.Itoa(s.counter))
+}
+
+// isStaged returns true if the path is inside the staging directory.
+func (s *atomicStage) isStaged(path string) bool {
+	return path == s.Dir || strings.HasPrefix(path, s.Dir+"/")
+}
+
+// lookup returns the staged path of the path if available.
+func (s *atomicStage) lookup(path string) string {
+	if e, ok := s.staged[path]; ok {
+		return e.Staged
+	}
+	return path
+}
+
+func (s *atomicStage) addCreatedDir(dir string) {
+	if !s.isStaged(dir) {
+		s.createdDirs = append(s.createdDirs, dir)
+	}
+}
+
+// saveDir saves the properties of the existing directory before
+// that the extraction changes them.
+func (s *atomicStage) saveDir(t *TarFormers, path string) error {
+	if s.WholeDir || s.isStaged(path) || s.savedDirs[path] {
+		return nil
+	}
+
+	var stat unix.Stat_t
+	err := unix.Lstat(path, &stat)
+	if err != nil {
+		return fmt.Errorf("Error on stat directory %s: %s", path, err.Error())
+	}
+
+	xattrs, err := t.GetXattr(path)
+	if err != nil {
+		return fmt.Errorf("Error on get xattr of directory %s: %s",
+			path, err.Error())
+	}
+
+	s.dirs = append(s.dirs, &atomicDir{
+		Path:   path,
+		Mode:   stat.Mode & 07777,
+		Uid:    int(stat.Uid),
+		Gid:    int(stat.Gid),
+		Atime:  stat.Atim,
+		Mtime:  stat.Mtim,
+		Xattrs: xattrs,
+	})
+	s.savedDirs[path] = true
+
+	return nil
+}
+
+// restoreDir restores the properties of the directory saved
+// by saveDir.
+func (s *atomicStage) restoreDir(t *TarFormers, d *atomicDir) error {
+	// The chown resets the setuid and setgid bits.
+	err := os.Lchown(d.Path, d.Uid, d.Gid)
+	if err != nil {
+		return err
+	}
+
+	err = unix.Chmod(d.Path, d.Mode)
+	if err != nil {
+		return err
+	}
+
+	attrs, err := t.ListXattr(d.Path)
+	if err != nil {
+		return err
+	}
+	for _, k := range attrs {
+		if _, ok := d.Xattrs[k]; !ok {
+			err = unix.Lremovexattr(d.Path, k)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for k, v := range d.Xattrs {
+		err = unix.Lsetxattr(d.Path, k, []byte(v), 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	return unix.UtimesNanoAt(unix.AT_FDCWD, d.Path,
+		[]unix.Timespec{d.Atime, d.Mtime}, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// remove moves the path to the staging directory.
+func (s *atomicStage) remove(path string) error {
+	if _, err := os.Lstat(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	e := &atomicEntry{
+		Path:   path,
+		Staged: s.nextPath("removed-"),
+	}
+
+	if err := os.Rename(path, e.Staged); err != nil {
+		return err
+	}
+	s.removed = append(s.removed, e)
+
+	return nil
+}
+
+// commit moves all staged files to the final paths.
+func (s *atomicStage) commit(t *TarFormers) error {
+	if s.WholeDir {
+		err := os.Rename(s.Dir, s.Root)
+		if err != nil {
+			return fmt.Errorf("Error on rename staging directory %s to %s: %s",
+				s.Dir, s.Root, err.Error())
+		}
+		return nil
+	}
+
+	for _, e := range s.entries {
+		err := s.commitEntry(e)
+		if err != nil {
+			return fmt.Errorf("Error on move %s to %s: %s",
+				e.Staged, e.Path, err.Error())
+		}
+		t.Logger.Debug(fmt.Sprintf("Committed file %s.", e.Path))
+	}
+
+	// Drop the staging directory with the replaced files.
+	return os.RemoveAll(s.Dir)
+}
+
+func (s *atomicStage) commitEntry(e *atomicEntry) error {
+	if _, err := os.Lstat(e.Staged); err != nil {
+		if os.IsNotExist(err) {
+			// The file isn't been created. For example a broken link
+			// with broken_links_fatal disabled.
+			return nil
+		}
+		return err
+	}
+
+	if _, err := os.Lstat(e.Path); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+
+		err = os.Rename(e.Staged, e.Path)
+		if err != nil {
+			return err
+		}
+		e.committed = true
+		return nil
+	}
+
+	err := unix.Renameat2(unix.AT_FDCWD, e.Staged,
+		unix.AT_FDCWD, e.Path, unix.RENAME_EXCHANGE)
+	if err == nil {
+		e.committed = true
+		e.exchanged = true
+		return nil
+	}
+
+	if !errors.Is(err, unix.EINVAL) && !errors.Is(err, unix.ENOSYS) &&
+		!errors.Is(err, unix.EOPNOTSUPP) {
+		return err
+	}
+
+	// POST: RENAME_EXCHANGE not supported. Using two renames.
+	e.Backup = s.nextPath("backup-")
+	err = os.Rename(e.Path, e.Backup)
+	if err != nil {
+		e.Backup = ""
+		return err
+	}
+
+	err = os.Rename(e.Staged, e.Path)
+	if err != nil {
+		// Restore the original file
+		os.Rename(e.Backup, e.Path)
+		e.Backup = ""
+		return err
+	}
+	e.committed = true
+
+	return nil
+}
+
+// rollback restores the target directory to the original state.
+func (s *atomicStage) rollback(t *TarFormers) {
+	var err error
+
+	if s.WholeDir {
+		err = os.RemoveAll(s.Dir)
+		if err != nil {
+			t.Logger.Warning(fmt.Sprintf(
+				"Error on remove staging directory %s: %s",
+				s.Dir, err.Error()))
+		}
+		return
+	}
+
+	// Restore the committed files in reverse order.
+	for i := len(s.entries) - 1; i >= 0; i-- {
+		e := s.entries[i]
+		if !e.committed {
+			continue
+		}
+
+		if e.exchanged {
+			err = unix.Renameat2(unix.AT_FDCWD, e.Staged,
+				unix.AT_FDCWD, e.Path, unix.RENAME_EXCHANGE)
+		} else if e.Backup != "" {
+			err = os.Rename(e.Backup, e.Path)
+		} else {
+			err = os.Remove(e.Path)
+		}
+
+		if err != nil {
+			t.Logger.Warning(fmt.Sprintf(
+				"Error on restore file %s: %s", e.Path, err.Error()))
+		}
+	}
+
+	// Restore the removed files.
+	for i := len(s.removed) - 1; i >= 0; i-- {
+		e := s.removed[i]
+		err = os.Rename(e.Staged, e.Path)
+		if err != nil {
+			t.Logger.Warning(fmt.Sprintf(
+				"Error on restore file %s: %s", e.Path, err.Error()))
+		}
+	}
+
+	// Remove the created directories.
+	for i := len(s.createdDirs) - 1; i >= 0; i-- {
+		err = os.RemoveAll(s.createdDirs[i])
+		if err != nil {
+			t.Logger.Warning(fmt.Sprintf(
+				"Error on remove directory %s: %s",
+				s.createdDirs[i], err.Error()))
+		}
+	}
+
+	err = os.RemoveAll(s.Dir)
+	if err != nil {
+		t.Logger.Warning(fmt.Sprintf(
+			"Error on remove staging directory %s: %s",
+			s.Dir, err.Error()))
+	}
+
+	// Restore the properties of the existing directories at the end
+	// because the changes of the files update the times.
+	for i := len(s.dirs) - 1; i >= 0; i-- {
+		err = s.restoreDir(t, s.dirs[i])
+		if err != nil {
+			t.Logger.Warning(fmt.Sprintf(
+				"Error on restore directory %s: %s",
+				s.dirs[i].Path, err.Error()))
+		}
+	}
+}
+
+// GetWritePath returns the path where the file with the final path
+// must be written. With the atomic extraction the file is written in
+// the staging directory and the parent directory of the final path
+// is created.
+func (t *TarFormers) GetWritePath(path string) (string, error) {
+	if t.stage == nil || t.stage.WholeDir || t.stage.isStaged(path) {
+		return path, nil
+	}
+
+	if e, ok := t.stage.staged[path]; ok {
+		return e.Staged, nil
+	}
+
+	_, err := t.CreateDir(filepath.Dir(path), 0755)
+	if err != nil {
+		return "", err
+	}
+
+	e := &atomicEntry{
+		Path:   path,
+		Staged: t.stage.nextPath("file-"),
+	}
+	t.stage.entries = append(t.stage.entries, e)
+	t.stage.staged[path] = e
+
+	return e.Staged, nil
+}
+
+// stageLink updates the paths of the link to use the staging directory.
+func (t *TarFormers) stageLink(link *specs.Link) error {
+	var err error
+
+	if link.TypeFlag == tar.TypeLink {
+		link.Linkname = t.getStagedPath(link.Linkname)
+	}
+
+	link.Path, err = t.GetWritePath(link.Path)
+	return err
+}
+
+// getStagedPath returns the path where the file with the final path
+// is been written.
+func (t *TarFormers) getStagedPath(path string) string {
+	if t.stage == nil {
+		return path
+	}
+	return t.stage.lookup(path)
+}
+
+// removePath removes the path. With the atomic extraction the path
+// is moved to the staging directory and restored on rollback.
+func (t *TarFormers) removePath(path string) error {
+	if t.stage == nil || t.stage.WholeDir {
+		return os.RemoveAll(path)
+	}
+	return t.stage.remove(path)
+}
+
+// firstMissingDir returns the first parent of the directory
+// that doesn't exist.
+func firstMissingDir(dir string) string {
+	ans := dir
+	for {
+		parent := filepath.Dir(ans)
+		if parent == ans {
+			return ans
+		}
+		if _, err := os.Lstat(parent); err == nil {
+			return ans
+		}
+		ans = parent
+	}
+}
@@ -0,0 +1,195 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package executor_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing/iotest"
+
+	. "github.com/geaaru/tar-formers/pkg/executor"
+	specs "github.com/geaaru/tar-formers/pkg/specs"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"golang.org/x/sys/unix"
+)
+
+var errTestInjected = errors.New("injected error")
+
+// newBrokenTestTarball returns a reader of the tarball of the entries
+// that fails with errTestInjected after the entries.
+func newBrokenTestTarball(entries []testEntry) io.Reader {
+	data := newTestTarball(entries).Bytes()
+	// Drop the two zero blocks of the end of the archive.
+	data = data[:len(data)-1024]
+	return io.MultiReader(bytes.NewReader(data), iotest.ErrReader(errTestInjected))
+}
+
+// listStagingDirs returns the staging directories under the directory.
+func listStagingDirs(dir string) []string {
+	ans := []string{}
+	entries, err := os.ReadDir(dir)
+	Expect(err).ToNot(HaveOccurred())
+	for _, e := range entries {
+		if strings.Contains(e.Name(), ".tar-formers-staging-") {
+			ans = append(ans, e.Name())
+		}
+	}
+	return ans
+}
+
+var _ = Describe("Atomic", func() {
+
+	Context("Atomic extraction", func() {
+		var tmpdir, root string
+
+		BeforeEach(func() {
+			tmpdir = GinkgoT().TempDir()
+			root = filepath.Join(tmpdir, "root")
+		})
+
+		newAtomicSpec := func() *specs.SpecFile {
+			s := specs.NewSpecFile()
+			s.SameOwner = os.Getuid() == 0
+			s.OverwritePerms = true
+			s.Atomic = true
+			return s
+		}
+
+		It("restores the existing files and directories on error", func() {
+			etc := filepath.Join(root, "etc")
+			Expect(os.MkdirAll(etc, 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(etc, "old"), []byte("old"), 0644)).To(Succeed())
+			hasXattr := unix.Lsetxattr(etc, "user.keep", []byte("1"), 0) == nil
+
+			var before unix.Stat_t
+			Expect(unix.Lstat(etc, &before)).To(Succeed())
+
+			t := NewTarFormers(specs.NewConfig(nil))
+			t.SetReader(newBrokenTestTarball([]testEntry{
+				{
+					Header: tar.Header{
+						Name: "etc", Typeflag: tar.TypeDir, Mode: 0700,
+						Uid: 1234, Gid: 1234,
+						PAXRecords: map[string]string{
+							specs.PaxXattrPrefix + "user.new": "1",
+						},
+						Format: tar.FormatPAX,
+					},
+				},
+				{
+					Header:  tar.Header{Name: "etc/old", Typeflag: tar.TypeReg, Mode: 0600},
+					Content: "new",
+				},
+				{
+					Header:  tar.Header{Name: "etc/new", Typeflag: tar.TypeReg, Mode: 0644},
+					Content: "data",
+				},
+				{
+					Header: tar.Header{Name: "newdir/sub", Typeflag: tar.TypeDir, Mode: 0755},
+				},
+			}))
+
+			err := t.RunTask(newAtomicSpec(), root)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(errTestInjected.Error()))
+
+			var after unix.Stat_t
+			Expect(unix.Lstat(etc, &after)).To(Succeed())
+			Expect(after.Mode).To(Equal(before.Mode))
+			Expect(after.Uid).To(Equal(before.Uid))
+			Expect(after.Gid).To(Equal(before.Gid))
+			Expect(after.Mtim).To(Equal(before.Mtim))
+
+			if hasXattr {
+				xattrs, err := t.GetXattr(etc)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(xattrs).To(HaveKeyWithValue("user.keep", "1"))
+				Expect(xattrs).ToNot(HaveKey("user.new"))
+			}
+
+			data, err := os.ReadFile(filepath.Join(etc, "old"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(Equal("old"))
+
+			_, err = os.Lstat(filepath.Join(etc, "new"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+			_, err = os.Lstat(filepath.Join(root, "newdir"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+
+			Expect(listStagingDirs(root)).To(BeEmpty())
+		})
+
+		It("keeps the existing empty target directory", func() {
+			Expect(os.MkdirAll(root, 0711)).To(Succeed())
+			Expect(os.Chmod(root, 0711)).To(Succeed())
+			hasXattr := unix.Lsetxattr(root, "user.keep", []byte("1"), 0) == nil
+
+			info, err := os.Stat(root)
+			Expect(err).ToNot(HaveOccurred())
+			ino := info.Sys().(*syscall.Stat_t).Ino
+
+			buf := newTestTarball([]testEntry{
+				{
+					Header:  tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0644},
+					Content: "data",
+				},
+			})
+			Expect(extractTestTarball(newAtomicSpec(), buf, root)).To(Succeed())
+
+			info, err = os.Stat(root)
+			Expect(err).ToNot(HaveOccurred())
+			// The directory isn't replaced: it could be a mount point.
+			Expect(info.Sys().(*syscall.Stat_t).Ino).To(Equal(ino))
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0711)))
+
+			if hasXattr {
+				dest := make([]byte, 16)
+				sz, err := unix.Lgetxattr(root, "user.keep", dest)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(dest[:sz])).To(Equal("1"))
+			}
+
+			data, err := os.ReadFile(filepath.Join(root, "file"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(Equal("data"))
+			Expect(listStagingDirs(root)).To(BeEmpty())
+		})
+
+		It("removes the new target directory on error", func() {
+			t := NewTarFormers(specs.NewConfig(nil))
+			t.SetReader(newBrokenTestTarball([]testEntry{
+				{
+					Header:  tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0644},
+					Content: "data",
+				},
+			}))
+
+			Expect(t.RunTask(newAtomicSpec(), root)).ToNot(Succeed())
+
+			_, err := os.Lstat(root)
+			Expect(os.IsNotExist(err)).To(BeTrue())
+			Expect(listStagingDirs(tmpdir)).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,309 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package executor
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	specs "github.com/geaaru/tar-formers/pkg/specs"
+
+	"golang.org/x/sys/unix"
+)
+
+// RunTaskDiffLayer writes to the writer a tar stream with the files
+// added or modified in the upper directory in relation to the lower
+// directory and the whiteouts of the removed files.
+func (t *TarFormers) RunTaskDiffLayer(task *specs.SpecFile, lower, upper string) error {
+	if task == nil {
+		return errors.New("Invalid task")
+	}
+
+	if lower == "" || upper == "" {
+		return errors.New("Invalid lower or upper directory")
+	}
+
+	if task.Writer == nil {
+		task.Writer = specs.NewWriter()
+	}
+
+	t.TaskWriter = task
+	err := t.TaskWriter.Prepare()
+	if err != nil {
+		return err
+	}
+
+	err = t.prepareReproducible()
+	if err != nil {
+		return err
+	}
+
+	tarWriter := tar.NewWriter(t.writer)
+	defer tarWriter.Close()
+
+	return t.HandleTarFlowDiffLayer(tarWriter, lower, upper)
+}
+
+func (t *TarFormers) HandleTarFlowDiffLayer(tw *tar.Writer, lower, upper string) error {
+	imap := make(map[inodeResource]string, 0)
+	// Directories of the upper with the opaque marker
+	opaqueDirs := make(map[string]bool, 0)
+
+	lower = filepath.Clean(lower)
+	upper = filepath.Clean(upper)
+
+	for _, d := range []string{lower, upper} {
+		info, err := os.Stat(d)
+		if err != nil {
+			return fmt.Errorf("Error on stat directory %s: %s", d, err.Error())
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("Path %s is not a directory", d)
+		}
+	}
+
+	// Write the files added or modified.
+	err := filepath.Walk(upper, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path == upper {
+			return nil
+		}
+
+		rel, err := filepath.Rel(upper, path)
+		if err != nil {
+			return err
+		}
+
+		if isOverlayWhiteout(info) {
+			// Convert the overlayfs whiteout to the OCI whiteout.
+			return t.writeWhiteout(tw, filepath.Join(
+				filepath.Dir(rel), WhiteoutPrefix+filepath.Base(rel)))
+		}
+
+		lowerPath := filepath.Join(lower, rel)
+		linfo, err := os.Lstat(lowerPath)
+		if err != nil && !os.IsNotExist(err) && !errors.Is(err, syscall.ENOTDIR) {
+			return err
+		}
+
+		if err == nil && !isDiffChanged(linfo, info, lowerPath, path) {
+			return nil
+		}
+
+		if t.TaskWriter.IsPath2Skip(path) {
+			t.Logger.Debug(fmt.Sprintf("File %s skipped.", path))
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		t.Logger.Debug(fmt.Sprintf("Adding changed path %s.", rel))
+
+		err = t.InjectFile2Writer(tw, path, t.TaskWriter.GetRename(rel), &info, &imap)
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() && linfo != nil && linfo.IsDir() {
+			opaque, err := isDiffOpaqueDir(lowerPath, path)
+			if err != nil {
+				return err
+			}
+			if opaque {
+				opaqueDirs[rel] = true
+				return t.writeWhiteout(tw, filepath.Join(rel, WhiteoutOpaqueDir))
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Error on process upper directory %s: %s",
+			upper, err.Error())
+	}
+
+	// Write the whiteouts of the removed files.
+	err = filepath.Walk(lower, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path == lower {
+			return nil
+		}
+
+		rel, err := filepath.Rel(lower, path)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := opaqueDirs[rel]; ok {
+			// All the files of the directory are already hidden.
+			return filepath.SkipDir
+		}
+
+		uinfo, err := os.Lstat(filepath.Join(upper, rel))
+		if err == nil {
+			if info.IsDir() && !uinfo.IsDir() {
+				// The directory is been replaced.
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !os.IsNotExist(err) && !errors.Is(err, syscall.ENOTDIR) {
+			return err
+		}
+
+		err = t.writeWhiteout(tw, filepath.Join(
+			filepath.Dir(rel), WhiteoutPrefix+filepath.Base(rel)))
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Error on process lower directory %s: %s",
+			lower, err.Error())
+	}
+
+	return nil
+}
+
+// writeWhiteout writes an empty file used as whiteout.
+func (t *TarFormers) writeWhiteout(tw *tar.Writer, name string) error {
+	header := &tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0,
+		Size:     0,
+		ModTime:  time.Unix(0, 0),
+	}
+
+	if t.TaskWriter.IsPath2Skip(name) {
+		t.Logger.Debug(fmt.Sprintf("Whiteout %s skipped.", name))
+		return nil
+	}
+
+	t.Logger.Debug(fmt.Sprintf("Adding whiteout %s.", name))
+
+	err := t.convertHeader(header)
+	if err != nil {
+		return err
+	}
+
+	err = t.beginEntry(tw)
+	if err != nil {
+		return err
+	}
+
+	err = tw.WriteHeader(header)
+	if err != nil {
+		return fmt.Errorf(
+			"Error on write header for whiteout '%s': %s",
+			name, err.Error())
+	}
+
+	return nil
+}
+
+// isDiffChanged returns true if the upper file is different from
+// the lower file.
+func isDiffChanged(lower, upper fs.FileInfo, lowerPath, upperPath string) bool {
+	if lower.Mode() != upper.Mode() {
+		return true
+	}
+
+	lstat := lower.Sys().(*syscall.Stat_t)
+	ustat := upper.Sys().(*syscall.Stat_t)
+
+	if lstat.Uid != ustat.Uid || lstat.Gid != ustat.Gid {
+		return true
+	}
+
+	if upper.IsDir() {
+		opaque, _ := isDiffOpaqueDir(lowerPath, upperPath)
+		return opaque
+	}
+
+	if lower.Size() != upper.Size() || !lower.ModTime().Equal(upper.ModTime()) {
+		return true
+	}
+
+	if lstat.Rdev != ustat.Rdev {
+		return true
+	}
+
+	if upper.Mode()&os.ModeSymlink != 0 {
+		l1, err1 := os.Readlink(lowerPath)
+		l2, err2 := os.Readlink(upperPath)
+		return err1 != nil || err2 != nil || l1 != l2
+	}
+
+	return false
+}
+
+// isDiffOpaqueDir returns true if the upper directory replaces the
+// lower directory: the upper directory has the overlayfs opaque
+// attribute or all the files of the lower directory are removed.
+func isDiffOpaqueDir(lowerDir, upperDir string) (bool, error) {
+	dest := make([]byte, 1)
+	sz, err := unix.Lgetxattr(upperDir, overlayOpaqueXattr, dest)
+	if err == nil && sz == 1 && dest[0] == 'y' {
+		return true, nil
+	}
+
+	lentries, err := os.ReadDir(lowerDir)
+	if err != nil {
+		return false, err
+	}
+
+	if len(lentries) == 0 {
+		return false, nil
+	}
+
+	for _, e := range lentries {
+		_, err := os.Lstat(filepath.Join(upperDir, e.Name()))
+		if err == nil {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// isOverlayWhiteout returns true if the file is an overlayfs whiteout.
+func isOverlayWhiteout(info fs.FileInfo) bool {
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	stat := info.Sys().(*syscall.Stat_t)
+	return stat.Rdev == 0
+}
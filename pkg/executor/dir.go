@@ -28,7 +28,10 @@ func (t *TarFormers) CreateDir(dir string, mode os.FileMode) (bool, error) {
 
 	if _, err := os.Stat(dir); err != nil {
 		if os.IsNotExist(err) {
-
+			if t.stage != nil && !t.stage.WholeDir {
+				// Track the new directories for the rollback.
+				t.stage.addCreatedDir(firstMissingDir(dir))
+			}
 			return true, os.MkdirAll(dir, mode)
 		} else {
 			return false, err
@@ -0,0 +1,160 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package executor
+
+import (
+	"archive/tar"
+	"fmt"
+
+	"github.com/geaaru/tar-formers/pkg/tools"
+)
+
+// LoadEntities reads the users and groups database used to
+// resolve the owners of the tar entries on extraction.
+func (t *TarFormers) LoadEntities(root string) error {
+	db, err := tools.NewEntitiesDbFromRoot(root)
+	if err != nil {
+		return err
+	}
+
+	if db.IsEmpty() {
+		t.Logger.Warning(fmt.Sprintf(
+			"No users and groups found under %s. Using numeric ids.",
+			root))
+	}
+
+	t.entities = db
+	return nil
+}
+
+// LoadWriterEntities reads the users and groups database used
+// to set the user and group names of the archived files.
+func (t *TarFormers) LoadWriterEntities(root string) error {
+	db, err := tools.NewEntitiesDbFromRoot(root)
+	if err != nil {
+		return err
+	}
+
+	t.writerEntities = db
+	return nil
+}
+
+// mapHeaderEntities resolves the user and group names of the header
+// with the ids of the extraction root. If the name is not
+// available the numeric id is maintained.
+func (t *TarFormers) mapHeaderEntities(header *tar.Header) {
+	if t.entities == nil {
+		return
+	}
+
+	if header.Uname != "" {
+		if uid, ok := t.entities.GetUid(header.Uname); ok {
+			header.Uid = uid
+		} else {
+			t.Logger.Debug(fmt.Sprintf(
+				"[%s] User %s not found. Using uid %d.",
+				header.Name, header.Uname, header.Uid))
+		}
+	}
+
+	if header.Gname != "" {
+		if gid, ok := t.entities.GetGid(header.Gname); ok {
+			header.Gid = gid
+		} else {
+			t.Logger.Debug(fmt.Sprintf(
+				"[%s] Group %s not found. Using gid %d.",
+				header.Name, header.Gname, header.Gid))
+		}
+	}
+}
+
+// mapHeaderNames sets the user and group names of the header
+// from the writer users and groups database.
+func (t *TarFormers) mapHeaderNames(header *tar.Header) {
+	if t.writerEntities == nil {
+		return
+	}
+
+	header.Uname, _ = t.writerEntities.GetUser(header.Uid)
+	header.Gname, _ = t.writerEntities.GetGroup(header.Gid)
+}
+
+// mapAclId returns the id of the qualifier of an ACL entry with the
+// same rules used for the owner of the header: the remap rules are
+// applied and the names are resolved with the users and groups of
+// the extraction root. The name is resolved only with map_entities
+// or if the numeric id isn't available.
+func (t *TarFormers) mapAclId(name string, id int, group bool) (int, error) {
+	if group {
+		name = t.Task.RemapGroup(name)
+	} else {
+		name = t.Task.RemapUser(name)
+	}
+	if id >= 0 {
+		if group {
+			id = t.Task.RemapGid(id)
+		} else {
+			id = t.Task.RemapUid(id)
+		}
+	}
+
+	if name == "" || (id >= 0 && t.entities == nil) {
+		return id, nil
+	}
+
+	db, err := t.getAclEntities()
+	if err != nil {
+		return 0, err
+	}
+
+	var ans int
+	var ok bool
+	if group {
+		ans, ok = db.GetGid(name)
+	} else {
+		ans, ok = db.GetUid(name)
+	}
+	if ok {
+		return ans, nil
+	}
+
+	if id < 0 {
+		return 0, fmt.Errorf("ACL name %s not found under %s", name, db.Root)
+	}
+
+	t.Logger.Debug(fmt.Sprintf("ACL name %s not found. Using id %d.", name, id))
+	return id, nil
+}
+
+// getAclEntities returns the users and groups database of the
+// extraction root. Without map_entities the database is read
+// on the first ACL name to resolve.
+func (t *TarFormers) getAclEntities() (*tools.EntitiesDb, error) {
+	if t.entities != nil {
+		return t.entities, nil
+	}
+
+	if t.aclEntities == nil {
+		db, err := tools.NewEntitiesDbFromRoot(t.entitiesRoot)
+		if err != nil {
+			return nil, err
+		}
+		t.aclEntities = db
+	}
+
+	return t.aclEntities, nil
+}
@@ -0,0 +1,110 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package executor_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	. "github.com/geaaru/tar-formers/pkg/executor"
+	specs "github.com/geaaru/tar-formers/pkg/specs"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Entities", func() {
+
+	Context("Map the names of the archived files", func() {
+		var src, root string
+
+		BeforeEach(func() {
+			tmpdir := GinkgoT().TempDir()
+			src = filepath.Join(tmpdir, "src")
+			root = filepath.Join(tmpdir, "root")
+			Expect(os.MkdirAll(src, 0755)).To(Succeed())
+			Expect(os.MkdirAll(filepath.Join(root, "etc"), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(src, "file"),
+				[]byte("data"), 0644)).To(Succeed())
+		})
+
+		archive := func() map[string]string {
+			s := specs.NewSpecFile()
+			s.Writer = specs.NewWriter()
+			s.Writer.ArchiveDirs = []string{src}
+			s.MapEntities = true
+			s.EntitiesRoot = root
+
+			buf := bytes.NewBuffer(nil)
+			t := NewTarFormers(specs.NewConfig(nil))
+			t.SetWriter(buf)
+			Expect(t.RunTaskWriter(s)).To(Succeed())
+
+			h := readTestTarball(buf)["file"]
+			Expect(h).ToNot(BeNil())
+			Expect(h.Uid).To(Equal(os.Getuid()))
+			Expect(h.Gid).To(Equal(os.Getgid()))
+			return map[string]string{"uname": h.Uname, "gname": h.Gname}
+		}
+
+		writeEntities := func(dir, user, group string) {
+			Expect(os.MkdirAll(dir, 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "passwd"), []byte(fmt.Sprintf(
+				"%s:x:%d:%d::/:/bin/sh\n", user, os.Getuid(), os.Getgid())),
+				0644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "group"), []byte(fmt.Sprintf(
+				"%s:x:%d:\n", group, os.Getgid())), 0644)).To(Succeed())
+		}
+
+		It("sets the names of the entities root", func() {
+			writeEntities(filepath.Join(root, "etc"), "builder", "builders")
+
+			Expect(archive()).To(Equal(map[string]string{
+				"uname": "builder", "gname": "builders",
+			}))
+		})
+
+		It("resolves the symlinks of the files inside the entities root", func() {
+			writeEntities(filepath.Join(root, "shared"), "builder", "builders")
+			// The absolute symlinks are resolved under the root and not
+			// with the files of the host.
+			Expect(os.Symlink("/shared/passwd",
+				filepath.Join(root, "etc", "passwd"))).To(Succeed())
+			Expect(os.Symlink("../../../../shared/group",
+				filepath.Join(root, "etc", "group"))).To(Succeed())
+
+			Expect(archive()).To(Equal(map[string]string{
+				"uname": "builder", "gname": "builders",
+			}))
+		})
+
+		It("clears the names not found", func() {
+			Expect(os.WriteFile(filepath.Join(root, "etc", "passwd"), []byte(fmt.Sprintf(
+				"other:x:%d:%d::/:/bin/sh\n", os.Getuid()+1, os.Getgid())),
+				0644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(root, "etc", "group"), []byte(fmt.Sprintf(
+				"other:x:%d:\n", os.Getgid()+1)), 0644)).To(Succeed())
+
+			Expect(archive()).To(Equal(map[string]string{"uname": "", "gname": ""}))
+		})
+
+		It("clears the names without the files of the entities root", func() {
+			Expect(archive()).To(Equal(map[string]string{"uname": "", "gname": ""}))
+		})
+	})
+})
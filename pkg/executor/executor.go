@@ -19,16 +19,21 @@ package executor
 import (
 	"archive/tar"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	log "github.com/geaaru/tar-formers/pkg/logger"
 	specs "github.com/geaaru/tar-formers/pkg/specs"
+	tools "github.com/geaaru/tar-formers/pkg/tools"
 
 	"golang.org/x/sync/semaphore"
 )
@@ -40,6 +45,13 @@ var mutex sync.Mutex
 // Default Tarformers Robot instance
 var optimusPrime *TarFormers = nil
 
+// TarFileOperation contains the operations requested by the file
+// handler for the entry. The file handler is called only one time for
+// every triggered entry, before the rename rules, the filters and the
+// overwrite policy. The handler could consume the content of the
+// entry only when the entry is skipped with the Skip option.
+// The entries skipped later by the overwrite policy are notified to
+// the skip handler (see SetSkipHandler) and to the journal.
 type TarFileOperation struct {
 	Rename  bool
 	NewName string
@@ -62,12 +74,29 @@ type TarFormers struct {
 	reader      io.Reader          `yaml:"-" json:"-"`
 	fileHandler TarFileHandlerFunc `yaml:"-" json:"-"`
 
+	journalHandler TarJournalHandlerFunc `yaml:"-" json:"-"`
+	skipHandler    TarSkipHandlerFunc    `yaml:"-" json:"-"`
+
 	writer            io.Writer                `yaml:"-" json:"-"`
 	fileWriterHandler TarFileWriterHandlerFunc `yaml:"-" json:"-"`
 
 	Task       *specs.SpecFile `yaml:"task,omitempty" json:"task,omitempty"`
 	TaskWriter *specs.SpecFile `yaml:"task_writer,omitempty" json:"task_writer,omitempty"`
 
+	// Journal of the changes done by the last extraction.
+	Journal *specs.Journal `yaml:"journal,omitempty" json:"journal,omitempty"`
+
+	// Protected files written as ._cfgNNNN_<name> by the last extraction.
+	ConfigUpdates []string `yaml:"config_updates,omitempty" json:"config_updates,omitempty"`
+
+	// Users and groups used by map_entities
+	entities       *tools.EntitiesDb `yaml:"-" json:"-"`
+	writerEntities *tools.EntitiesDb `yaml:"-" json:"-"`
+	// Users and groups of the extraction root used to resolve
+	// the ACL names without map_entities.
+	entitiesRoot string
+	aclEntities  *tools.EntitiesDb
+
 	//Using wait group to run f.Sync in parallel
 	// Run f.Sync kills time processing.
 	waitGroup *sync.WaitGroup
@@ -76,6 +105,18 @@ type TarFormers struct {
 
 	flushMutex sync.Mutex
 	FlushErrs  []error
+
+	// Paths created by the current layer used with whiteouts
+	layerPaths map[string]bool
+
+	// Recorder of the raw headers used by bridge
+	bridgeRecorder *sparseHeaderRecorder
+
+	// Staging of the atomic extraction
+	stage *atomicStage
+
+	// Source date epoch of the reproducible tarballs
+	sourceDate time.Time
 }
 
 func SetDefaultTarFormers(t *TarFormers) {
@@ -155,12 +196,32 @@ func (t *TarFormers) RunTaskWriter(task *specs.SpecFile) error {
 	}
 
 	t.TaskWriter = task
-	t.TaskWriter.Prepare()
+	err := t.TaskWriter.Prepare()
+	if err != nil {
+		return err
+	}
+
+	err = t.prepareReproducible()
+	if err != nil {
+		return err
+	}
+
+	t.writerEntities = nil
+	if task.MapEntities {
+		root := task.EntitiesRoot
+		if root == "" {
+			root = "/"
+		}
+		err = t.LoadWriterEntities(root)
+		if err != nil {
+			return err
+		}
+	}
 
 	tarWriter := tar.NewWriter(t.writer)
 	defer tarWriter.Close()
 
-	err := t.HandleTarFlowWriter(tarWriter)
+	err = t.HandleTarFlowWriter(tarWriter)
 	if err != nil {
 		return err
 	}
@@ -180,15 +241,30 @@ func (t *TarFormers) RunTaskBridge(in, out *specs.SpecFile) error {
 	t.TaskWriter = out
 	t.Task = in
 
-	t.Task.Prepare()
-	t.TaskWriter.Prepare()
+	err := t.Task.Prepare()
+	if err != nil {
+		return err
+	}
+	err = t.TaskWriter.Prepare()
+	if err != nil {
+		return err
+	}
 
 	tarWriter := tar.NewWriter(t.writer)
 	defer tarWriter.Close()
 
-	tarReader := tar.NewReader(t.reader)
+	// The raw headers are recorded to pass through the sparse maps.
+	t.bridgeRecorder = nil
+	reader := t.reader
+	if t.TaskWriter.Sparse && t.canWriteSparse() {
+		t.bridgeRecorder = newSparseHeaderRecorder(t.reader)
+		reader = t.bridgeRecorder
+	}
+
+	tarReader := tar.NewReader(reader)
 
-	err := t.HandlerTarBridgeFlow(tarReader, tarWriter)
+	err = t.HandlerTarBridgeFlow(tarReader, tarWriter)
+	t.bridgeRecorder = nil
 	if err != nil {
 		return err
 	}
@@ -200,9 +276,28 @@ func (t *TarFormers) HandlerTarBridgeFlow(
 	tarReader *tar.Reader, tarWriter *tar.Writer) error {
 	var ans error = nil
 
+	limits := t.newLimitsChecker(t.Task)
+
 	for {
+		var raw []byte
+
+		if t.bridgeRecorder != nil {
+			// Consume the content of the previous entry to record
+			// only the blocks of the next entry.
+			_, err := io.Copy(io.Discard, tarReader)
+			if err != nil {
+				ans = err
+				break
+			}
+			t.bridgeRecorder.begin()
+		}
+
 		header, err := tarReader.Next()
 
+		if t.bridgeRecorder != nil {
+			raw = t.bridgeRecorder.end()
+		}
+
 		if err == io.EOF {
 			err = nil
 			break
@@ -213,6 +308,11 @@ func (t *TarFormers) HandlerTarBridgeFlow(
 			break
 		}
 
+		err = limits.CheckHeader(header)
+		if err != nil {
+			return err
+		}
+
 		name := header.Name
 
 		// Call file handler also for file that could be skipped and permit
@@ -291,6 +391,49 @@ func (t *TarFormers) HandlerTarBridgeFlow(
 
 		header.Name = name
 
+		// Apply the remap of the owner of both reader and writer rules.
+		t.Task.RemapHeader(header)
+		t.TaskWriter.RemapHeader(header)
+
+		if specs.IsSparseHeader(header) {
+			var datas []SparseEntry
+
+			if t.TaskWriter.Sparse && t.canWriteSparse() {
+				datas, err = ParseSparseMap(raw, header)
+				if err != nil {
+					return fmt.Errorf("Error on parse sparse map of the file %s: %s",
+						header.Name, err.Error())
+				}
+			}
+
+			if datas != nil {
+				err = t.bridgeSparseFile(tarWriter, header, datas,
+					limits.Reader(tarReader, header.Name))
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			// The content is written with the holes inflated.
+			header.Typeflag = tar.TypeReg
+			for k := range header.PAXRecords {
+				if strings.HasPrefix(k, "GNU.sparse.") {
+					delete(header.PAXRecords, k)
+				}
+			}
+		}
+
+		err = t.convertHeader(header)
+		if err != nil {
+			return err
+		}
+
+		err = t.beginEntry(tarWriter)
+		if err != nil {
+			return err
+		}
+
 		// Write tar header
 		err = tarWriter.WriteHeader(header)
 		if err != nil {
@@ -301,15 +444,17 @@ func (t *TarFormers) HandlerTarBridgeFlow(
 
 		switch header.Typeflag {
 		case tar.TypeReg, tar.TypeRegA:
-			nb, err := io.Copy(tarWriter, tarReader)
-			if err != nil {
+			nb, err := io.Copy(tarWriter, limits.Reader(tarReader, header.Name))
+			if IsLimitError(err) {
+				return err
+			} else if err != nil {
 				return fmt.Errorf(
 					"Error on write file %s: %s", name, err.Error())
 			}
 			if nb != header.Size {
 				return fmt.Errorf(
-					"For file %s written %s instead of %s bytes.",
-					nb, header.Size)
+					"For file %s written %d instead of %d bytes.",
+					name, nb, header.Size)
 			}
 		}
 
@@ -325,7 +470,7 @@ func (t *TarFormers) HandleTarFlowWriter(tarWriter *tar.Writer) error {
 
 	// Write all directories selected
 	if len(t.TaskWriter.Writer.ArchiveDirs) > 0 {
-		for _, d := range t.TaskWriter.Writer.ArchiveDirs {
+		for _, d := range t.getArchivePaths(t.TaskWriter.Writer.ArchiveDirs) {
 			err := t.InjectDir2Writer(tarWriter, d, &imap)
 			if err != nil {
 				return fmt.Errorf(
@@ -338,7 +483,7 @@ func (t *TarFormers) HandleTarFlowWriter(tarWriter *tar.Writer) error {
 
 	// Write all files selected
 	if len(t.TaskWriter.Writer.ArchiveFiles) > 0 {
-		for _, f := range t.TaskWriter.Writer.ArchiveFiles {
+		for _, f := range t.getArchivePaths(t.TaskWriter.Writer.ArchiveFiles) {
 			info, err := os.Stat(f)
 			if err != nil {
 				return fmt.Errorf(
@@ -366,10 +511,41 @@ func (t *TarFormers) RunTask(task *specs.SpecFile, dir string) error {
 	}
 
 	t.Task = task
+	t.stage = nil
+	t.Journal = nil
+	t.ConfigUpdates = []string{}
+	if task.HasJournal() || t.HasJournalHandler() {
+		t.Journal = specs.NewJournal(dir)
+	}
 
-	_, err := t.CreateDir(dir, 0755)
-	if err != nil {
-		return err
+	var err error
+	extractDir := dir
+	if task.Atomic {
+		t.stage, err = t.newAtomicStage(dir)
+		if err != nil {
+			return err
+		}
+		if t.stage.WholeDir {
+			extractDir = t.stage.Dir
+		}
+	} else {
+		_, err = t.CreateDir(dir, 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	t.entities = nil
+	t.aclEntities = nil
+	t.entitiesRoot = task.EntitiesRoot
+	if t.entitiesRoot == "" {
+		t.entitiesRoot = dir
+	}
+	if task.MapEntities {
+		err = t.LoadEntities(t.entitiesRoot)
+		if err != nil {
+			return err
+		}
 	}
 
 	// Setup parallel context and semaphore
@@ -386,21 +562,47 @@ func (t *TarFormers) RunTask(task *specs.SpecFile, dir string) error {
 
 	tarReader := tar.NewReader(t.reader)
 
-	defer t.waitGroup.Wait()
+	err = t.HandleTarFlow(tarReader, extractDir)
 
-	err = t.HandleTarFlow(tarReader, dir)
-	if err != nil {
-		return err
-	}
+	// Wait the flush of all files before check errors.
+	t.waitGroup.Wait()
 
-	if len(t.FlushErrs) > 0 {
+	if err == nil && len(t.FlushErrs) > 0 {
 		for _, e := range t.FlushErrs {
 			t.Logger.Error(e)
 		}
-		return errors.New("Received errors on flush files")
+		err = errors.New("Received errors on flush files")
 	}
 
-	return nil
+	if t.stage != nil {
+		if err == nil {
+			err = t.stage.commit(t)
+		}
+		if err != nil {
+			t.Logger.Warning(fmt.Sprintf(
+				"Restoring directory %s after error.", dir))
+			t.stage.rollback(t)
+			if t.hasJournal() {
+				t.Journal.MarkRolledBack()
+			}
+		}
+		t.stage = nil
+
+		// The journal handler is called only for the committed changes.
+		if err == nil {
+			err = t.emitJournal()
+		}
+	}
+
+	if err == nil {
+		err = t.writeJournal()
+	}
+
+	if err == nil {
+		t.reportConfigUpdates()
+	}
+
+	return err
 }
 
 func (t *TarFormers) HandleTarFlow(tarReader *tar.Reader, dir string) error {
@@ -411,7 +613,14 @@ func (t *TarFormers) HandleTarFlow(tarReader *tar.Reader, dir string) error {
 		dir = dir + "/"
 	}
 
-	t.Task.Prepare()
+	err := t.Task.Prepare()
+	if err != nil {
+		return err
+	}
+
+	whiteouts := t.Task.GetWhiteoutsMode()
+	t.layerPaths = make(map[string]bool, 0)
+	limits := t.newLimitsChecker(t.Task)
 
 	for {
 		header, err := tarReader.Next()
@@ -427,9 +636,13 @@ func (t *TarFormers) HandleTarFlow(tarReader *tar.Reader, dir string) error {
 			break
 		}
 
+		err = limits.CheckHeader(header)
+		if err != nil {
+			return err
+		}
+
 		absPath := "/" + header.Name
-		targetPath := filepath.Join(dir, header.Name)
-		var name string
+		var targetPath, name string
 
 		// Call file handler also for file that could be skipped and permit
 		// to notify this to users.
@@ -447,6 +660,10 @@ func (t *TarFormers) HandleTarFlow(tarReader *tar.Reader, dir string) error {
 
 			if opts.Skip {
 				t.Logger.Debug(fmt.Sprintf("File %s skipped.", header.Name))
+				err = t.journalSkip(filepath.Join(dir, header.Name), header, "handler")
+				if err != nil {
+					return err
+				}
 				continue
 			}
 
@@ -458,7 +675,6 @@ func (t *TarFormers) HandleTarFlow(tarReader *tar.Reader, dir string) error {
 					absPath = "/" + name
 				}
 
-				targetPath = filepath.Join(dir, name)
 			} else {
 				name = header.Name
 			}
@@ -466,7 +682,6 @@ func (t *TarFormers) HandleTarFlow(tarReader *tar.Reader, dir string) error {
 			rename := t.Task.GetRename(absPath)
 			if rename != absPath {
 				absPath = rename
-				targetPath = filepath.Join(dir, rename)
 			}
 			// Drop initial / for header name
 			name = rename[1:]
@@ -474,9 +689,55 @@ func (t *TarFormers) HandleTarFlow(tarReader *tar.Reader, dir string) error {
 
 		if t.Task.IsPath2Skip(absPath) {
 			t.Logger.Debug(fmt.Sprintf("File %s skipped.", name))
+			err = t.journalSkip(filepath.Join(dir, name), header, "filter")
+			if err != nil {
+				return err
+			}
 			continue
 		}
 
+		targetPath, err = t.GetTargetPath(dir, name, header.Typeflag == tar.TypeDir)
+		if err == nil && header.Typeflag == tar.TypeLink {
+			err = t.checkHardlink(name, header.Linkname)
+		}
+		if err != nil {
+			err = t.handleUnsafeEntry(err)
+			if err != nil {
+				return err
+			}
+			err = t.journalSkip(filepath.Join(dir, name), header, "unsafe")
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		t.Task.RemapHeader(header)
+		if t.Task.MapEntities {
+			t.mapHeaderEntities(header)
+		}
+
+		if whiteouts != specs.WhiteoutsKeep {
+			if IsWhiteout(targetPath) {
+				err = t.handleWhiteout(targetPath, header)
+				if err != nil {
+					err = t.handleUnsafeEntry(err)
+					if err != nil {
+						return err
+					}
+					err = t.journalSkip(targetPath, header, "unsafe")
+					if err != nil {
+						return err
+					}
+				}
+				continue
+			}
+
+			if whiteouts == specs.WhiteoutsApply {
+				t.addLayerPath(dir, targetPath)
+			}
+		}
+
 		info := header.FileInfo()
 
 		if t.Config.GetLogging().Level == "debug" {
@@ -486,6 +747,32 @@ func (t *TarFormers) HandleTarFlow(tarReader *tar.Reader, dir string) error {
 				header.Gid, info.Mode(), header.Linkname))
 		}
 
+		var reader io.Reader = limits.Reader(tarReader, header.Name)
+		var closer io.Closer
+
+		if header.Typeflag != tar.TypeDir {
+			var skip bool
+			skip, reader, closer, err = t.checkOverwritePolicy(
+				dir, absPath, targetPath, header, reader)
+			if err != nil {
+				return err
+			}
+
+			if skip {
+				if closer != nil {
+					closer.Close()
+				}
+				err = t.notifySkip(absPath, dir, targetPath, header)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		existed := t.existPath(targetPath)
+		digest := ""
+
 		switch header.Typeflag {
 		case tar.TypeDir:
 			newDir, err = t.CreateDir(targetPath, info.Mode())
@@ -493,11 +780,64 @@ func (t *TarFormers) HandleTarFlow(tarReader *tar.Reader, dir string) error {
 				return fmt.Errorf("Error on create directory %s: %s",
 					targetPath, err.Error())
 			}
-		case tar.TypeReg, tar.TypeRegA:
-			err = t.CreateFile(dir, name, info.Mode(), tarReader, header)
+		case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+			var hasher hash.Hash
+			var pcloser io.Closer
+			fileName := name
+
+			if t.Task.IsPathProtected(absPath) {
+				var changed bool
+				changed, reader, pcloser, err = t.compareFileContent(
+					targetPath, header.Size, reader)
+				if err != nil {
+					return fmt.Errorf("Error on compare protected file %s: %s",
+						targetPath, err.Error())
+				}
+
+				if changed {
+					fileName, targetPath, err = t.getProtectedName(dir, name)
+					if err != nil {
+						return err
+					}
+					existed = false
+					t.ConfigUpdates = append(t.ConfigUpdates, targetPath)
+					t.Logger.Debug(fmt.Sprintf(
+						"Protected file %s written as %s.", name, fileName))
+				} else if pcloser != nil {
+					// POST: the existing file has the same content.
+					pcloser.Close()
+					if closer != nil {
+						closer.Close()
+					}
+					t.Logger.Debug(fmt.Sprintf(
+						"Protected file %s not changed.", name))
+					err = t.journalSkip(targetPath, header, "identical")
+					if err != nil {
+						return err
+					}
+					continue
+				}
+			}
+
+			if t.hasJournal() {
+				hasher = sha256.New()
+				reader = io.TeeReader(reader, hasher)
+			}
+
+			err = t.CreateFile(dir, fileName, info.Mode(), reader, header)
+			if pcloser != nil {
+				pcloser.Close()
+			}
+			if closer != nil {
+				closer.Close()
+			}
 			if err != nil {
 				return err
 			}
+
+			if hasher != nil {
+				digest = hex.EncodeToString(hasher.Sum(nil))
+			}
 		case tar.TypeLink:
 			t.Logger.Debug(fmt.Sprintf("Path %s is a hardlink to %s.",
 				name, header.Linkname))
@@ -522,7 +862,7 @@ func (t *TarFormers) HandleTarFlow(tarReader *tar.Reader, dir string) error {
 					TypeFlag: header.Typeflag,
 					Meta:     specs.NewFileMeta(header),
 				})
-		case tar.TypeChar, tar.TypeBlock:
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
 			err := t.CreateBlockCharFifo(targetPath, info.Mode(), header)
 			if err != nil {
 				return err
@@ -532,10 +872,31 @@ func (t *TarFormers) HandleTarFlow(tarReader *tar.Reader, dir string) error {
 
 		// Set this an option
 		switch header.Typeflag {
-		case tar.TypeDir, tar.TypeReg, tar.TypeRegA, tar.TypeBlock, tar.TypeFifo:
+		case tar.TypeDir, tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse,
+			tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
 			meta := specs.NewFileMeta(header)
 			if header.Typeflag != tar.TypeDir || newDir || (!newDir && t.Task.OverwritePerms2Dir()) {
-				err := t.SetFileProps(targetPath, &meta, false)
+				if header.Typeflag == tar.TypeDir && !newDir && t.stage != nil {
+					// Restore the existing directory on rollback.
+					err := t.stage.saveDir(t, targetPath)
+					if err != nil {
+						return err
+					}
+				}
+
+				err := t.SetFileProps(t.getStagedPath(targetPath), &meta, false)
+				if err != nil {
+					return err
+				}
+
+				if header.Typeflag == tar.TypeDir && !newDir {
+					e := specs.NewJournalEntry(targetPath, specs.JournalChmod, header)
+					t.setJournalStat(e, t.getStagedPath(targetPath))
+					err = t.addJournalEntry(e)
+				} else {
+					err = t.journalHeader(targetPath, t.getStagedPath(targetPath),
+						header, existed, digest)
+				}
 				if err != nil {
 					return err
 				}
@@ -548,7 +909,24 @@ func (t *TarFormers) HandleTarFlow(tarReader *tar.Reader, dir string) error {
 	if len(links) > 0 {
 		//links = t.GetOrderedLinks(links)
 		for i := range links {
-			err := t.CreateLink(links[i])
+			err := t.resolveLink(dir, &links[i])
+			if err != nil {
+				err = t.handleUnsafeEntry(err)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			link := links[i]
+			existed := t.existPath(link.Path)
+
+			err = t.stageLink(&links[i])
+			if err != nil {
+				return err
+			}
+
+			err = t.CreateLink(links[i])
 			if err != nil {
 				return err
 			}
@@ -558,6 +936,11 @@ func (t *TarFormers) HandleTarFlow(tarReader *tar.Reader, dir string) error {
 			if err != nil {
 				return err
 			}
+
+			err = t.journalLink(&link, links[i].Path, existed)
+			if err != nil {
+				return err
+			}
 		}
 	}
 
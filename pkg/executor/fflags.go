@@ -0,0 +1,147 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package executor
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Inode flags of linux/fs.h
+const (
+	fsSecrmFl       = 0x00000001
+	fsUnrmFl        = 0x00000002
+	fsComprFl       = 0x00000004
+	fsSyncFl        = 0x00000008
+	fsImmutableFl   = 0x00000010
+	fsAppendFl      = 0x00000020
+	fsNodumpFl      = 0x00000040
+	fsNoatimeFl     = 0x00000080
+	fsJournalDataFl = 0x00004000
+	fsNotailFl      = 0x00008000
+	fsDirsyncFl     = 0x00010000
+	fsTopdirFl      = 0x00020000
+	fsNocowFl       = 0x00800000
+)
+
+// Map the names of the file flags used by star and libarchive
+// to the inode flags.
+var fflagsNames = map[string]int{
+	"sappnd":       fsAppendFl,
+	"sappend":      fsAppendFl,
+	"uappnd":       fsAppendFl,
+	"uappend":      fsAppendFl,
+	"append":       fsAppendFl,
+	"schg":         fsImmutableFl,
+	"schange":      fsImmutableFl,
+	"simmutable":   fsImmutableFl,
+	"uchg":         fsImmutableFl,
+	"uchange":      fsImmutableFl,
+	"uimmutable":   fsImmutableFl,
+	"immutable":    fsImmutableFl,
+	"nodump":       fsNodumpFl,
+	"noatime":      fsNoatimeFl,
+	"compress":     fsComprFl,
+	"sync":         fsSyncFl,
+	"dirsync":      fsDirsyncFl,
+	"nocow":        fsNocowFl,
+	"journal-data": fsJournalDataFl,
+	"notail":       fsNotailFl,
+	"topdir":       fsTopdirFl,
+	"secdeleted":   fsSecrmFl,
+	"undel":        fsUnrmFl,
+	"uunlink":      fsUnrmFl,
+}
+
+// ParseFileFlags converts the file flags of the SCHILY.fflags record
+// to the inode flags. The unknown flags are returned as second value.
+func ParseFileFlags(fflags string) (int, []string) {
+	ans := 0
+	unknown := []string{}
+
+	for _, name := range strings.Split(fflags, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if f, ok := fflagsNames[name]; ok {
+			ans |= f
+		} else {
+			unknown = append(unknown, name)
+		}
+	}
+
+	return ans, unknown
+}
+
+// SetFileFlags sets the file flags of the regular files and of the
+// directories in best effort fashion.
+func (t *TarFormers) SetFileFlags(path, fflags string) error {
+	flags, unknown := ParseFileFlags(fflags)
+	if len(unknown) > 0 {
+		t.Logger.Warning(fmt.Sprintf("[%s] Ignoring unknown file flags %s.",
+			path, strings.Join(unknown, ",")))
+	}
+
+	if flags == 0 {
+		return nil
+	}
+
+	if t.stage != nil {
+		// The immutable files couldn't be moved on commit.
+		t.Logger.Warning(fmt.Sprintf(
+			"[%s] File flags %s not applied with the atomic extraction.",
+			path, fflags))
+		return nil
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() && !info.IsDir() {
+		return nil
+	}
+
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_NONBLOCK|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("For path %s error on open: %s", path, err.Error())
+	}
+	defer unix.Close(fd)
+
+	current, err := unix.IoctlGetUint32(fd, unix.FS_IOC_GETFLAGS)
+	if err == nil {
+		err = unix.IoctlSetPointerInt(fd, unix.FS_IOC_SETFLAGS, int(current)|flags)
+	}
+
+	if err != nil {
+		if err == unix.ENOTTY || err == unix.EOPNOTSUPP || err == unix.EPERM ||
+			err == unix.EINVAL {
+			t.Logger.Warning(fmt.Sprintf(
+				"[%s] Ignoring file flags %s not supported: %s",
+				path, fflags, err.Error()))
+			return nil
+		}
+		return fmt.Errorf("For path %s error on set file flags: %s",
+			path, err.Error())
+	}
+
+	return nil
+}
@@ -23,42 +23,66 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 
 	specs "github.com/geaaru/tar-formers/pkg/specs"
+	tools "github.com/geaaru/tar-formers/pkg/tools"
 
 	"golang.org/x/sys/unix"
 )
 
 func (t *TarFormers) CreateFile(dir, name string, mode os.FileMode, reader io.Reader, header *tar.Header) error {
-	file := filepath.Join(dir, name)
+	file, err := t.GetTargetPath(dir, name, false)
+	if err != nil {
+		return err
+	}
 
-	_, err := t.CreateDir(filepath.Dir(file), mode|os.ModeDir|100)
+	file, err = t.GetWritePath(file)
 	if err != nil {
 		return err
 	}
 
-	// To avoid the Text file busy error.
-	// It's needed unlink the file if exists.
-	exists, err := t.ExistFile(file)
+	_, err = t.CreateDir(filepath.Dir(file), mode|os.ModeDir|100)
 	if err != nil {
 		return err
 	}
 
-	if exists {
+	// To avoid the Text file busy error.
+	// It's needed unlink the file if exists. The last component
+	// is checked without follow it: an existing symlink (also a
+	// broken symlink) is replaced and never followed.
+	info, err := os.Lstat(file)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error on stat file %s: %s", file, err.Error())
+	}
+
+	if err == nil && !info.IsDir() {
 		err = os.Remove(file)
 		if err != nil {
+			if t.Task.IsSecureExtraction() {
+				return fmt.Errorf("Error on removing file %s: %s",
+					file, err.Error())
+			}
 			t.Logger.Warning(
 				fmt.Sprintf("Error on removing file %s", file))
 		}
 	}
 
+	flags := os.O_CREATE | os.O_TRUNC | os.O_WRONLY
+	if t.Task.IsSecureExtraction() {
+		// The file is been removed. If something is created
+		// in the meantime the extraction fails.
+		flags |= os.O_EXCL | unix.O_NOFOLLOW
+	}
+
 	err = t.semaphore.Acquire(*t.Ctx, 1)
 	if err != nil {
 		return errors.New("Error on acquire sem on processing file " + file)
 	}
 
-	f, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	f, err := os.OpenFile(file, flags, mode)
 	if err != nil {
 		return errors.New(
 			fmt.Sprintf("Error on open file %s: %s", file, err.Error()))
@@ -66,9 +90,17 @@ func (t *TarFormers) CreateFile(dir, name string, mode os.FileMode, reader io.Re
 
 	// Copy file content
 	copyBuffer := make([]byte, t.Task.BufferSize*1024)
-	nb, err := io.CopyBuffer(f, reader, copyBuffer)
+	var nb int64
+	if t.Task.Sparse {
+		nb, err = SparseCopy(f, reader, copyBuffer)
+	} else {
+		nb, err = io.CopyBuffer(f, reader, copyBuffer)
+	}
 	if err != nil {
 		f.Close()
+		if IsLimitError(err) {
+			return err
+		}
 		return fmt.Errorf("Error on write file %s: %s",
 			file, err.Error())
 	}
@@ -159,7 +191,17 @@ func (t *TarFormers) SetFileProps(path string, meta *specs.FileMeta, link bool)
 
 	// maintaining access and modification time in best effort fashion
 	if t.Task.SameChtimes {
-		err := os.Chtimes(path, meta.AccessTime, meta.ModTime)
+		// The links are not followed: the target of a symlink could
+		// be outside of the extraction directory.
+		flags := 0
+		if link {
+			flags = unix.AT_SYMLINK_NOFOLLOW
+		}
+		ts := []unix.Timespec{
+			getTimespec(meta.AccessTime),
+			getTimespec(meta.ModTime),
+		}
+		err := unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, flags)
 		if err != nil {
 			t.Logger.Warning(
 				fmt.Sprintf("[%s] Error on chtimes: %s", path, err.Error()))
@@ -168,6 +210,11 @@ func (t *TarFormers) SetFileProps(path string, meta *specs.FileMeta, link bool)
 
 	if len(meta.Xattrs) > 0 {
 		for key, value := range meta.Xattrs {
+			if !t.Task.IsXattrAllowed(key) {
+				t.Logger.Debug(fmt.Sprintf("[%s] Xattr %s skipped.", path, key))
+				continue
+			}
+
 			err := t.SetXattrAttr(path, key, value, 0)
 			if err != nil {
 				return err
@@ -175,48 +222,152 @@ func (t *TarFormers) SetFileProps(path string, meta *specs.FileMeta, link bool)
 		}
 	}
 
-	if len(meta.PAXRecords) > 0 {
-		// NOTE: using PAX extend header like xattr. To verify.
-		for key, value := range meta.PAXRecords {
-			err := t.SetXattrAttr(path, key, value, 0)
+	if !link {
+		err := t.SetAcls(path, meta)
+		if err != nil {
+			return err
+		}
+	}
+
+	if meta.SELinuxLabel != "" && t.Task.IsXattrAllowed(specs.SELinuxXattr) {
+		if _, ok := meta.Xattrs[specs.SELinuxXattr]; !ok {
+			err := t.SetXattrAttr(path, specs.SELinuxXattr, meta.SELinuxLabel, 0)
 			if err != nil {
 				return err
 			}
 		}
 	}
 
+	// The file flags are set at the end because the immutable
+	// flag blocks the other changes.
+	if meta.Fflags != "" && !link {
+		err := t.SetFileFlags(path, meta.Fflags)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// GetXattr returns all the extended attributes of the path.
 func (t *TarFormers) GetXattr(path string) (map[string]string, error) {
-	attr := "security.capability"
 	ans := make(map[string]string, 0)
 
-	// Start with a 128 length byte array
-	dest := make([]byte, 128)
-	sz, errno := unix.Lgetxattr(path, attr, dest)
+	attrs, err := t.ListXattr(path)
+	if err != nil {
+		return ans, err
+	}
+
+	for _, attr := range attrs {
+		// Start with a 128 length byte array
+		dest := make([]byte, 128)
+		sz, errno := unix.Lgetxattr(path, attr, dest)
+
+		for errno == unix.ERANGE {
+			// Buffer too small, use zero-sized buffer to get the actual size
+			sz, errno = unix.Lgetxattr(path, attr, []byte{})
+			if errno != nil {
+				return ans, errno
+			}
+			dest = make([]byte, sz)
+			sz, errno = unix.Lgetxattr(path, attr, dest)
+		}
+
+		switch {
+		case errno == unix.ENODATA:
+			// The attribute is been removed.
+			continue
+		case errno != nil:
+			return ans, errno
+		}
+
+		ans[attr] = string(dest[:sz])
+	}
+
+	return ans, nil
+}
+
+// getTimespec returns the timespec of the time. A zero time leaves
+// the time of the file unchanged like os.Chtimes.
+func getTimespec(t time.Time) unix.Timespec {
+	if t.IsZero() {
+		return unix.Timespec{Nsec: unix.UTIME_OMIT}
+	}
+	return unix.NsecToTimespec(t.UnixNano())
+}
+
+// SetAcls sets the POSIX ACLs of the SCHILY.acl.access and
+// SCHILY.acl.default PAX records.
+func (t *TarFormers) SetAcls(path string, meta *specs.FileMeta) error {
+	for name, acl := range meta.Acls {
+		var attr string
+
+		switch name {
+		case "access":
+			attr = tools.AclXattrAccess
+		case "default":
+			if !meta.FileInfo.IsDir() {
+				continue
+			}
+			attr = tools.AclXattrDefault
+		default:
+			t.Logger.Warning(fmt.Sprintf("[%s] Ignoring unknown ACL %s.",
+				path, name))
+			continue
+		}
+
+		if !t.Task.IsXattrAllowed(attr) {
+			t.Logger.Debug(fmt.Sprintf("[%s] ACL %s skipped.", path, name))
+			continue
+		}
+
+		data, err := tools.AclTextToXattr(acl, t.mapAclId)
+		if err != nil {
+			return fmt.Errorf("For path %s error on parse ACL %s: %s",
+				path, name, err.Error())
+		}
+
+		err = t.SetXattrAttr(path, attr, string(data), 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ListXattr returns the names of the extended attributes of the path.
+func (t *TarFormers) ListXattr(path string) ([]string, error) {
+	ans := []string{}
+
+	dest := make([]byte, 256)
+	sz, errno := unix.Llistxattr(path, dest)
 
 	for errno == unix.ERANGE {
 		// Buffer too small, use zero-sized buffer to get the actual size
-		sz, errno = unix.Lgetxattr(path, attr, []byte{})
+		sz, errno = unix.Llistxattr(path, []byte{})
 		if errno != nil {
 			return ans, errno
 		}
 		dest = make([]byte, sz)
-		sz, errno = unix.Lgetxattr(path, attr, dest)
+		sz, errno = unix.Llistxattr(path, dest)
 	}
 
 	switch {
-	case errno == unix.ENODATA:
+	case errno == unix.ENOTSUP:
 		return ans, nil
 	case errno != nil:
 		return ans, errno
 	}
 
-	ans[attr] = string(dest[:sz])
+	for _, name := range strings.Split(string(dest[:sz]), "\x00") {
+		if name != "" {
+			ans = append(ans, name)
+		}
+	}
 
 	return ans, nil
-
 }
 
 func (t *TarFormers) SetXattrAttr(path, k, v string, flag int) error {
@@ -244,7 +395,12 @@ func (t *TarFormers) SetXattrAttr(path, k, v string, flag int) error {
 }
 
 func (t *TarFormers) CreateBlockCharFifo(file string, mode os.FileMode, header *tar.Header) error {
-	_, err := t.CreateDir(filepath.Dir(file), mode|os.ModeDir|100)
+	file, err := t.GetWritePath(file)
+	if err != nil {
+		return err
+	}
+
+	_, err = t.CreateDir(filepath.Dir(file), mode|os.ModeDir|100)
 	if err != nil {
 		return err
 	}
@@ -259,20 +415,30 @@ func (t *TarFormers) CreateBlockCharFifo(file string, mode os.FileMode, header *
 		modeDev |= unix.S_IFIFO
 	}
 
+	// Drop the existing file to permit the creation of the node.
+	if _, err := os.Lstat(file); err == nil {
+		err = os.Remove(file)
+		if err != nil {
+			t.Logger.Warning(
+				fmt.Sprintf("Error on removing file %s", file))
+		}
+	}
+
 	dev := int(uint32(unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor))))
-	return unix.Mknod(file, modeDev, dev)
+	if err := unix.Mknod(file, modeDev, dev); err != nil {
+		return fmt.Errorf("Error on create special file %s: %s",
+			file, err.Error())
+	}
+
+	return nil
 }
 
 func (t *TarFormers) CreateLink(link specs.Link) error {
 
 	// Existing links could be wrong. Drop the existing link
-	// if there is already the link.
-	exists, err := t.ExistFile(link.Path)
-	if err != nil {
-		return err
-	}
-
-	if exists {
+	// if there is already the link. The existing link could be
+	// a broken symlink.
+	if _, err := os.Lstat(link.Path); err == nil {
 		err = os.Remove(link.Path)
 		if err != nil {
 			t.Logger.Warning(
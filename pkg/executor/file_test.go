@@ -0,0 +1,203 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package executor_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/geaaru/tar-formers/pkg/executor"
+	specs "github.com/geaaru/tar-formers/pkg/specs"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+type testEntry struct {
+	Header  tar.Header
+	Content string
+}
+
+// newTestTarball returns a tarball with the entries.
+func newTestTarball(entries []testEntry) *bytes.Buffer {
+	buf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buf)
+
+	for i := range entries {
+		h := entries[i].Header
+		if h.Typeflag == tar.TypeReg {
+			h.Size = int64(len(entries[i].Content))
+		}
+		Expect(tw.WriteHeader(&h)).To(Succeed())
+		if entries[i].Content != "" {
+			_, err := tw.Write([]byte(entries[i].Content))
+			Expect(err).ToNot(HaveOccurred())
+		}
+	}
+	Expect(tw.Close()).To(Succeed())
+
+	return buf
+}
+
+// extractTestTarball extracts the tarball in the directory dir.
+func extractTestTarball(s *specs.SpecFile, buf *bytes.Buffer, dir string) error {
+	t := NewTarFormers(specs.NewConfig(nil))
+	t.SetReader(buf)
+	return t.RunTask(s, dir)
+}
+
+var _ = Describe("File", func() {
+
+	Context("CreateFile", func() {
+		var tmpdir, root, outside string
+
+		BeforeEach(func() {
+			tmpdir = GinkgoT().TempDir()
+			root = filepath.Join(tmpdir, "root")
+			outside = filepath.Join(tmpdir, "outside")
+			Expect(os.MkdirAll(root, 0755)).To(Succeed())
+			Expect(os.MkdirAll(outside, 0755)).To(Succeed())
+		})
+
+		for _, secure := range []bool{true, false} {
+			secure := secure
+
+			It("doesn't follow a broken symlink of the target", func() {
+				pwned := filepath.Join(outside, "pwned")
+				Expect(os.Symlink(pwned, filepath.Join(root, "evil"))).To(Succeed())
+
+				s := specs.NewSpecFile()
+				s.SameOwner = false
+				s.SecureExtraction = secure
+
+				buf := newTestTarball([]testEntry{
+					{
+						Header: tar.Header{
+							Name: "evil", Typeflag: tar.TypeReg, Mode: 0644,
+						},
+						Content: "data",
+					},
+				})
+				Expect(extractTestTarball(s, buf, root)).To(Succeed())
+
+				_, err := os.Lstat(pwned)
+				Expect(os.IsNotExist(err)).To(BeTrue())
+
+				info, err := os.Lstat(filepath.Join(root, "evil"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(info.Mode().IsRegular()).To(BeTrue())
+
+				data, err := os.ReadFile(filepath.Join(root, "evil"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(data)).To(Equal("data"))
+			})
+
+			It("replaces a symlink to an existing file", func() {
+				target := filepath.Join(outside, "file")
+				Expect(os.WriteFile(target, []byte("original"), 0644)).To(Succeed())
+				Expect(os.Symlink(target, filepath.Join(root, "link"))).To(Succeed())
+
+				s := specs.NewSpecFile()
+				s.SameOwner = false
+				s.SecureExtraction = secure
+
+				buf := newTestTarball([]testEntry{
+					{
+						Header: tar.Header{
+							Name: "link", Typeflag: tar.TypeReg, Mode: 0644,
+						},
+						Content: "data",
+					},
+				})
+				Expect(extractTestTarball(s, buf, root)).To(Succeed())
+
+				data, err := os.ReadFile(target)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(data)).To(Equal("original"))
+
+				info, err := os.Lstat(filepath.Join(root, "link"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(info.Mode().IsRegular()).To(BeTrue())
+			})
+		}
+
+		It("doesn't write through a symlink created by the tarball", func() {
+			pwned := filepath.Join(outside, "pwned")
+
+			s := specs.NewSpecFile()
+			s.SameOwner = false
+			s.SecureExtraction = true
+
+			buf := newTestTarball([]testEntry{
+				{
+					Header: tar.Header{
+						Name: "evil", Typeflag: tar.TypeSymlink, Linkname: pwned,
+					},
+				},
+				{
+					Header: tar.Header{
+						Name: "evil", Typeflag: tar.TypeReg, Mode: 0644,
+					},
+					Content: "data",
+				},
+			})
+			_ = extractTestTarball(s, buf, root)
+
+			_, err := os.Lstat(pwned)
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+	})
+
+	Context("SetFileProps", func() {
+
+		It("doesn't change the times of the target of a symlink", func() {
+			tmpdir := GinkgoT().TempDir()
+			root := filepath.Join(tmpdir, "root")
+			target := filepath.Join(tmpdir, "outside")
+			Expect(os.WriteFile(target, []byte("data"), 0644)).To(Succeed())
+
+			mtime := time.Unix(1700000000, 0)
+			Expect(os.Chtimes(target, mtime, mtime)).To(Succeed())
+
+			s := specs.NewSpecFile()
+			s.SameOwner = false
+			s.SameChtimes = true
+
+			linkTime := time.Unix(946684800, 0)
+			buf := newTestTarball([]testEntry{
+				{
+					Header: tar.Header{
+						Name: "link", Typeflag: tar.TypeSymlink, Linkname: target,
+						ModTime: linkTime,
+					},
+				},
+			})
+			Expect(extractTestTarball(s, buf, root)).To(Succeed())
+
+			info, err := os.Stat(target)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.ModTime().Equal(mtime)).To(BeTrue())
+
+			info, err = os.Lstat(filepath.Join(root, "link"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Mode() & os.ModeSymlink).ToNot(BeZero())
+			Expect(info.ModTime().Equal(linkTime)).To(BeTrue())
+		})
+	})
+})
@@ -0,0 +1,135 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package executor
+
+import (
+	"archive/tar"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	specs "github.com/geaaru/tar-formers/pkg/specs"
+)
+
+// PAX records of the fields of the header.
+var paxHeaderFields = map[string]bool{
+	"path":     true,
+	"linkpath": true,
+	"size":     true,
+	"uid":      true,
+	"gid":      true,
+	"uname":    true,
+	"gname":    true,
+	"mtime":    true,
+	"atime":    true,
+	"ctime":    true,
+}
+
+// getWriterFormat returns the format of the headers defined on the
+// writer rules. The format is validated by the Prepare of the spec.
+func (t *TarFormers) getWriterFormat() tar.Format {
+	if t.TaskWriter == nil {
+		return tar.FormatUnknown
+	}
+	format, _ := t.TaskWriter.Writer.GetFormat()
+	return format
+}
+
+// canWriteSparse returns true if the sparse files could be written
+// as PAX sparse entries with the selected format.
+func (t *TarFormers) canWriteSparse() bool {
+	format := t.getWriterFormat()
+	return format == tar.FormatUnknown || format == tar.FormatPAX
+}
+
+// convertHeader converts the header to the format defined on the
+// writer rules. With the USTAR and GNU formats the atime, the ctime,
+// the sub-second precision of the mtime and the PAX records can't be
+// represented: the conversion fails with an error that reports them
+// or, with the drop_unsupported option, they are dropped. The other
+// fields are checked by tar.Writer that returns an error if they
+// can't be represented.
+func (t *TarFormers) convertHeader(header *tar.Header) error {
+	format := t.getWriterFormat()
+	if format == tar.FormatUnknown {
+		return nil
+	}
+
+	header.Format = format
+	if format == tar.FormatPAX {
+		return nil
+	}
+
+	// The atime and ctime fields of the GNU headers are written by
+	// GNU tar only for incremental archives and some readers parse
+	// them as the prefix of the name.
+	fields := []string{}
+	if !header.AccessTime.IsZero() {
+		fields = append(fields, "atime")
+	}
+	if !header.ChangeTime.IsZero() {
+		fields = append(fields, "ctime")
+	}
+	if header.ModTime.Nanosecond() != 0 {
+		fields = append(fields, "mtime (sub-second precision)")
+	}
+
+	// The records of the header fields are managed by tar.Writer.
+	records := map[string]bool{}
+	for k := range header.PAXRecords {
+		if _, ok := paxHeaderFields[k]; !ok {
+			records[k] = true
+		}
+	}
+	for k := range header.Xattrs {
+		records[specs.PaxXattrPrefix+k] = true
+	}
+
+	keys := []string{}
+	for k := range records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fields = append(fields, keys...)
+
+	if len(fields) == 0 {
+		return nil
+	}
+
+	if !t.TaskWriter.Writer.DropUnsupported {
+		return fmt.Errorf(
+			"Entry %s has fields that can't be represented by the %s format: %s",
+			header.Name, format, strings.Join(fields, ", "))
+	}
+
+	msg := fmt.Sprintf("[%s] Dropping fields not supported by the %s format: %s",
+		header.Name, format, strings.Join(fields, ", "))
+	if len(keys) > 0 {
+		t.Logger.Warning(msg)
+	} else {
+		t.Logger.Debug(msg)
+	}
+
+	header.AccessTime = time.Time{}
+	header.ChangeTime = time.Time{}
+	header.ModTime = header.ModTime.Truncate(time.Second)
+	header.PAXRecords = nil
+	header.Xattrs = nil
+
+	return nil
+}
@@ -0,0 +1,208 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package executor_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/geaaru/tar-formers/pkg/executor"
+	specs "github.com/geaaru/tar-formers/pkg/specs"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"golang.org/x/sys/unix"
+)
+
+// bridgeTestTarball converts the tarball with the format.
+func bridgeTestTarball(buf *bytes.Buffer, format string, drop bool) (*bytes.Buffer, error) {
+	in := specs.NewSpecFile()
+	out := specs.NewSpecFile()
+	out.Writer = specs.NewWriter()
+	out.Writer.Format = format
+	out.Writer.DropUnsupported = drop
+
+	ans := bytes.NewBuffer(nil)
+	t := NewTarFormers(specs.NewConfig(nil))
+	t.SetReader(buf)
+	t.SetWriter(ans)
+
+	return ans, t.RunTaskBridge(in, out)
+}
+
+// archiveTestDirFormat archives the directory with the format.
+func archiveTestDirFormat(dir, format string, sameChtimes, drop bool) (*bytes.Buffer, error) {
+	s := specs.NewSpecFile()
+	s.SameChtimes = sameChtimes
+	s.Writer = specs.NewWriter()
+	s.Writer.ArchiveDirs = []string{dir}
+	s.Writer.Format = format
+	s.Writer.DropUnsupported = drop
+
+	buf := bytes.NewBuffer(nil)
+	t := NewTarFormers(specs.NewConfig(nil))
+	t.SetWriter(buf)
+
+	return buf, t.RunTaskWriter(s)
+}
+
+var _ = Describe("Format", func() {
+
+	Context("Archive files", func() {
+		var src string
+		mtime := time.Unix(1700000000, 123456789)
+
+		BeforeEach(func() {
+			src = filepath.Join(GinkgoT().TempDir(), "src")
+			Expect(os.MkdirAll(filepath.Join(src, "dir"), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(src, "dir", "file"),
+				[]byte("data"), 0644)).To(Succeed())
+			Expect(os.Symlink("dir/file", filepath.Join(src, "link"))).To(Succeed())
+			Expect(os.Chtimes(filepath.Join(src, "dir", "file"), mtime, mtime)).To(Succeed())
+		})
+
+		for _, format := range []string{"ustar", "gnu", "pax"} {
+			format := format
+
+			It("archives the files with "+format, func() {
+				buf, err := archiveTestDirFormat(src, format, false, false)
+				Expect(err).ToNot(HaveOccurred())
+
+				headers := readTestTarball(buf)
+				Expect(headers).To(HaveKey("dir"))
+				Expect(headers).To(HaveKey("link"))
+				Expect(headers).To(HaveKey("file"))
+
+				for name, h := range headers {
+					Expect(h.AccessTime.IsZero()).To(BeTrue(), name)
+					Expect(h.ChangeTime.IsZero()).To(BeTrue(), name)
+					Expect(h.PAXRecords).ToNot(HaveKey("atime"), name)
+					Expect(h.PAXRecords).ToNot(HaveKey("ctime"), name)
+				}
+
+				h := headers["file"]
+				if format == "pax" {
+					Expect(h.ModTime.Equal(mtime)).To(BeTrue())
+				} else {
+					Expect(h.ModTime.Equal(mtime.Truncate(time.Second))).To(BeTrue())
+				}
+			})
+		}
+
+		It("archives the atime and the ctime with same_chtimes and pax", func() {
+			buf, err := archiveTestDirFormat(src, "pax", true, false)
+			Expect(err).ToNot(HaveOccurred())
+
+			h := readTestTarball(buf)["file"]
+			Expect(h).ToNot(BeNil())
+			Expect(h.PAXRecords).To(HaveKey("atime"))
+			Expect(h.PAXRecords).To(HaveKey("ctime"))
+		})
+
+		for _, format := range []string{"ustar", "gnu"} {
+			format := format
+
+			It("fails on the extended attributes with "+format, func() {
+				err := unix.Lsetxattr(filepath.Join(src, "dir", "file"),
+					"user.foo", []byte("bar"), 0)
+				if err != nil {
+					Skip("The filesystem doesn't support the user xattrs: " + err.Error())
+				}
+
+				_, err = archiveTestDirFormat(src, format, false, false)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("SCHILY.xattr.user.foo"))
+				Expect(err.Error()).ToNot(ContainSubstring("mtime"))
+
+				buf, err := archiveTestDirFormat(src, format, false, true)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(readTestTarball(buf)["file"].PAXRecords).To(BeEmpty())
+			})
+		}
+	})
+
+	Context("Convert headers", func() {
+		mtime := time.Unix(1700000000, 500)
+
+		newTarball := func(records map[string]string, mtime time.Time) *bytes.Buffer {
+			return newTestTarball([]testEntry{
+				{
+					Header: tar.Header{
+						Name: "file", Typeflag: tar.TypeReg, Mode: 0644,
+						ModTime: mtime, PAXRecords: records,
+						Format: tar.FormatPAX,
+					},
+					Content: "data",
+				},
+			})
+		}
+
+		for _, format := range []string{"ustar", "gnu"} {
+			format := format
+
+			It("fails on PAX records with "+format, func() {
+				buf := newTarball(map[string]string{
+					"SCHILY.xattr.user.foo": "bar",
+				}, time.Unix(1700000000, 0))
+
+				_, err := bridgeTestTarball(buf, format, false)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("Entry file"))
+				Expect(err.Error()).To(ContainSubstring("SCHILY.xattr.user.foo"))
+			})
+
+			It("fails on sub-second mtime with "+format, func() {
+				buf := newTarball(nil, mtime)
+
+				_, err := bridgeTestTarball(buf, format, false)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("Entry file"))
+				Expect(err.Error()).To(ContainSubstring("mtime"))
+			})
+
+			It("drops the unsupported fields with "+format, func() {
+				buf := newTarball(map[string]string{
+					"SCHILY.xattr.user.foo": "bar",
+				}, mtime)
+
+				out, err := bridgeTestTarball(buf, format, true)
+				Expect(err).ToNot(HaveOccurred())
+
+				h := readTestTarball(out)["file"]
+				Expect(h).ToNot(BeNil())
+				Expect(h.PAXRecords).To(BeEmpty())
+				Expect(h.ModTime.Equal(time.Unix(1700000000, 0))).To(BeTrue())
+			})
+		}
+
+		It("keeps the PAX records with pax", func() {
+			buf := newTarball(map[string]string{
+				"SCHILY.xattr.user.foo": "bar",
+			}, mtime)
+
+			out, err := bridgeTestTarball(buf, "pax", false)
+			Expect(err).ToNot(HaveOccurred())
+
+			h := readTestTarball(out)["file"]
+			Expect(h).ToNot(BeNil())
+			Expect(h.PAXRecords).To(HaveKeyWithValue("SCHILY.xattr.user.foo", "bar"))
+			Expect(h.ModTime.Equal(mtime)).To(BeTrue())
+		})
+	})
+})
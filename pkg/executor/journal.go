@@ -0,0 +1,206 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package executor
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	specs "github.com/geaaru/tar-formers/pkg/specs"
+)
+
+// Function handler called for every entry added to the journal.
+type TarJournalHandlerFunc func(entry *specs.JournalEntry, t *TarFormers) error
+
+func (t *TarFormers) SetJournalHandler(f TarJournalHandlerFunc) {
+	t.journalHandler = f
+}
+
+func (t *TarFormers) HasJournalHandler() bool {
+	return t.journalHandler != nil
+}
+
+func (t *TarFormers) hasJournal() bool {
+	return t.Journal != nil
+}
+
+// existPath returns true if the path exists. It's used to check if
+// the entry replaces an existing file only when the journal is enabled.
+func (t *TarFormers) existPath(path string) bool {
+	if !t.hasJournal() {
+		return false
+	}
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// addJournalEntry adds the entry to the journal and calls
+// the journal handler. With the atomic extraction the handler
+// is called only after the commit (see emitJournal).
+func (t *TarFormers) addJournalEntry(e *specs.JournalEntry) error {
+	if !t.hasJournal() {
+		return nil
+	}
+
+	// With the atomic extraction of the whole directory the
+	// files are extracted in the staging directory.
+	if t.stage != nil && t.stage.WholeDir && t.stage.isStaged(e.Path) {
+		e.Path = filepath.Join(t.stage.Root,
+			strings.TrimPrefix(e.Path, t.stage.Dir))
+	}
+
+	t.Journal.Add(e)
+
+	if t.HasJournalHandler() && t.stage == nil {
+		return t.journalHandler(e, t)
+	}
+
+	return nil
+}
+
+// emitJournal calls the journal handler for all the entries of the
+// journal. It's used after the commit of the atomic extraction.
+func (t *TarFormers) emitJournal() error {
+	if !t.hasJournal() || !t.HasJournalHandler() {
+		return nil
+	}
+
+	for _, e := range t.Journal.Entries {
+		err := t.journalHandler(e, t)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setJournalStat sets the mode and the owner of the journal entry
+// with the values of the path on disk. The values of the header could
+// be changed by the umask, the owner mapping or the same_owner option.
+func (t *TarFormers) setJournalStat(e *specs.JournalEntry, path string) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Logger.Debug(fmt.Sprintf("[%s] Error on stat for journal: %s",
+			path, err.Error()))
+		return
+	}
+
+	stat := info.Sys().(*syscall.Stat_t)
+	e.Mode = fmt.Sprintf("%04o", stat.Mode&07777)
+	if int(stat.Uid) != e.Uid {
+		e.Uid = int(stat.Uid)
+		e.Uname = ""
+	}
+	if int(stat.Gid) != e.Gid {
+		e.Gid = int(stat.Gid)
+		e.Gname = ""
+	}
+}
+
+// journalHeader adds the journal entry of the path created
+// or replaced from the header. The mode and the owner are read
+// from the written path.
+func (t *TarFormers) journalHeader(path, writtenPath string, header *tar.Header, existed bool, digest string) error {
+	if !t.hasJournal() {
+		return nil
+	}
+
+	action := specs.JournalCreated
+	if existed {
+		action = specs.JournalReplaced
+	}
+
+	e := specs.NewJournalEntry(path, action, header)
+	e.Sha256 = digest
+	t.setJournalStat(e, writtenPath)
+
+	return t.addJournalEntry(e)
+}
+
+// journalLink adds the journal entry of the link created or replaced.
+// The mode and the owner are read from the written path.
+func (t *TarFormers) journalLink(link *specs.Link, writtenPath string, existed bool) error {
+	if !t.hasJournal() {
+		return nil
+	}
+
+	action := specs.JournalCreated
+	if existed {
+		action = specs.JournalReplaced
+	}
+
+	e := &specs.JournalEntry{
+		Path:     link.Path,
+		Action:   action,
+		Type:     specs.GetJournalType(link.TypeFlag),
+		Mode:     fmt.Sprintf("%04o", link.Mode.Perm()),
+		Uid:      link.Meta.Uid,
+		Gid:      link.Meta.Gid,
+		Uname:    link.Meta.Uname,
+		Gname:    link.Meta.Gname,
+		Linkname: link.Linkname,
+	}
+	t.setJournalStat(e, writtenPath)
+
+	return t.addJournalEntry(e)
+}
+
+// journalSkip adds the journal entry of the skipped path.
+func (t *TarFormers) journalSkip(path string, header *tar.Header, reason string) error {
+	if !t.hasJournal() {
+		return nil
+	}
+
+	e := specs.NewJournalEntry(path, specs.JournalSkipped, header)
+	e.Reason = reason
+
+	return t.addJournalEntry(e)
+}
+
+// journalRemove adds the journal entry of the removed path.
+func (t *TarFormers) journalRemove(path, reason string) error {
+	if !t.hasJournal() {
+		return nil
+	}
+
+	e := specs.NewJournalEntry(path, specs.JournalRemoved, nil)
+	e.Reason = reason
+
+	return t.addJournalEntry(e)
+}
+
+// writeJournal writes the journal to the file defined in the task.
+func (t *TarFormers) writeJournal() error {
+	if !t.hasJournal() || t.Task.JournalFile == "" {
+		return nil
+	}
+
+	err := t.Journal.WriteFile(t.Task.JournalFile)
+	if err != nil {
+		return fmt.Errorf("Error on write journal %s: %s",
+			t.Task.JournalFile, err.Error())
+	}
+
+	t.Logger.Debug(fmt.Sprintf("Journal written to %s.", t.Task.JournalFile))
+
+	return nil
+}
@@ -0,0 +1,168 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package executor_test
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	. "github.com/geaaru/tar-formers/pkg/executor"
+	specs "github.com/geaaru/tar-formers/pkg/specs"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Journal", func() {
+
+	Context("Journal entries", func() {
+		var root string
+		var entries []*specs.JournalEntry
+
+		BeforeEach(func() {
+			root = filepath.Join(GinkgoT().TempDir(), "root")
+			Expect(os.MkdirAll(root, 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(root, "old"),
+				[]byte("old"), 0644)).To(Succeed())
+			entries = []*specs.JournalEntry{}
+		})
+
+		newJournalSpec := func() *specs.SpecFile {
+			s := specs.NewSpecFile()
+			s.SameOwner = false
+			s.Journal = true
+			return s
+		}
+
+		runTask := func(s *specs.SpecFile, tarEntries []testEntry) (*TarFormers, error) {
+			t := NewTarFormers(specs.NewConfig(nil))
+			t.SetReader(newTestTarball(tarEntries))
+			t.SetJournalHandler(func(e *specs.JournalEntry, t *TarFormers) error {
+				// The entries are notified when the path is on disk.
+				if e.Action == specs.JournalCreated || e.Action == specs.JournalReplaced {
+					_, err := os.Lstat(e.Path)
+					Expect(err).ToNot(HaveOccurred(), e.Path)
+				}
+				entries = append(entries, e)
+				return nil
+			})
+			return t, t.RunTask(s, root)
+		}
+
+		It("uses the mode and the owner of the files on disk", func() {
+			umask := syscall.Umask(022)
+			defer syscall.Umask(umask)
+
+			_, err := runTask(newJournalSpec(), []testEntry{
+				{
+					Header: tar.Header{
+						Name: "bin", Typeflag: tar.TypeReg, Mode: 0777,
+						Uid: 1234, Gid: 1234, Uname: "foo", Gname: "foo",
+					},
+					Content: "data",
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(entries).To(HaveLen(1))
+
+			info, err := os.Lstat(filepath.Join(root, "bin"))
+			Expect(err).ToNot(HaveOccurred())
+			stat := info.Sys().(*syscall.Stat_t)
+
+			e := entries[0]
+			Expect(e.Path).To(Equal(filepath.Join(root, "bin")))
+			Expect(e.Mode).To(Equal(fmt.Sprintf("%04o", stat.Mode&07777)))
+			// Without same_owner the mode isn't forced and the umask is used.
+			Expect(e.Mode).To(Equal("0755"))
+			Expect(e.Uid).To(Equal(int(stat.Uid)))
+			Expect(e.Gid).To(Equal(int(stat.Gid)))
+			Expect(e.Uname).To(BeEmpty())
+			Expect(e.Gname).To(BeEmpty())
+		})
+
+		It("calls the journal handler after the commit", func() {
+			s := newJournalSpec()
+			s.Atomic = true
+
+			t, err := runTask(s, []testEntry{
+				{
+					Header:  tar.Header{Name: "old", Typeflag: tar.TypeReg, Mode: 0600},
+					Content: "new",
+				},
+				{
+					Header:  tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0644},
+					Content: "data",
+				},
+				{
+					Header: tar.Header{
+						Name: "link", Typeflag: tar.TypeSymlink, Linkname: "file",
+					},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(entries).To(HaveLen(3))
+			Expect(t.Journal.Entries).To(Equal(entries))
+
+			Expect(entries[0].Action).To(Equal(specs.JournalReplaced))
+			Expect(entries[0].Mode).To(Equal("0600"))
+			Expect(entries[2].Type).To(Equal("symlink"))
+			Expect(entries[2].Mode).To(Equal("0777"))
+			for _, e := range entries {
+				Expect(e.RolledBack).To(BeFalse())
+			}
+		})
+
+		It("marks the entries as rolled back", func() {
+			s := newJournalSpec()
+			s.Atomic = true
+			s.SecureExtraction = true
+			s.UnsafeEntries = specs.UnsafeEntriesReject
+
+			t, err := runTask(s, []testEntry{
+				{
+					Header:  tar.Header{Name: "old", Typeflag: tar.TypeReg, Mode: 0644},
+					Content: "new",
+				},
+				{
+					Header:  tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0644},
+					Content: "data",
+				},
+				{
+					Header:  tar.Header{Name: "../evil", Typeflag: tar.TypeReg, Mode: 0644},
+					Content: "data",
+				},
+			})
+			Expect(err).To(HaveOccurred())
+
+			// The journal handler isn't called for the restored changes.
+			Expect(entries).To(BeEmpty())
+			Expect(t.Journal.Entries).To(HaveLen(2))
+			for _, e := range t.Journal.Entries {
+				Expect(e.RolledBack).To(BeTrue(), e.Path)
+			}
+			Expect(t.Journal.GetPaths()).To(BeEmpty())
+
+			data, err := os.ReadFile(filepath.Join(root, "old"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(Equal("old"))
+			_, err = os.Lstat(filepath.Join(root, "file"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+	})
+})
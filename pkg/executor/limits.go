@@ -0,0 +1,195 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package executor
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	specs "github.com/geaaru/tar-formers/pkg/specs"
+	tools "github.com/geaaru/tar-formers/pkg/tools"
+)
+
+const (
+	LimitMaxEntries          = "max_entries"
+	LimitMaxFileSize         = "max_file_size"
+	LimitMaxTotalSize        = "max_total_size"
+	LimitMaxPathLength       = "max_path_length"
+	LimitMaxPathDepth        = "max_path_depth"
+	LimitMaxCompressionRatio = "max_compression_ratio"
+
+	// The compression ratio is checked only after the decompression
+	// of a minimal number of bytes.
+	compressionRatioMinBytes = 1024 * 1024
+)
+
+// LimitError is returned when an entry of the tar stream
+// exceeds one of the limits of the task.
+type LimitError struct {
+	Limit string
+	Entry string
+	Value int64
+	Max   int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("Entry %s exceeds the limit %s (%d > %d)",
+		e.Entry, e.Limit, e.Value, e.Max)
+}
+
+type limitsChecker struct {
+	limits *specs.Limits
+	stats  tools.CompressionStats
+
+	entries   int64
+	totalSize int64
+}
+
+type limitsReader struct {
+	io.Reader
+	checker *limitsChecker
+	name    string
+}
+
+// newLimitsChecker creates the checker of the limits of the task. The
+// compression ratio is checked if the reader provides the compression
+// stats.
+func (t *TarFormers) newLimitsChecker(task *specs.SpecFile) *limitsChecker {
+	if task.Limits == nil {
+		return nil
+	}
+
+	ans := &limitsChecker{limits: task.Limits}
+	if s, ok := t.reader.(tools.CompressionStats); ok {
+		ans.stats = s
+	}
+
+	return ans
+}
+
+// CheckHeader checks the limits of the entry.
+func (l *limitsChecker) CheckHeader(header *tar.Header) error {
+	if l == nil {
+		return nil
+	}
+
+	l.entries++
+	if l.limits.MaxEntries > 0 && l.entries > l.limits.MaxEntries {
+		return l.newError(LimitMaxEntries, header.Name,
+			l.entries, l.limits.MaxEntries)
+	}
+
+	switch header.Typeflag {
+	case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+		if l.limits.MaxFileSize > 0 && header.Size > l.limits.MaxFileSize {
+			return l.newError(LimitMaxFileSize, header.Name,
+				header.Size, l.limits.MaxFileSize)
+		}
+
+		l.totalSize += header.Size
+		if l.limits.MaxTotalSize > 0 && l.totalSize > l.limits.MaxTotalSize {
+			return l.newError(LimitMaxTotalSize, header.Name,
+				l.totalSize, l.limits.MaxTotalSize)
+		}
+	}
+
+	if l.limits.MaxPathLength > 0 {
+		// The target of the links is checked too.
+		for _, path := range []string{header.Name, header.Linkname} {
+			if int64(len(path)) > l.limits.MaxPathLength {
+				return l.newError(LimitMaxPathLength, header.Name,
+					int64(len(path)), l.limits.MaxPathLength)
+			}
+		}
+	}
+
+	if l.limits.MaxPathDepth > 0 {
+		depth := getPathDepth(header.Name)
+		if depth > l.limits.MaxPathDepth {
+			return l.newError(LimitMaxPathDepth, header.Name,
+				depth, l.limits.MaxPathDepth)
+		}
+	}
+
+	return l.CheckRatio(header.Name)
+}
+
+// CheckRatio checks the compression ratio of the stream.
+func (l *limitsChecker) CheckRatio(name string) error {
+	if l == nil || l.stats == nil || l.limits.MaxCompressionRatio <= 0 {
+		return nil
+	}
+
+	decompressed := l.stats.DecompressedBytes()
+	compressed := l.stats.CompressedBytes()
+	if decompressed < compressionRatioMinBytes || compressed <= 0 {
+		return nil
+	}
+
+	ratio := decompressed / compressed
+	if ratio > l.limits.MaxCompressionRatio {
+		return l.newError(LimitMaxCompressionRatio, name,
+			ratio, l.limits.MaxCompressionRatio)
+	}
+
+	return nil
+}
+
+// Reader returns a reader that checks the compression ratio
+// while the content of the entry is read.
+func (l *limitsChecker) Reader(r io.Reader, name string) io.Reader {
+	if l == nil || l.stats == nil || l.limits.MaxCompressionRatio <= 0 {
+		return r
+	}
+	return &limitsReader{Reader: r, checker: l, name: name}
+}
+
+func (l *limitsChecker) newError(limit, name string, value, max int64) error {
+	return &LimitError{
+		Limit: limit,
+		Entry: name,
+		Value: value,
+		Max:   max,
+	}
+}
+
+func (r *limitsReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == nil {
+		err = r.checker.CheckRatio(r.name)
+	}
+	return n, err
+}
+
+// IsLimitError returns true if the error is a LimitError.
+func IsLimitError(err error) bool {
+	var lerr *LimitError
+	return errors.As(err, &lerr)
+}
+
+// getPathDepth returns the number of elements of the path.
+func getPathDepth(path string) int64 {
+	path = strings.Trim(filepath.Clean("/"+path), "/")
+	if path == "" {
+		return 0
+	}
+	return int64(strings.Count(path, "/") + 1)
+}
@@ -0,0 +1,118 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package executor_test
+
+import (
+	"archive/tar"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/geaaru/tar-formers/pkg/executor"
+	specs "github.com/geaaru/tar-formers/pkg/specs"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Limits", func() {
+
+	Context("Path length", func() {
+		var root string
+		longPath := strings.Repeat("a", 40) + "/" + strings.Repeat("b", 40)
+
+		BeforeEach(func() {
+			root = filepath.Join(GinkgoT().TempDir(), "root")
+		})
+
+		newLimitsSpec := func() *specs.SpecFile {
+			s := specs.NewSpecFile()
+			s.SameOwner = false
+			s.Limits = &specs.Limits{MaxPathLength: 64}
+			return s
+		}
+
+		checkLimitError := func(err error) {
+			Expect(err).To(HaveOccurred())
+			Expect(IsLimitError(err)).To(BeTrue(), err.Error())
+
+			var lerr *LimitError
+			Expect(errors.As(err, &lerr)).To(BeTrue())
+			Expect(lerr.Limit).To(Equal(LimitMaxPathLength))
+			Expect(lerr.Value).To(Equal(int64(len(longPath))))
+			Expect(lerr.Max).To(Equal(int64(64)))
+		}
+
+		It("rejects the long path of the entries", func() {
+			buf := newTestTarball([]testEntry{
+				{
+					Header:  tar.Header{Name: longPath, Typeflag: tar.TypeReg, Mode: 0644},
+					Content: "data",
+				},
+			})
+
+			checkLimitError(extractTestTarball(newLimitsSpec(), buf, root))
+		})
+
+		It("rejects the long target of the symlinks", func() {
+			buf := newTestTarball([]testEntry{
+				{
+					Header: tar.Header{
+						Name: "link", Typeflag: tar.TypeSymlink, Linkname: longPath,
+					},
+				},
+			})
+
+			checkLimitError(extractTestTarball(newLimitsSpec(), buf, root))
+
+			_, err := os.Lstat(filepath.Join(root, "link"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("rejects the long target of the hardlinks", func() {
+			buf := newTestTarball([]testEntry{
+				{
+					Header: tar.Header{
+						Name: "link", Typeflag: tar.TypeLink, Linkname: longPath,
+					},
+				},
+			})
+
+			checkLimitError(extractTestTarball(newLimitsSpec(), buf, root))
+		})
+
+		It("accepts the paths within the limit", func() {
+			buf := newTestTarball([]testEntry{
+				{
+					Header:  tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0644},
+					Content: "data",
+				},
+				{
+					Header: tar.Header{
+						Name: "link", Typeflag: tar.TypeSymlink, Linkname: "file",
+					},
+				},
+			})
+
+			Expect(extractTestTarball(newLimitsSpec(), buf, root)).To(Succeed())
+
+			target, err := os.Readlink(filepath.Join(root, "link"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(target).To(Equal("file"))
+		})
+	})
+})
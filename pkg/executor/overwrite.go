@@ -0,0 +1,195 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package executor
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	specs "github.com/geaaru/tar-formers/pkg/specs"
+
+	"golang.org/x/sys/unix"
+)
+
+const compareBufferSize = 32 * 1024
+
+// Function handler called for every entry skipped by the overwrite
+// policy. The reason is the overwrite policy applied.
+type TarSkipHandlerFunc func(path, dst string,
+	header *tar.Header, reason string, t *TarFormers) error
+
+func (t *TarFormers) SetSkipHandler(f TarSkipHandlerFunc) {
+	t.skipHandler = f
+}
+
+func (t *TarFormers) HasSkipHandler() bool {
+	return t.skipHandler != nil
+}
+
+// checkOverwritePolicy applies the overwrite policy of the path when
+// the target path already exists. It returns true if the entry must
+// be skipped. With the if-different policy the content of the regular
+// files is compared with the existing file and the returned reader
+// contains the full content of the entry. The returned closer must be
+// closed after the read of the content.
+func (t *TarFormers) checkOverwritePolicy(dir, absPath, targetPath string,
+	header *tar.Header, reader io.Reader) (bool, io.Reader, io.Closer, error) {
+
+	policy := t.Task.GetOverwritePolicy(absPath)
+	if policy == specs.OverwriteReplace {
+		return false, reader, nil, nil
+	}
+
+	info, err := os.Lstat(targetPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, reader, nil, nil
+		}
+		return false, nil, nil, err
+	}
+
+	switch policy {
+	case specs.OverwriteFail:
+		return false, nil, nil, fmt.Errorf(
+			"Path %s already exists and the overwrite policy is %s",
+			targetPath, policy)
+	case specs.OverwriteKeepExisting:
+		return true, reader, nil, nil
+	case specs.OverwriteKeepNewer:
+		return !info.ModTime().Before(header.ModTime), reader, nil, nil
+	}
+
+	// POST: if-different policy
+	switch header.Typeflag {
+	case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+		if !info.Mode().IsRegular() {
+			return false, reader, nil, nil
+		}
+		changed, r, closer, err := t.compareFileContent(targetPath, header.Size, reader)
+		return !changed, r, closer, err
+
+	case tar.TypeSymlink:
+		if info.Mode()&os.ModeSymlink == 0 {
+			return false, reader, nil, nil
+		}
+		linkname, err := os.Readlink(targetPath)
+		return err == nil && linkname == header.Linkname, reader, nil, nil
+
+	case tar.TypeLink:
+		linkname := filepath.Join(dir, header.Linkname)
+		if t.getStagedPath(linkname) != linkname {
+			// The linked file is been written by the extraction.
+			return false, reader, nil, nil
+		}
+		linfo, err := os.Lstat(linkname)
+		return err == nil && os.SameFile(info, linfo), reader, nil, nil
+
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok || info.Mode().Type() != header.FileInfo().Mode().Type() {
+			return false, reader, nil, nil
+		}
+		dev := unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor))
+		return uint64(stat.Rdev) == dev, reader, nil, nil
+	}
+
+	return false, reader, nil, nil
+}
+
+// notifySkip reports the entry skipped by the overwrite policy
+// to the skip handler and to the journal.
+func (t *TarFormers) notifySkip(absPath, dir, targetPath string, header *tar.Header) error {
+	reason := t.Task.GetOverwritePolicy(absPath)
+
+	t.Logger.Debug(fmt.Sprintf("File %s skipped by overwrite policy %s.",
+		targetPath, reason))
+
+	if t.HasSkipHandler() {
+		err := t.skipHandler(absPath, dir, header, reason, t)
+		if err != nil {
+			return err
+		}
+	}
+
+	return t.journalSkip(targetPath, header, reason)
+}
+
+// compareFileContent compares the content of the reader with the
+// existing file. It returns true if the content is different and the
+// reader with the full content of the entry. If the file doesn't exist
+// or it isn't a regular file the content is not compared. The returned
+// closer must be closed after the read of the content.
+func (t *TarFormers) compareFileContent(path string, size int64, reader io.Reader) (bool, io.Reader, io.Closer, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, reader, nil, nil
+		}
+		return false, nil, nil, err
+	}
+
+	if !info.Mode().IsRegular() {
+		return false, reader, nil, nil
+	}
+
+	if info.Size() != size {
+		return true, reader, nil, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return false, nil, nil, err
+	}
+
+	bufNew := make([]byte, compareBufferSize)
+	bufOld := make([]byte, compareBufferSize)
+	var consumed int64
+
+	for {
+		n, rerr := io.ReadFull(reader, bufNew)
+		if n > 0 {
+			m, _ := io.ReadFull(f, bufOld[:n])
+			if m != n || !bytes.Equal(bufNew[:n], bufOld[:n]) {
+				// The already consumed content is equal to the
+				// content of the existing file.
+				return true, io.MultiReader(
+					io.NewSectionReader(f, 0, consumed),
+					bytes.NewReader(bufNew[:n]),
+					reader,
+				), f, nil
+			}
+			consumed += int64(n)
+		}
+
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			f.Close()
+			return false, nil, nil, rerr
+		}
+	}
+
+	// POST: the content is identical. The file is written again
+	// from the existing file.
+	return false, io.NewSectionReader(f, 0, consumed), f, nil
+}
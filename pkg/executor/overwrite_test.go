@@ -0,0 +1,92 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package executor_test
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+
+	. "github.com/geaaru/tar-formers/pkg/executor"
+	specs "github.com/geaaru/tar-formers/pkg/specs"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Overwrite", func() {
+
+	Context("Handlers", func() {
+
+		It("calls the file handler one time and the skip handler", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "file"),
+				[]byte("old"), 0644)).To(Succeed())
+
+			buf := newTestTarball([]testEntry{
+				{
+					Header: tar.Header{
+						Name: "file", Typeflag: tar.TypeReg, Mode: 0644,
+					},
+					Content: "new",
+				},
+				{
+					Header: tar.Header{
+						Name: "other", Typeflag: tar.TypeReg, Mode: 0644,
+					},
+					Content: "other",
+				},
+			})
+
+			s := specs.NewSpecFile()
+			s.SameOwner = false
+			s.OverwritePolicy = specs.OverwriteKeepExisting
+			s.TriggeredFiles = []string{"/file", "/other"}
+
+			calls := map[string]int{}
+			skipped := map[string]string{}
+
+			t := NewTarFormers(specs.NewConfig(nil))
+			t.SetReader(buf)
+			t.SetFileHandler(func(path, dst string, header *tar.Header,
+				content io.Reader, opts *TarFileOperation, t *TarFormers) error {
+				calls[path]++
+				return nil
+			})
+			t.SetSkipHandler(func(path, dst string, header *tar.Header,
+				reason string, t *TarFormers) error {
+				skipped[path] = reason
+				return nil
+			})
+
+			Expect(t.RunTask(s, dir)).To(Succeed())
+
+			Expect(calls).To(Equal(map[string]int{"/file": 1, "/other": 1}))
+			Expect(skipped).To(Equal(map[string]string{
+				"/file": specs.OverwriteKeepExisting,
+			}))
+
+			data, err := os.ReadFile(filepath.Join(dir, "file"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(Equal("old"))
+
+			data, err = os.ReadFile(filepath.Join(dir, "other"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(Equal("other"))
+		})
+	})
+})
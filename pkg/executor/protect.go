@@ -0,0 +1,60 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package executor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const protectMaxFiles = 10000
+
+// getProtectedName returns the name and the target path of the
+// first ._cfgNNNN_<name> file available.
+func (t *TarFormers) getProtectedName(dir, name string) (string, string, error) {
+	for i := 0; i < protectMaxFiles; i++ {
+		n := filepath.Join(filepath.Dir(name),
+			fmt.Sprintf("._cfg%04d_%s", i, filepath.Base(name)))
+
+		path, err := t.GetTargetPath(dir, n, false)
+		if err != nil {
+			return "", "", err
+		}
+
+		if _, err := os.Lstat(path); err == nil || t.getStagedPath(path) != path {
+			continue
+		}
+
+		return n, path, nil
+	}
+
+	return "", "", fmt.Errorf("Too many protected files for %s", name)
+}
+
+// reportConfigUpdates prints the list of the config files to update.
+func (t *TarFormers) reportConfigUpdates() {
+	if len(t.ConfigUpdates) == 0 {
+		return
+	}
+
+	t.Logger.Info(fmt.Sprintf(
+		"There are %d protected files to update:", len(t.ConfigUpdates)))
+	for _, f := range t.ConfigUpdates {
+		t.Logger.Info(fmt.Sprintf("- %s", f))
+	}
+}
@@ -0,0 +1,146 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package executor_test
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	. "github.com/geaaru/tar-formers/pkg/executor"
+	specs "github.com/geaaru/tar-formers/pkg/specs"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Protect", func() {
+
+	Context("Protected paths", func() {
+		var root, etc string
+
+		BeforeEach(func() {
+			root = filepath.Join(GinkgoT().TempDir(), "root")
+			etc = filepath.Join(root, "etc")
+			Expect(os.MkdirAll(etc, 0755)).To(Succeed())
+		})
+
+		extract := func(content string) *TarFormers {
+			s := specs.NewSpecFile()
+			s.SameOwner = false
+			s.ProtectPaths = []string{"/etc"}
+
+			t := NewTarFormers(specs.NewConfig(nil))
+			t.SetReader(newTestTarball([]testEntry{
+				{
+					Header: tar.Header{
+						Name: "etc/conf", Typeflag: tar.TypeReg, Mode: 0644,
+						ModTime: time.Unix(1600000000, 0),
+					},
+					Content: content,
+				},
+			}))
+			Expect(t.RunTask(s, root)).To(Succeed())
+			return t
+		}
+
+		readFile := func(name string) string {
+			data, err := os.ReadFile(filepath.Join(etc, name))
+			Expect(err).ToNot(HaveOccurred(), name)
+			return string(data)
+		}
+
+		listFiles := func() []string {
+			entries, err := os.ReadDir(etc)
+			Expect(err).ToNot(HaveOccurred())
+			ans := []string{}
+			for _, e := range entries {
+				ans = append(ans, e.Name())
+			}
+			return ans
+		}
+
+		It("writes the new file", func() {
+			t := extract("new")
+
+			Expect(listFiles()).To(Equal([]string{"conf"}))
+			Expect(readFile("conf")).To(Equal("new"))
+			Expect(t.ConfigUpdates).To(BeEmpty())
+		})
+
+		It("doesn't write the file with the same content", func() {
+			Expect(os.WriteFile(filepath.Join(etc, "conf"), []byte("same"), 0600)).To(Succeed())
+			info, err := os.Lstat(filepath.Join(etc, "conf"))
+			Expect(err).ToNot(HaveOccurred())
+
+			t := extract("same")
+
+			Expect(listFiles()).To(Equal([]string{"conf"}))
+			Expect(t.ConfigUpdates).To(BeEmpty())
+
+			after, err := os.Lstat(filepath.Join(etc, "conf"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(after.Sys().(*syscall.Stat_t).Ino).To(Equal(info.Sys().(*syscall.Stat_t).Ino))
+			Expect(after.ModTime()).To(Equal(info.ModTime()))
+			Expect(after.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		})
+
+		It("writes the changed files with increasing names", func() {
+			Expect(os.WriteFile(filepath.Join(etc, "conf"), []byte("old"), 0644)).To(Succeed())
+
+			for i, content := range []string{"first", "second", "third"} {
+				t := extract(content)
+				Expect(t.ConfigUpdates).To(HaveLen(1))
+				Expect(filepath.Base(t.ConfigUpdates[0])).To(Equal(
+					[]string{"._cfg0000_conf", "._cfg0001_conf", "._cfg0002_conf"}[i]))
+			}
+
+			Expect(listFiles()).To(Equal([]string{
+				"._cfg0000_conf", "._cfg0001_conf", "._cfg0002_conf", "conf",
+			}))
+			Expect(readFile("conf")).To(Equal("old"))
+			Expect(readFile("._cfg0000_conf")).To(Equal("first"))
+			Expect(readFile("._cfg0001_conf")).To(Equal("second"))
+			Expect(readFile("._cfg0002_conf")).To(Equal("third"))
+
+			// The same content of the installed file isn't a pending update.
+			t := extract("old")
+			Expect(t.ConfigUpdates).To(BeEmpty())
+			Expect(listFiles()).To(HaveLen(4))
+		})
+
+		It("writes the files excluded by the mask", func() {
+			Expect(os.WriteFile(filepath.Join(etc, "conf"), []byte("old"), 0644)).To(Succeed())
+
+			s := specs.NewSpecFile()
+			s.SameOwner = false
+			s.ProtectPaths = []string{"/etc"}
+			s.ProtectMask = []string{"/etc/conf"}
+			buf := newTestTarball([]testEntry{
+				{
+					Header:  tar.Header{Name: "etc/conf", Typeflag: tar.TypeReg, Mode: 0644},
+					Content: "new",
+				},
+			})
+			Expect(extractTestTarball(s, buf, root)).To(Succeed())
+
+			Expect(listFiles()).To(Equal([]string{"conf"}))
+			Expect(readFile("conf")).To(Equal("new"))
+		})
+	})
+})
@@ -0,0 +1,118 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package executor_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	. "github.com/geaaru/tar-formers/pkg/executor"
+	specs "github.com/geaaru/tar-formers/pkg/specs"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Remap", func() {
+
+	remapEntries := []testEntry{
+		{
+			Header: tar.Header{
+				Name: "file", Typeflag: tar.TypeReg, Mode: 0644,
+				Uid: 1500, Gid: 100, Uname: "foo", Gname: "users",
+			},
+			Content: "data",
+		},
+		{
+			Header: tar.Header{
+				Name: "other", Typeflag: tar.TypeReg, Mode: 0644,
+				Uid: 3000, Gid: 3000,
+			},
+			Content: "data",
+		},
+	}
+
+	Context("Extraction", func() {
+
+		It("remaps the owner of the files", func() {
+			if os.Geteuid() != 0 {
+				Skip("The change of the owner requires root.")
+			}
+
+			root := filepath.Join(GinkgoT().TempDir(), "root")
+			s := specs.NewSpecFile()
+			s.SameOwner = true
+			s.RemapUids = map[string]string{"1000-1999": "100000"}
+			s.RemapGids = map[string]string{"100": "200"}
+
+			Expect(extractTestTarball(s, newTestTarball(remapEntries), root)).To(Succeed())
+
+			info, err := os.Lstat(filepath.Join(root, "file"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Sys().(*syscall.Stat_t).Uid).To(Equal(uint32(100500)))
+			Expect(info.Sys().(*syscall.Stat_t).Gid).To(Equal(uint32(200)))
+
+			info, err = os.Lstat(filepath.Join(root, "other"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Sys().(*syscall.Stat_t).Uid).To(Equal(uint32(3000)))
+			Expect(info.Sys().(*syscall.Stat_t).Gid).To(Equal(uint32(3000)))
+		})
+
+		It("rejects the invalid rules", func() {
+			s := specs.NewSpecFile()
+			s.RemapUids = map[string]string{"0-100": "1000", "100": "0"}
+
+			err := extractTestTarball(s, newTestTarball(remapEntries),
+				filepath.Join(GinkgoT().TempDir(), "root"))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("Bridge", func() {
+
+		It("applies the rules of the reader and of the writer", func() {
+			in := specs.NewSpecFile()
+			in.RemapUids = map[string]string{"1000-1999": "100000"}
+			in.RemapUsers = map[string]string{"foo": "bar"}
+			out := specs.NewSpecFile()
+			out.Writer = specs.NewWriter()
+			out.RemapUids = map[string]string{"100500": "0"}
+			out.RemapGids = map[string]string{"100": "200"}
+			out.RemapGroups = map[string]string{"users": "staff"}
+
+			ans := bytes.NewBuffer(nil)
+			t := NewTarFormers(specs.NewConfig(nil))
+			t.SetReader(newTestTarball(remapEntries))
+			t.SetWriter(ans)
+			Expect(t.RunTaskBridge(in, out)).To(Succeed())
+
+			headers := readTestTarball(ans)
+			Expect(headers).To(HaveKey("file"))
+			// The rules of the writer are applied after the rules
+			// of the reader.
+			Expect(headers["file"].Uid).To(Equal(0))
+			Expect(headers["file"].Gid).To(Equal(200))
+			Expect(headers["file"].Uname).To(Equal("bar"))
+			Expect(headers["file"].Gname).To(Equal("staff"))
+
+			Expect(headers["other"].Uid).To(Equal(3000))
+			Expect(headers["other"].Gid).To(Equal(3000))
+		})
+	})
+})
@@ -0,0 +1,98 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package executor
+
+import (
+	"archive/tar"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// prepareReproducible resolves the source date epoch used to clamp
+// the modification times of the reproducible tarballs.
+func (t *TarFormers) prepareReproducible() error {
+	t.sourceDate = time.Time{}
+
+	w := t.TaskWriter.Writer
+	if w == nil || !w.Reproducible {
+		return nil
+	}
+
+	epoch, ok, err := w.GetSourceDateEpoch()
+	if err != nil {
+		return err
+	}
+	if ok {
+		t.sourceDate = epoch
+		t.Logger.Debug(fmt.Sprintf("Using source date epoch %d.", epoch.Unix()))
+	}
+
+	return nil
+}
+
+// normalizeHeader applies the reproducible rules of the writer
+// to the header.
+func (t *TarFormers) normalizeHeader(header *tar.Header) {
+	w := t.TaskWriter.Writer
+	if w == nil {
+		return
+	}
+
+	if w.Reproducible {
+		// Sub-second precision is stored only by PAX headers and
+		// depends on the filesystem.
+		header.ModTime = header.ModTime.Truncate(time.Second)
+		if !t.sourceDate.IsZero() && header.ModTime.After(t.sourceDate) {
+			header.ModTime = t.sourceDate
+		}
+		header.AccessTime = time.Time{}
+		header.ChangeTime = time.Time{}
+	}
+
+	if w.NormalizeOwner {
+		header.Uid = w.Uid
+		header.Gid = w.Gid
+		header.Uname = w.Uname
+		header.Gname = w.Gname
+	}
+
+	if w.CanonicalModes && header.Typeflag != tar.TypeSymlink {
+		// Keep the setuid, setgid and sticky bits.
+		mode := header.Mode &^ 0777
+		if header.Typeflag == tar.TypeDir || header.Mode&0111 != 0 {
+			mode |= 0755
+		} else {
+			mode |= 0644
+		}
+		header.Mode = mode
+	}
+}
+
+// getArchivePaths returns the list of the paths to archive. On
+// reproducible mode the paths are sorted.
+func (t *TarFormers) getArchivePaths(paths []string) []string {
+	if t.TaskWriter.Writer == nil || !t.TaskWriter.Writer.Reproducible {
+		return paths
+	}
+
+	ans := make([]string, len(paths))
+	copy(ans, paths)
+	sort.Strings(ans)
+
+	return ans
+}
@@ -0,0 +1,128 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package executor_test
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/geaaru/tar-formers/pkg/executor"
+	specs "github.com/geaaru/tar-formers/pkg/specs"
+	"github.com/geaaru/tar-formers/pkg/tools"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// sourceDateEpoch is the SOURCE_DATE_EPOCH of the tests.
+const sourceDateEpoch = 1700000000
+
+// createReproducibleTree creates the files of the tree in the
+// order of the names with the current time.
+func createReproducibleTree(dir string, names []string) {
+	Expect(os.RemoveAll(dir)).To(Succeed())
+	Expect(os.MkdirAll(dir, 0755)).To(Succeed())
+
+	for _, name := range names {
+		p := filepath.Join(dir, name)
+		Expect(os.MkdirAll(filepath.Dir(p), 0755)).To(Succeed())
+		Expect(os.WriteFile(p, []byte("content of "+name), 0644)).To(Succeed())
+	}
+}
+
+// archiveReproducible writes the reproducible tarball of the directory
+// compressed with the extension of the file and returns the sha256.
+func archiveReproducible(dir, tarball string) string {
+	s := specs.NewSpecFile()
+	s.Writer = specs.NewWriter()
+	s.Writer.ArchiveDirs = []string{dir}
+	s.Writer.Reproducible = true
+
+	opts := tools.NewTarCompressionOpts(true)
+	opts.Reproducible = true
+	opts.SetTuning(tools.DefaultLevel, 4, 0, 0)
+	Expect(tools.PrepareTarWriter(tarball, opts)).To(Succeed())
+
+	t := NewTarFormers(specs.NewConfig(nil))
+	t.SetWriter(opts.CompressWriter)
+	err := t.RunTaskWriter(s)
+	opts.Close()
+	Expect(err).ToNot(HaveOccurred())
+
+	data, err := os.ReadFile(tarball)
+	Expect(err).ToNot(HaveOccurred())
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+var _ = Describe("Reproducible", func() {
+
+	DescribeTable("Archive the same tree",
+		func(ext string) {
+			GinkgoT().Setenv(specs.SourceDateEpochEnv, fmt.Sprintf("%d", sourceDateEpoch))
+
+			tmpdir := GinkgoT().TempDir()
+			src := filepath.Join(tmpdir, "src")
+			names := []string{
+				"a", "b/c", "b/d/e", "f/g", "h",
+			}
+
+			createReproducibleTree(src, names)
+			hash1 := archiveReproducible(src, filepath.Join(tmpdir, "first.tar"+ext))
+
+			// Create the files in the reverse order with other mtimes.
+			reversed := []string{}
+			for i := len(names) - 1; i >= 0; i-- {
+				reversed = append(reversed, names[i])
+			}
+			createReproducibleTree(src, reversed)
+			mtime := time.Now().Add(time.Hour)
+			for _, name := range names {
+				Expect(os.Chtimes(filepath.Join(src, name), mtime, mtime)).To(Succeed())
+			}
+			hash2 := archiveReproducible(src, filepath.Join(tmpdir, "second.tar"+ext))
+
+			Expect(hash2).To(Equal(hash1))
+
+			// The mtimes are clamped to the source date epoch.
+			opts := tools.NewTarReaderCompressionOpts(true)
+			Expect(tools.PrepareTarReader(filepath.Join(tmpdir, "second.tar"+ext), opts)).To(Succeed())
+			defer opts.Close()
+			Expect(opts.CompressReader).ToNot(BeNil())
+
+			tr := tar.NewReader(opts.CompressReader)
+			entries := 0
+			for {
+				h, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				Expect(err).ToNot(HaveOccurred())
+				Expect(h.ModTime.Unix()).To(Equal(int64(sourceDateEpoch)), h.Name)
+				Expect(h.AccessTime.IsZero()).To(BeTrue(), h.Name)
+				Expect(h.ChangeTime.IsZero()).To(BeTrue(), h.Name)
+				entries++
+			}
+			Expect(entries).To(BeNumerically(">=", len(names)))
+		},
+		Entry("gzip", ".gz"),
+		Entry("zstd", ".zst"),
+	)
+})
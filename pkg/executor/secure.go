@@ -0,0 +1,119 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package executor
+
+import (
+	"archive/tar"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	specs "github.com/geaaru/tar-formers/pkg/specs"
+	tools "github.com/geaaru/tar-formers/pkg/tools"
+)
+
+// UnsafeEntryError is returned when an entry of the tarball
+// tries to write outside of the extraction directory.
+type UnsafeEntryError struct {
+	Name   string
+	Reason string
+}
+
+func (e *UnsafeEntryError) Error() string {
+	return fmt.Sprintf("Unsafe entry %s: %s", e.Name, e.Reason)
+}
+
+// GetTargetPath returns the path where the entry name is created
+// under the directory dir. With secure extraction enabled all the
+// symlinks of the path are resolved inside the directory. The last
+// component is resolved only if follow is true.
+func (t *TarFormers) GetTargetPath(dir, name string, follow bool) (string, error) {
+	if t.Task == nil || !t.Task.IsSecureExtraction() {
+		return filepath.Join(dir, name), nil
+	}
+
+	if tools.IsPathEscaping(name) {
+		return "", &UnsafeEntryError{
+			Name:   name,
+			Reason: "the path goes outside of the extraction directory",
+		}
+	}
+
+	ans, err := tools.SecureJoin(dir, name, follow)
+	if err != nil {
+		return "", &UnsafeEntryError{
+			Name:   name,
+			Reason: "error on resolve path: " + err.Error(),
+		}
+	}
+
+	return ans, nil
+}
+
+// checkHardlink validates the target of an hardlink.
+func (t *TarFormers) checkHardlink(name, linkname string) error {
+	if t.Task.IsSecureExtraction() && tools.IsPathEscaping(linkname) {
+		return &UnsafeEntryError{
+			Name: name,
+			Reason: fmt.Sprintf(
+				"the hardlink target %s is outside of the extraction directory",
+				linkname),
+		}
+	}
+	return nil
+}
+
+// handleUnsafeEntry logs the reason of the unsafe entry and returns
+// the error if the entry must be rejected.
+func (t *TarFormers) handleUnsafeEntry(err error) error {
+	if _, ok := err.(*UnsafeEntryError); !ok {
+		return err
+	}
+
+	if t.Task.GetUnsafeEntriesPolicy() == specs.UnsafeEntriesSkip {
+		t.Logger.Warning(fmt.Sprintf("%s. Skipped.", err.Error()))
+		return nil
+	}
+
+	t.Logger.Error(fmt.Sprintf("%s. Rejected.", err.Error()))
+	return err
+}
+
+// resolveLink updates the paths of the link resolving them again
+// with the symlinks created in the extraction directory.
+func (t *TarFormers) resolveLink(dir string, link *specs.Link) error {
+	var err error
+
+	if !t.Task.IsSecureExtraction() {
+		return nil
+	}
+
+	link.Path, err = t.GetTargetPath(dir, link.Name, false)
+	if err != nil {
+		return err
+	}
+
+	if link.TypeFlag != tar.TypeSymlink {
+		rel := strings.TrimPrefix(link.Linkname, filepath.Clean(dir))
+		link.Linkname, err = t.GetTargetPath(dir, rel, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
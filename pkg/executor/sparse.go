@@ -0,0 +1,704 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package executor
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	tarBlockSize    = 512
+	sparseBlockSize = 4096
+)
+
+// SparseEntry represents a Length-sized data fragment at Offset
+// of a sparse file.
+type SparseEntry struct {
+	Offset int64
+	Length int64
+}
+
+// GetSparseDatas returns the data fragments of the file through
+// SEEK_DATA/SEEK_HOLE. If the file ends with an hole a last empty
+// fragment at the end of the file is added.
+func GetSparseDatas(f *os.File, size int64) ([]SparseEntry, error) {
+	ans := []SparseEntry{}
+	fd := int(f.Fd())
+
+	var off int64 = 0
+	for off < size {
+		dataStart, err := unix.Seek(fd, off, unix.SEEK_DATA)
+		if err != nil {
+			if errors.Is(err, unix.ENXIO) {
+				// POST: no more data.
+				break
+			}
+			return nil, err
+		}
+		if dataStart >= size {
+			break
+		}
+
+		holeStart, err := unix.Seek(fd, dataStart, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, err
+		}
+		if holeStart > size {
+			holeStart = size
+		}
+
+		ans = append(ans, SparseEntry{
+			Offset: dataStart,
+			Length: holeStart - dataStart,
+		})
+		off = holeStart
+	}
+
+	if len(ans) == 0 || ans[len(ans)-1].Offset+ans[len(ans)-1].Length < size {
+		ans = append(ans, SparseEntry{Offset: size, Length: 0})
+	}
+
+	// Restore the position of the file.
+	_, err := f.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	return ans, nil
+}
+
+// SparseDataSize returns the size of the data of the fragments.
+func SparseDataSize(datas []SparseEntry) int64 {
+	var ans int64 = 0
+	for _, d := range datas {
+		ans += d.Length
+	}
+	return ans
+}
+
+// SparseCopy copies the content of the reader to the file without
+// write the blocks with only zeros. The holes are created through
+// seek and the file is truncated to the final size.
+func SparseCopy(f *os.File, reader io.Reader, buf []byte) (int64, error) {
+	var nb int64 = 0
+	zeros := make([]byte, sparseBlockSize)
+
+	for {
+		n, rerr := io.ReadFull(reader, buf)
+		if n > 0 {
+			data := buf[:n]
+			for len(data) > 0 {
+				l := len(data)
+				if l > sparseBlockSize {
+					l = sparseBlockSize
+				}
+
+				if bytes.Equal(data[:l], zeros[:l]) {
+					_, err := f.Seek(int64(l), io.SeekCurrent)
+					if err != nil {
+						return nb, err
+					}
+				} else {
+					_, err := f.Write(data[:l])
+					if err != nil {
+						return nb, err
+					}
+				}
+
+				nb += int64(l)
+				data = data[l:]
+			}
+		}
+
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			return nb, rerr
+		}
+	}
+
+	return nb, f.Truncate(nb)
+}
+
+// WriteSparseFile writes the file as a PAX 1.0 sparse entry directly
+// to the underlying writer of the tar writer tw, because tar.Writer
+// doesn't support the sparse entries. Only the data fragments of the
+// file are written. The reader r returns the content of the file with
+// the holes: if r is an io.Seeker the holes are skipped through seek,
+// otherwise they are read and checked.
+func (t *TarFormers) WriteSparseFile(tw *tar.Writer,
+	header *tar.Header, r io.Reader, datas []SparseEntry) error {
+
+	if t.writer == nil {
+		return errors.New("No writer available for sparse file")
+	}
+
+	// Write the padding of the previous entry. After the flush the
+	// tar writer doesn't have pending data and the blocks written
+	// directly are not seen by it.
+	err := t.beginEntry(tw)
+	if err != nil {
+		return err
+	}
+
+	// Prepare the sparse map
+	var smap bytes.Buffer
+	smap.WriteString(fmt.Sprintf("%d\n", len(datas)))
+	for _, d := range datas {
+		smap.WriteString(fmt.Sprintf("%d\n%d\n", d.Offset, d.Length))
+	}
+	smap.Write(make([]byte, blockPadding(int64(smap.Len()))))
+
+	physSize := int64(smap.Len()) + SparseDataSize(datas)
+
+	records := map[string]string{}
+	for k, v := range header.PAXRecords {
+		if !strings.HasPrefix(k, "GNU.sparse.") {
+			records[k] = v
+		}
+	}
+	for k, v := range header.Xattrs {
+		records["SCHILY.xattr."+k] = v
+	}
+	records["GNU.sparse.major"] = "1"
+	records["GNU.sparse.minor"] = "0"
+	records["GNU.sparse.name"] = header.Name
+	records["GNU.sparse.realsize"] = strconv.FormatInt(header.Size, 10)
+	records["mtime"] = formatPAXTime(header.ModTime)
+	if t.TaskWriter != nil && t.TaskWriter.SameChtimes {
+		if !header.AccessTime.IsZero() {
+			records["atime"] = formatPAXTime(header.AccessTime)
+		}
+		if !header.ChangeTime.IsZero() {
+			records["ctime"] = formatPAXTime(header.ChangeTime)
+		}
+	}
+	if header.Uname != "" {
+		records["uname"] = header.Uname
+	}
+	if header.Gname != "" {
+		records["gname"] = header.Gname
+	}
+
+	uid := int64(header.Uid)
+	gid := int64(header.Gid)
+	size := physSize
+	if !fitsOctal(uid, 8) {
+		records["uid"] = strconv.FormatInt(uid, 10)
+		uid = 0
+	}
+	if !fitsOctal(gid, 8) {
+		records["gid"] = strconv.FormatInt(gid, 10)
+		gid = 0
+	}
+	if !fitsOctal(size, 12) {
+		records["size"] = strconv.FormatInt(size, 10)
+		size = 0
+	}
+
+	keys := []string{}
+	for k := range records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var pax bytes.Buffer
+	for _, k := range keys {
+		pax.WriteString(formatPAXRecord(k, records[k]))
+	}
+
+	dir, base := filepath.Split(header.Name)
+	mtime := header.ModTime.Unix()
+	if mtime < 0 {
+		// The right value is available on PAX records.
+		mtime = 0
+	}
+
+	// Write the PAX extended header
+	xhdr := newUstarBlock(
+		filepath.Join(dir, "PaxHeaders.0", base),
+		0644, 0, 0, int64(pax.Len()), mtime, tar.TypeXHeader, "", "")
+	if _, err := t.writer.Write(xhdr); err != nil {
+		return err
+	}
+	pax.Write(make([]byte, blockPadding(int64(pax.Len()))))
+	if _, err := t.writer.Write(pax.Bytes()); err != nil {
+		return err
+	}
+
+	// Write the ustar header
+	hdr := newUstarBlock(
+		filepath.Join(dir, "GNUSparseFile.0", base),
+		header.Mode&07777, uid, gid, size, mtime, tar.TypeReg,
+		header.Uname, header.Gname)
+	if _, err := t.writer.Write(hdr); err != nil {
+		return err
+	}
+
+	// Write the sparse map and the data fragments
+	if _, err := t.writer.Write(smap.Bytes()); err != nil {
+		return err
+	}
+
+	seeker, _ := r.(io.Seeker)
+	var pos int64 = 0
+	for _, d := range datas {
+		if d.Length == 0 {
+			continue
+		}
+
+		if seeker != nil {
+			_, err = seeker.Seek(d.Offset, io.SeekStart)
+		} else {
+			err = skipSparseHole(r, d.Offset-pos)
+		}
+		if err != nil {
+			return err
+		}
+
+		nb, err := io.CopyN(t.writer, r, d.Length)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if nb != d.Length {
+			return fmt.Errorf("Sparse file %s changed while reading", header.Name)
+		}
+		pos = d.Offset + d.Length
+	}
+
+	if seeker == nil {
+		// Check the hole at the end of the file.
+		err = skipSparseHole(r, header.Size-pos)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = t.writer.Write(make([]byte, blockPadding(physSize)))
+	if err != nil {
+		return err
+	}
+
+	// The tar writer must be still without pending data.
+	err = tw.Flush()
+	if err != nil {
+		return fmt.Errorf("Tar writer changed on write sparse file %s: %s",
+			header.Name, err.Error())
+	}
+
+	return nil
+}
+
+// skipSparseHole reads the n bytes of an hole and checks that
+// they are all zeros.
+func skipSparseHole(r io.Reader, n int64) error {
+	buf := make([]byte, sparseBlockSize)
+	zeros := make([]byte, sparseBlockSize)
+
+	for n > 0 {
+		l := int64(len(buf))
+		if l > n {
+			l = n
+		}
+		_, err := io.ReadFull(r, buf[:l])
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(buf[:l], zeros[:l]) {
+			return errors.New("Found data in a hole of the sparse map")
+		}
+		n -= l
+	}
+
+	return nil
+}
+
+func blockPadding(n int64) int64 {
+	return -n & (tarBlockSize - 1)
+}
+
+func fitsOctal(n int64, width int) bool {
+	return n >= 0 && n < int64(1)<<(3*(width-1))
+}
+
+func formatPAXTime(ts time.Time) string {
+	secs, nsecs := ts.Unix(), ts.Nanosecond()
+	if nsecs == 0 {
+		return strconv.FormatInt(secs, 10)
+	}
+	return strings.TrimRight(fmt.Sprintf("%d.%09d", secs, nsecs), "0")
+}
+
+func formatPAXRecord(k, v string) string {
+	const padding = 3 // Extra padding for ' ', '=', and '\n'
+	size := len(k) + len(v) + padding
+	size += len(strconv.Itoa(size))
+	record := strconv.Itoa(size) + " " + k + "=" + v + "\n"
+
+	// Final adjustment if adding size field increased the record size.
+	if len(record) != size {
+		size = len(record)
+		record = strconv.Itoa(size) + " " + k + "=" + v + "\n"
+	}
+	return record
+}
+
+// newUstarBlock creates a ustar header block.
+func newUstarBlock(name string, mode, uid, gid, size, mtime int64,
+	typeflag byte, uname, gname string) []byte {
+	blk := make([]byte, tarBlockSize)
+
+	setString := func(b []byte, s string) {
+		copy(b, s)
+	}
+	setOctal := func(b []byte, n int64) {
+		s := strconv.FormatInt(n, 8)
+		s = strings.Repeat("0", len(b)-1-len(s)) + s
+		copy(b, s)
+	}
+
+	if len(name) > 100 {
+		name = name[len(name)-100:]
+	}
+
+	setString(blk[0:100], name)
+	setOctal(blk[100:108], mode)
+	setOctal(blk[108:116], uid)
+	setOctal(blk[116:124], gid)
+	setOctal(blk[124:136], size)
+	setOctal(blk[136:148], mtime)
+	blk[156] = typeflag
+	setString(blk[257:263], "ustar\x00")
+	setString(blk[263:265], "00")
+	setString(blk[265:297], uname)
+	setString(blk[297:329], gname)
+	setOctal(blk[329:337], 0)
+	setOctal(blk[337:345], 0)
+
+	// Calculate the checksum with the checksum field filled of spaces.
+	copy(blk[148:156], "        ")
+	var chksum int64 = 0
+	for _, c := range blk {
+		chksum += int64(c)
+	}
+	s := strconv.FormatInt(chksum, 8)
+	s = strings.Repeat("0", 6-len(s)) + s
+	copy(blk[148:156], s+"\x00 ")
+
+	return blk
+}
+
+// injectSparseFile writes the file as sparse entry if the file
+// contains holes. It returns false if the file is not sparse.
+func (t *TarFormers) injectSparseFile(tw *tar.Writer,
+	file string, header *tar.Header) (bool, error) {
+
+	f, err := os.Open(file)
+	if err != nil {
+		return false, fmt.Errorf(
+			"Error on open file %s: %s", file, err.Error())
+	}
+	defer f.Close()
+
+	datas, err := GetSparseDatas(f, header.Size)
+	if err != nil {
+		t.Logger.Debug(fmt.Sprintf(
+			"[%s] Error on detect holes: %s", file, err.Error()))
+		return false, nil
+	}
+
+	if SparseDataSize(datas) >= header.Size {
+		return false, nil
+	}
+
+	t.Logger.Debug(fmt.Sprintf("Injecting sparse file %s (%d of %d bytes)",
+		header.Name, SparseDataSize(datas), header.Size))
+
+	err = t.WriteSparseFile(tw, header, f, datas)
+	if err != nil {
+		return true, fmt.Errorf("Error on write sparse file %s: %s",
+			file, err.Error())
+	}
+
+	return true, nil
+}
+
+// bridgeSparseFile writes the sparse entry read by the tar reader
+// with the sparse map of the input entry. Only the data fragments
+// are written: the holes returned by the tar reader are checked and
+// skipped without temporary files.
+func (t *TarFormers) bridgeSparseFile(tw *tar.Writer,
+	header *tar.Header, datas []SparseEntry, reader io.Reader) error {
+
+	t.Logger.Debug(fmt.Sprintf("Bridging sparse file %s (%d of %d bytes)",
+		header.Name, SparseDataSize(datas), header.Size))
+
+	header.Typeflag = tar.TypeReg
+	err := t.WriteSparseFile(tw, header, reader, datas)
+	if IsLimitError(err) {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("Error on write sparse file %s: %s",
+			header.Name, err.Error())
+	}
+
+	return nil
+}
+
+// sparseHeaderRecorder records the raw blocks read by the tar reader
+// on Next. The sparse maps of the old GNU format and of the PAX 1.0
+// format are not exposed by archive/tar and are parsed from them.
+type sparseHeaderRecorder struct {
+	reader    io.Reader
+	offset    int64
+	start     int64
+	recording bool
+	buf       bytes.Buffer
+}
+
+func newSparseHeaderRecorder(r io.Reader) *sparseHeaderRecorder {
+	return &sparseHeaderRecorder{reader: r}
+}
+
+func (r *sparseHeaderRecorder) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if r.recording && n > 0 {
+		r.buf.Write(p[:n])
+	}
+	r.offset += int64(n)
+	return n, err
+}
+
+// begin starts the recording. The content of the current entry
+// must be already consumed.
+func (r *sparseHeaderRecorder) begin() {
+	r.buf.Reset()
+	r.start = r.offset
+	r.recording = true
+}
+
+// end stops the recording and returns the blocks read without the
+// padding of the previous entry.
+func (r *sparseHeaderRecorder) end() []byte {
+	r.recording = false
+	pad := blockPadding(r.start)
+	if int64(r.buf.Len()) < pad {
+		return nil
+	}
+	return r.buf.Bytes()[pad:]
+}
+
+// ParseSparseMap returns the sparse map of the sparse entry. The map
+// of the PAX 0.x formats is read from the PAX records, the map of the
+// old GNU format and of the PAX 1.0 format from the raw blocks read
+// by the tar reader for the entry. It returns nil if the map is not
+// available.
+func ParseSparseMap(raw []byte, header *tar.Header) ([]SparseEntry, error) {
+	var ans []SparseEntry
+	var err error
+
+	major := header.PAXRecords["GNU.sparse.major"]
+	minor := header.PAXRecords["GNU.sparse.minor"]
+
+	if smap, ok := header.PAXRecords["GNU.sparse.map"]; ok && major != "1" {
+		ans, err = parseSparseNumbers(strings.Split(smap, ","), false)
+		if err != nil {
+			return nil, err
+		}
+		return validateSparseMap(ans, header.Size)
+	}
+
+	for len(raw) >= tarBlockSize {
+		blk := raw[:tarBlockSize]
+		raw = raw[tarBlockSize:]
+
+		if bytes.Equal(blk, make([]byte, tarBlockSize)) {
+			return nil, nil
+		}
+
+		switch blk[156] {
+		case tar.TypeXHeader, tar.TypeXGlobalHeader,
+			tar.TypeGNULongName, tar.TypeGNULongLink:
+			size, err := parseTarNumeric(blk[124:136])
+			if err != nil {
+				return nil, err
+			}
+			size += blockPadding(size)
+			if size > int64(len(raw)) {
+				return nil, nil
+			}
+			raw = raw[size:]
+			continue
+
+		case tar.TypeGNUSparse:
+			ans, err = parseGNUSparseMap(blk, raw)
+
+		default:
+			if major != "1" || minor != "0" {
+				return nil, nil
+			}
+			// The map is at the beginning of the data.
+			ans, err = parseSparseNumbers(strings.Split(string(raw), "\n"), true)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+		return validateSparseMap(ans, header.Size)
+	}
+
+	return nil, nil
+}
+
+// parseGNUSparseMap parses the sparse map of the old GNU format
+// from the header and the extension blocks.
+func parseGNUSparseMap(blk, raw []byte) ([]SparseEntry, error) {
+	ans := []SparseEntry{}
+
+	parse := func(b []byte, n int) error {
+		for i := 0; i < n; i++ {
+			e := b[i*24 : (i+1)*24]
+			if e[0] == 0 {
+				break
+			}
+			off, err := parseTarNumeric(e[:12])
+			if err != nil {
+				return err
+			}
+			length, err := parseTarNumeric(e[12:])
+			if err != nil {
+				return err
+			}
+			ans = append(ans, SparseEntry{Offset: off, Length: length})
+		}
+		return nil
+	}
+
+	err := parse(blk[386:482], 4)
+	if err != nil {
+		return nil, err
+	}
+
+	extended := blk[482] != 0
+	for extended {
+		if len(raw) < tarBlockSize {
+			return nil, errors.New("Truncated sparse map")
+		}
+		blk, raw = raw[:tarBlockSize], raw[tarBlockSize:]
+		err = parse(blk[:504], 21)
+		if err != nil {
+			return nil, err
+		}
+		extended = blk[504] != 0
+	}
+
+	return ans, nil
+}
+
+// parseSparseNumbers parses the list of numbers of a sparse map.
+// With count the first number is the number of the entries.
+func parseSparseNumbers(fields []string, count bool) ([]SparseEntry, error) {
+	ans := []SparseEntry{}
+
+	n := len(fields) / 2
+	if count {
+		if len(fields) == 0 {
+			return nil, errors.New("Invalid sparse map")
+		}
+		c, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil || c < 0 || c > int64(len(fields)-1)/2 {
+			return nil, errors.New("Invalid sparse map")
+		}
+		n = int(c)
+		fields = fields[1:]
+	} else if len(fields)%2 != 0 {
+		return nil, errors.New("Invalid sparse map")
+	}
+
+	for i := 0; i < n; i++ {
+		off, err := strconv.ParseInt(fields[2*i], 10, 64)
+		if err != nil {
+			return nil, errors.New("Invalid sparse map")
+		}
+		length, err := strconv.ParseInt(fields[2*i+1], 10, 64)
+		if err != nil {
+			return nil, errors.New("Invalid sparse map")
+		}
+		ans = append(ans, SparseEntry{Offset: off, Length: length})
+	}
+
+	return ans, nil
+}
+
+// validateSparseMap checks that the fragments are sorted and inside
+// the file. An empty fragment is added at the end of the file if
+// the file ends with an hole.
+func validateSparseMap(datas []SparseEntry, size int64) ([]SparseEntry, error) {
+	var pos int64 = 0
+	for _, d := range datas {
+		if d.Offset < pos || d.Length < 0 || d.Offset+d.Length > size {
+			return nil, errors.New("Invalid sparse map")
+		}
+		pos = d.Offset + d.Length
+	}
+
+	if pos < size || len(datas) == 0 {
+		datas = append(datas, SparseEntry{Offset: size, Length: 0})
+	}
+
+	return datas, nil
+}
+
+// parseTarNumeric parses a numeric field of the tar header in octal
+// or in base-256 format.
+func parseTarNumeric(b []byte) (int64, error) {
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		// Base-256 format: only the positive numbers of 63 bits
+		// are valid.
+		var n uint64 = 0
+		for i, c := range b[1:] {
+			if i < len(b)-9 && c != 0 {
+				return 0, errors.New("Invalid numeric field")
+			}
+			n = n<<8 | uint64(c)
+		}
+		if b[0] != 0x80 || n > math.MaxInt64 {
+			return 0, errors.New("Invalid numeric field")
+		}
+		return int64(n), nil
+	}
+
+	s := strings.Trim(string(b), " \x00")
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(s, 8, 64)
+}
@@ -0,0 +1,205 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package executor_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	. "github.com/geaaru/tar-formers/pkg/executor"
+	specs "github.com/geaaru/tar-formers/pkg/specs"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+const sparseTestSize = 20 << 20
+
+// createSparseTestFile creates a file of 20MB with two data fragments.
+func createSparseTestFile(path string) {
+	f, err := os.Create(path)
+	Expect(err).ToNot(HaveOccurred())
+	defer f.Close()
+
+	Expect(f.Truncate(sparseTestSize)).To(Succeed())
+	_, err = f.WriteAt([]byte("HEAD"), 0)
+	Expect(err).ToNot(HaveOccurred())
+	_, err = f.WriteAt([]byte("MIDDLE"), 8<<20)
+	Expect(err).ToNot(HaveOccurred())
+
+	info, err := f.Stat()
+	Expect(err).ToNot(HaveOccurred())
+	if info.Sys().(*syscall.Stat_t).Blocks*512 >= sparseTestSize {
+		Skip("The filesystem doesn't support sparse files.")
+	}
+}
+
+// readTestTarballContents returns the content of the regular files
+// of the tarball.
+func readTestTarballContents(data []byte) map[string][]byte {
+	ans := make(map[string][]byte, 0)
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		Expect(err).ToNot(HaveOccurred())
+		if h.Typeflag == tar.TypeReg {
+			content, err := io.ReadAll(tr)
+			Expect(err).ToNot(HaveOccurred())
+			ans[filepath.Base(h.Name)] = content
+		}
+	}
+	return ans
+}
+
+// checkSparseTestTarball checks the tarball with the tar commands.
+func checkSparseTestTarball(tarball, src string) {
+	for _, cmd := range [][]string{
+		{"tar", "-xSf"},
+		{"bsdtar", "-xf"},
+	} {
+		if _, err := exec.LookPath(cmd[0]); err != nil {
+			GinkgoWriter.Printf("%s not available. Skipped.\n", cmd[0])
+			continue
+		}
+
+		out := filepath.Join(GinkgoT().TempDir(), cmd[0])
+		Expect(os.MkdirAll(out, 0755)).To(Succeed())
+
+		output, err := exec.Command(cmd[0], cmd[1], tarball, "-C", out).CombinedOutput()
+		Expect(err).ToNot(HaveOccurred(), string(output))
+
+		for _, f := range []string{"a", "vm.img", "b"} {
+			expected, err := os.ReadFile(filepath.Join(src, f))
+			Expect(err).ToNot(HaveOccurred())
+			data, err := os.ReadFile(filepath.Join(out, src, f))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(bytes.Equal(data, expected)).To(BeTrue(),
+				"content of %s extracted by %s", f, cmd[0])
+		}
+	}
+}
+
+var _ = Describe("Sparse", func() {
+
+	Context("Sparse files", func() {
+		var tmpdir, src string
+
+		BeforeEach(func() {
+			tmpdir = GinkgoT().TempDir()
+			src = filepath.Join(tmpdir, "src")
+			Expect(os.MkdirAll(src, 0755)).To(Succeed())
+
+			Expect(os.WriteFile(filepath.Join(src, "a"),
+				[]byte("first file"), 0644)).To(Succeed())
+			createSparseTestFile(filepath.Join(src, "vm.img"))
+			Expect(os.WriteFile(filepath.Join(src, "b"),
+				bytes.Repeat([]byte("b"), 1000), 0644)).To(Succeed())
+		})
+
+		It("archives sparse and normal files", func() {
+			s := specs.NewSpecFile()
+			s.Sparse = true
+			s.Writer = specs.NewWriter()
+			s.Writer.ArchiveDirs = []string{src}
+
+			buf := bytes.NewBuffer(nil)
+			t := NewTarFormers(specs.NewConfig(nil))
+			t.SetWriter(buf)
+			Expect(t.RunTaskWriter(s)).To(Succeed())
+
+			Expect(buf.Len()).To(BeNumerically("<", 64<<10))
+
+			vm, err := os.ReadFile(filepath.Join(src, "vm.img"))
+			Expect(err).ToNot(HaveOccurred())
+
+			contents := readTestTarballContents(buf.Bytes())
+			Expect(string(contents["a"])).To(Equal("first file"))
+			Expect(bytes.Equal(contents["vm.img"], vm)).To(BeTrue())
+			Expect(contents["b"]).To(HaveLen(1000))
+
+			tarball := filepath.Join(tmpdir, "out.tar")
+			Expect(os.WriteFile(tarball, buf.Bytes(), 0644)).To(Succeed())
+			checkSparseTestTarball(tarball, src)
+
+			dst := filepath.Join(tmpdir, "dst")
+			e := specs.NewSpecFile()
+			e.Sparse = true
+			Expect(extractTestTarball(e, buf, dst)).To(Succeed())
+
+			data, err := os.ReadFile(filepath.Join(dst, src, "vm.img"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(bytes.Equal(data, vm)).To(BeTrue())
+		})
+
+		for _, version := range []string{"gnu", "0.0", "0.1", "1.0"} {
+			version := version
+
+			It("bridges the sparse map of the "+version+" format", func() {
+				if _, err := exec.LookPath("tar"); err != nil {
+					Skip("GNU tar not available.")
+				}
+
+				in := filepath.Join(tmpdir, "in.tar")
+				args := []string{"-S", "--format=gnu"}
+				if version != "gnu" {
+					args = []string{"-S", "--format=posix", "--sparse-version=" + version}
+				}
+				args = append(args, "-cf", in, "-C", "/", src[1:])
+
+				output, err := exec.Command("tar", args...).CombinedOutput()
+				Expect(err).ToNot(HaveOccurred(), string(output))
+
+				inFile, err := os.Open(in)
+				Expect(err).ToNot(HaveOccurred())
+				defer inFile.Close()
+
+				sIn := specs.NewSpecFile()
+				sOut := specs.NewSpecFile()
+				sOut.Sparse = true
+				sOut.Writer = specs.NewWriter()
+
+				buf := bytes.NewBuffer(nil)
+				t := NewTarFormers(specs.NewConfig(nil))
+				t.SetReader(inFile)
+				t.SetWriter(buf)
+				Expect(t.RunTaskBridge(sIn, sOut)).To(Succeed())
+
+				// Only the data fragments are written.
+				Expect(buf.Len()).To(BeNumerically("<", 64<<10))
+
+				vm, err := os.ReadFile(filepath.Join(src, "vm.img"))
+				Expect(err).ToNot(HaveOccurred())
+
+				contents := readTestTarballContents(buf.Bytes())
+				Expect(string(contents["a"])).To(Equal("first file"))
+				Expect(bytes.Equal(contents["vm.img"], vm)).To(BeTrue())
+				Expect(contents["b"]).To(HaveLen(1000))
+
+				tarball := filepath.Join(tmpdir, "out.tar")
+				Expect(os.WriteFile(tarball, buf.Bytes(), 0644)).To(Succeed())
+				checkSparseTestTarball(tarball, src)
+			})
+		}
+	})
+})
@@ -0,0 +1,223 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package executor
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	specs "github.com/geaaru/tar-formers/pkg/specs"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	WhiteoutPrefix     = ".wh."
+	WhiteoutMetaPrefix = ".wh..wh."
+	WhiteoutOpaqueDir  = ".wh..wh..opq"
+
+	overlayOpaqueXattr = "trusted.overlay.opaque"
+)
+
+// IsWhiteout returns true if the base name of the path is an OCI whiteout.
+func IsWhiteout(path string) bool {
+	return strings.HasPrefix(filepath.Base(path), WhiteoutPrefix)
+}
+
+// addLayerPath registers the path and its parents as paths
+// created by the current layer.
+func (t *TarFormers) addLayerPath(dir, path string) {
+	dir = filepath.Clean(dir)
+	for path != dir && strings.HasPrefix(path, dir) {
+		if _, ok := t.layerPaths[path]; ok {
+			break
+		}
+		t.layerPaths[path] = true
+		path = filepath.Dir(path)
+	}
+}
+
+// handleWhiteout manages the whiteout entry with the path targetPath
+// in relation to the whiteouts mode of the task.
+func (t *TarFormers) handleWhiteout(targetPath string, header *tar.Header) error {
+	base := filepath.Base(targetPath)
+	parent := filepath.Dir(targetPath)
+
+	// The whiteouts of . and .. reference the parent directories.
+	name := strings.TrimPrefix(base, WhiteoutPrefix)
+	if name == "" || name == "." || name == ".." {
+		return &UnsafeEntryError{
+			Name:   header.Name,
+			Reason: "the whiteout references a parent directory",
+		}
+	}
+
+	if t.Task.GetWhiteoutsMode() == specs.WhiteoutsOverlay {
+		if base == WhiteoutOpaqueDir {
+			return t.createOverlayOpaque(parent, header)
+		} else if strings.HasPrefix(base, WhiteoutMetaPrefix) {
+			t.Logger.Debug(fmt.Sprintf("Whiteout %s ignored.", targetPath))
+			return nil
+		}
+		path := filepath.Join(parent, name)
+		existed := t.existPath(path)
+		err := t.createOverlayWhiteout(path, header)
+		if err != nil {
+			return err
+		}
+
+		e := specs.NewJournalEntry(path, specs.JournalCreated, header)
+		if existed {
+			e.Action = specs.JournalReplaced
+		}
+		e.Type = specs.GetJournalType(tar.TypeChar)
+		e.Reason = "whiteout"
+		t.setJournalStat(e, t.getStagedPath(path))
+		return t.addJournalEntry(e)
+	}
+
+	// POST: apply mode
+	if base == WhiteoutOpaqueDir {
+		t.Logger.Debug(fmt.Sprintf("Clearing opaque directory %s.", parent))
+		return t.clearOpaqueDir(parent)
+	} else if strings.HasPrefix(base, WhiteoutMetaPrefix) {
+		t.Logger.Debug(fmt.Sprintf("Whiteout %s ignored.", targetPath))
+		return nil
+	}
+
+	path := filepath.Join(parent, name)
+	if _, ok := t.layerPaths[path]; ok {
+		// The path is been created by the same layer.
+		t.Logger.Debug(fmt.Sprintf(
+			"Whiteout %s ignored for path of the same layer.", targetPath))
+		return nil
+	}
+
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	t.Logger.Debug(fmt.Sprintf("Removing whiteout path %s.", path))
+	err := t.removePath(path)
+	if err != nil {
+		return fmt.Errorf("Error on remove whiteout path %s: %s",
+			path, err.Error())
+	}
+
+	return t.journalRemove(path, "whiteout")
+}
+
+// clearOpaqueDir removes all the files of the directory that are
+// not created by the current layer.
+func (t *TarFormers) clearOpaqueDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("Error on read opaque directory %s: %s",
+			dir, err.Error())
+	}
+
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+
+		if t.stage != nil && t.stage.isStaged(path) {
+			continue
+		}
+
+		if _, ok := t.layerPaths[path]; ok {
+			if e.IsDir() {
+				err = t.clearOpaqueDir(path)
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		err = t.removePath(path)
+		if err != nil {
+			return fmt.Errorf("Error on remove path %s: %s",
+				path, err.Error())
+		}
+
+		err = t.journalRemove(path, "opaque")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// createOverlayWhiteout creates the overlayfs whiteout: a char
+// device with major and minor 0.
+func (t *TarFormers) createOverlayWhiteout(path string, header *tar.Header) error {
+	path, err := t.GetWritePath(path)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Lstat(path); err == nil {
+		err = os.RemoveAll(path)
+		if err != nil {
+			return fmt.Errorf("Error on remove path %s: %s",
+				path, err.Error())
+		}
+	}
+
+	_, err = t.CreateDir(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	if err := unix.Mknod(path, unix.S_IFCHR, 0); err != nil {
+		return fmt.Errorf("Error on create overlay whiteout %s: %s",
+			path, err.Error())
+	}
+
+	if t.Task.SameOwner {
+		if err := os.Lchown(path, header.Uid, header.Gid); err != nil {
+			return fmt.Errorf("For path %s error on chown: %s",
+				path, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// createOverlayOpaque sets the overlayfs opaque xattr to the directory.
+func (t *TarFormers) createOverlayOpaque(dir string, header *tar.Header) error {
+	newDir, err := t.CreateDir(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	if !newDir && t.stage != nil {
+		// Restore the existing directory on rollback.
+		err = t.stage.saveDir(t, dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	return t.SetXattrAttr(dir, overlayOpaqueXattr, "y", 0)
+}
@@ -0,0 +1,156 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package executor_test
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+
+	specs "github.com/geaaru/tar-formers/pkg/specs"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Whiteout", func() {
+
+	Context("Unsafe whiteouts", func() {
+		var tmpdir, root, outside, victim string
+
+		BeforeEach(func() {
+			tmpdir = GinkgoT().TempDir()
+			root = filepath.Join(tmpdir, "root")
+			outside = filepath.Join(tmpdir, "outside")
+			victim = filepath.Join(outside, "victim")
+			Expect(os.MkdirAll(filepath.Join(root, "sub"), 0755)).To(Succeed())
+			Expect(os.MkdirAll(outside, 0755)).To(Succeed())
+			Expect(os.WriteFile(victim, []byte("data"), 0644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(root, "sub", "file"),
+				[]byte("data"), 0644)).To(Succeed())
+		})
+
+		newWhiteoutSpec := func(mode, policy string) *specs.SpecFile {
+			s := specs.NewSpecFile()
+			s.SameOwner = false
+			s.Whiteouts = mode
+			s.UnsafeEntries = policy
+			// The secure extraction is forced by the whiteouts mode.
+			s.SecureExtraction = false
+			return s
+		}
+
+		for _, mode := range []string{specs.WhiteoutsApply, specs.WhiteoutsOverlay} {
+			mode := mode
+
+			It("rejects the whiteouts outside of the root with "+mode, func() {
+				buf := newTestTarball([]testEntry{
+					{
+						Header: tar.Header{
+							Name: "../outside/.wh.victim", Typeflag: tar.TypeReg,
+						},
+					},
+				})
+
+				err := extractTestTarball(
+					newWhiteoutSpec(mode, specs.UnsafeEntriesReject), buf, root)
+				Expect(err).To(HaveOccurred())
+
+				data, err := os.ReadFile(victim)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(data)).To(Equal("data"))
+			})
+
+			It("skips the whiteouts outside of the root with "+mode, func() {
+				buf := newTestTarball([]testEntry{
+					{
+						Header: tar.Header{
+							Name: "../outside/.wh.victim", Typeflag: tar.TypeReg,
+						},
+					},
+					{
+						Header: tar.Header{
+							Name: "sub/.wh...", Typeflag: tar.TypeReg,
+						},
+					},
+				})
+
+				err := extractTestTarball(
+					newWhiteoutSpec(mode, specs.UnsafeEntriesSkip), buf, root)
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = os.Lstat(victim)
+				Expect(err).ToNot(HaveOccurred())
+				_, err = os.Lstat(filepath.Join(root, "sub", "file"))
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("resolves the symlinks of the whiteouts inside the root with "+mode, func() {
+				Expect(os.Symlink(outside, filepath.Join(root, "link"))).To(Succeed())
+
+				buf := newTestTarball([]testEntry{
+					{
+						Header: tar.Header{
+							Name: "link/.wh.victim", Typeflag: tar.TypeReg,
+						},
+					},
+				})
+
+				err := extractTestTarball(
+					newWhiteoutSpec(mode, specs.UnsafeEntriesReject), buf, root)
+				Expect(err).ToNot(HaveOccurred())
+
+				info, err := os.Lstat(victim)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(info.Mode().IsRegular()).To(BeTrue())
+			})
+		}
+
+		It("rejects the whiteouts of the parent directories", func() {
+			buf := newTestTarball([]testEntry{
+				{
+					Header: tar.Header{
+						Name: "sub/.wh..", Typeflag: tar.TypeReg,
+					},
+				},
+			})
+
+			err := extractTestTarball(
+				newWhiteoutSpec(specs.WhiteoutsApply, specs.UnsafeEntriesReject), buf, root)
+			Expect(err).To(HaveOccurred())
+
+			_, err = os.Lstat(filepath.Join(root, "sub", "file"))
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("removes the paths of the whiteouts inside the root", func() {
+			buf := newTestTarball([]testEntry{
+				{
+					Header: tar.Header{
+						Name: "sub/.wh.file", Typeflag: tar.TypeReg,
+					},
+				},
+			})
+
+			err := extractTestTarball(
+				newWhiteoutSpec(specs.WhiteoutsApply, specs.UnsafeEntriesReject), buf, root)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = os.Lstat(filepath.Join(root, "sub", "file"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+	})
+})
@@ -25,6 +25,9 @@ import (
 	"path/filepath"
 	"syscall"
 	"time"
+
+	specs "github.com/geaaru/tar-formers/pkg/specs"
+	tools "github.com/geaaru/tar-formers/pkg/tools"
 )
 
 type inodeResource struct {
@@ -43,6 +46,18 @@ func (t *TarFormers) InjectFile2Writer(tw *tar.Writer,
 		fnewname = file
 	}
 
+	// Sockets could not be archived.
+	if s.Mode()&os.ModeSocket != 0 {
+		if t.TaskWriter.Writer != nil &&
+			t.TaskWriter.Writer.GetSocketsPolicy() == specs.SocketsFail {
+			return fmt.Errorf("File %s is a socket and could not be archived.",
+				file)
+		}
+		t.Logger.Warning(fmt.Sprintf(
+			"File %s is a socket and could not be archived. Skipped.", file))
+		return nil
+	}
+
 	header, err := tar.FileInfoHeader(s, "")
 	if err != nil {
 		return fmt.Errorf("Error on create tar header for file %s: %s",
@@ -87,7 +102,33 @@ func (t *TarFormers) InjectFile2Writer(tw *tar.Writer,
 			file, err.Error())
 	}
 
-	header.Xattrs = xattr
+	for k, v := range xattr {
+		if !t.TaskWriter.Writer.IsXattrAllowed(k) {
+			continue
+		}
+		if header.PAXRecords == nil {
+			header.PAXRecords = make(map[string]string, 0)
+		}
+
+		// The POSIX ACLs are written in text format.
+		if k == tools.AclXattrAccess || k == tools.AclXattrDefault {
+			acl, err := tools.AclXattrToText([]byte(v))
+			if err != nil {
+				t.Logger.Warning(fmt.Sprintf(
+					"[%s] Ignoring invalid ACL %s: %s", file, k, err.Error()))
+				continue
+			}
+
+			if k == tools.AclXattrAccess {
+				header.PAXRecords[specs.PaxAclAccess] = acl
+			} else {
+				header.PAXRecords[specs.PaxAclDefault] = acl
+			}
+			continue
+		}
+
+		header.PAXRecords[specs.PaxXattrPrefix+k] = v
+	}
 
 	stat_t := s.Sys().(*syscall.Stat_t)
 
@@ -129,14 +170,49 @@ func (t *TarFormers) InjectFile2Writer(tw *tar.Writer,
 		// Note: this works only on Linux/Unix
 		header.AccessTime = time.Unix(stat_t.Atim.Unix())
 		header.ChangeTime = time.Unix(stat_t.Ctim.Unix())
+	} else {
+		// tar.FileInfoHeader sets the atime and the ctime of the file.
+		header.AccessTime = time.Time{}
+		header.ChangeTime = time.Time{}
 	}
 
 	header.Uid = int(stat_t.Uid)
 	header.Gid = int(stat_t.Gid)
 
+	if t.TaskWriter.MapEntities {
+		t.mapHeaderNames(header)
+	}
+
+	t.normalizeHeader(header)
+
 	t.Logger.Debug(fmt.Sprintf("Processing file %s -> %s of type %d",
 		file, header.Name, header.Typeflag))
 
+	// The sub-second precision of the mtime of the filesystem is
+	// stored only by the PAX format.
+	format := t.getWriterFormat()
+	if format == tar.FormatUSTAR || format == tar.FormatGNU {
+		header.ModTime = header.ModTime.Truncate(time.Second)
+	}
+
+	err = t.convertHeader(header)
+	if err != nil {
+		return err
+	}
+
+	if t.TaskWriter.Sparse && t.canWriteSparse() &&
+		header.Typeflag == tar.TypeReg && header.Size > 0 {
+		done, err := t.injectSparseFile(tw, file, header)
+		if err != nil || done {
+			return err
+		}
+	}
+
+	err = t.beginEntry(tw)
+	if err != nil {
+		return err
+	}
+
 	err = tw.WriteHeader(header)
 	if err != nil {
 		return fmt.Errorf(
@@ -159,6 +235,12 @@ func (t *TarFormers) InjectFile2Writer(tw *tar.Writer,
 		))
 		return nil
 
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		// The content of devices and fifo must not be read.
+		t.Logger.Debug(fmt.Sprintf("Injecting special file %s (%d, %d)",
+			header.Name, header.Devmajor, header.Devminor,
+		))
+		return nil
 	}
 
 	f, err := os.Open(file)
@@ -178,6 +260,24 @@ func (t *TarFormers) InjectFile2Writer(tw *tar.Writer,
 	return nil
 }
 
+// beginEntry writes the padding of the previous entry and notifies
+// the compression writer of the beginning of a new entry.
+func (t *TarFormers) beginEntry(tw *tar.Writer) error {
+	err := tw.Flush()
+	if err != nil {
+		return err
+	}
+
+	if ew, ok := t.writer.(tools.EntryWriter); ok {
+		err = ew.BeginEntry()
+		if err != nil {
+			return fmt.Errorf("Error on begin entry: %s", err.Error())
+		}
+	}
+
+	return nil
+}
+
 func (t *TarFormers) InjectDir2Writer(tw *tar.Writer,
 	dir string,
 	iMap *map[inodeResource]string) error {
@@ -0,0 +1,160 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package executor_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+
+	. "github.com/geaaru/tar-formers/pkg/executor"
+	specs "github.com/geaaru/tar-formers/pkg/specs"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"golang.org/x/sys/unix"
+)
+
+// archiveTestDir creates the tarball of the directory dir.
+func archiveTestDir(dir, socketsPolicy string) (*bytes.Buffer, error) {
+	s := specs.NewSpecFile()
+	s.Writer = specs.NewWriter()
+	s.Writer.ArchiveDirs = []string{dir}
+	s.Writer.Sockets = socketsPolicy
+
+	buf := bytes.NewBuffer(nil)
+	t := NewTarFormers(specs.NewConfig(nil))
+	t.SetWriter(buf)
+
+	return buf, t.RunTaskWriter(s)
+}
+
+// readTestTarball returns the headers of the tarball.
+func readTestTarball(buf *bytes.Buffer) map[string]*tar.Header {
+	ans := make(map[string]*tar.Header, 0)
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		Expect(err).ToNot(HaveOccurred())
+		ans[filepath.Base(h.Name)] = h
+	}
+	return ans
+}
+
+var _ = Describe("Writer", func() {
+
+	Context("Special files", func() {
+		var src, dst string
+		var listener net.Listener
+
+		BeforeEach(func() {
+			if os.Geteuid() != 0 {
+				Skip("The creation of the device files requires root.")
+			}
+
+			tmpdir := GinkgoT().TempDir()
+			src = filepath.Join(tmpdir, "src")
+			dst = filepath.Join(tmpdir, "dst")
+			Expect(os.MkdirAll(src, 0755)).To(Succeed())
+
+			Expect(unix.Mkfifo(filepath.Join(src, "fifo"), 0640)).To(Succeed())
+			Expect(unix.Mknod(filepath.Join(src, "char"), unix.S_IFCHR|0620,
+				int(unix.Mkdev(1, 3)))).To(Succeed())
+			Expect(unix.Mknod(filepath.Join(src, "block"), unix.S_IFBLK|0600,
+				int(unix.Mkdev(7, 42)))).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(src, "file"),
+				[]byte("data"), 0644)).To(Succeed())
+
+			var err error
+			listener, err = net.Listen("unix", filepath.Join(src, "socket"))
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			if listener != nil {
+				listener.Close()
+				listener = nil
+			}
+		})
+
+		It("archives and extracts every special file and skips sockets", func() {
+			buf, err := archiveTestDir(src, specs.SocketsSkip)
+			Expect(err).ToNot(HaveOccurred())
+
+			headers := readTestTarball(buf)
+			Expect(headers).ToNot(HaveKey("socket"))
+			Expect(headers).To(HaveKey("file"))
+			Expect(headers["fifo"].Typeflag).To(Equal(byte(tar.TypeFifo)))
+			Expect(headers["char"].Typeflag).To(Equal(byte(tar.TypeChar)))
+			Expect(headers["block"].Typeflag).To(Equal(byte(tar.TypeBlock)))
+			Expect(headers["block"].Devmajor).To(Equal(int64(7)))
+			Expect(headers["block"].Devminor).To(Equal(int64(42)))
+
+			s := specs.NewSpecFile()
+			Expect(extractTestTarball(s, buf, dst)).To(Succeed())
+
+			out := filepath.Join(dst, src)
+
+			var st unix.Stat_t
+			Expect(unix.Lstat(filepath.Join(out, "fifo"), &st)).To(Succeed())
+			Expect(st.Mode & unix.S_IFMT).To(Equal(uint32(unix.S_IFIFO)))
+			Expect(st.Mode & 07777).To(Equal(uint32(0640)))
+
+			Expect(unix.Lstat(filepath.Join(out, "char"), &st)).To(Succeed())
+			Expect(st.Mode & unix.S_IFMT).To(Equal(uint32(unix.S_IFCHR)))
+			Expect(unix.Major(st.Rdev)).To(Equal(uint32(1)))
+			Expect(unix.Minor(st.Rdev)).To(Equal(uint32(3)))
+
+			Expect(unix.Lstat(filepath.Join(out, "block"), &st)).To(Succeed())
+			Expect(st.Mode & unix.S_IFMT).To(Equal(uint32(unix.S_IFBLK)))
+			Expect(unix.Major(st.Rdev)).To(Equal(uint32(7)))
+			Expect(unix.Minor(st.Rdev)).To(Equal(uint32(42)))
+
+			_, err = os.Lstat(filepath.Join(out, "socket"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+
+			data, err := os.ReadFile(filepath.Join(out, "file"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(Equal("data"))
+		})
+
+		It("replaces the existing special files on extract", func() {
+			buf, err := archiveTestDir(src, specs.SocketsSkip)
+			Expect(err).ToNot(HaveOccurred())
+
+			s := specs.NewSpecFile()
+			Expect(extractTestTarball(s, bytes.NewBuffer(buf.Bytes()), dst)).To(Succeed())
+			Expect(extractTestTarball(s, buf, dst)).To(Succeed())
+
+			var st unix.Stat_t
+			Expect(unix.Lstat(filepath.Join(dst, src, "block"), &st)).To(Succeed())
+			Expect(st.Mode & unix.S_IFMT).To(Equal(uint32(unix.S_IFBLK)))
+		})
+
+		It("fails on sockets with the fail policy", func() {
+			_, err := archiveTestDir(src, specs.SocketsFail)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("socket"))
+		})
+	})
+})
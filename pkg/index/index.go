@@ -0,0 +1,262 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package index
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	specs "github.com/geaaru/tar-formers/pkg/specs"
+	"github.com/geaaru/tar-formers/pkg/tools"
+)
+
+const (
+	// Version of the format of the index.
+	IndexVersion = 2
+	// Suffix of the sidecar file of the index.
+	IndexFileSuffix = ".index.json"
+
+	blockSize = 512
+)
+
+// Index contains the offsets of the entries of a tarball. The offsets
+// are relative to the uncompressed tar stream.
+type Index struct {
+	Version int `json:"version"`
+	// Compression of the tarball: none and zstd-seekable are
+	// readable with random access.
+	Compression tools.CompressionMode `json:"compression"`
+	// Size and modification time of the tarball file used to check
+	// that the index matches the tarball.
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Entries []*Entry  `json:"entries"`
+
+	names map[string]int
+}
+
+// Entry describes an entry of the tarball.
+type Entry struct {
+	Name     string    `json:"name"`
+	Typeflag byte      `json:"typeflag"`
+	Linkname string    `json:"linkname,omitempty"`
+	Size     int64     `json:"size"`
+	Mode     int64     `json:"mode"`
+	Uid      int       `json:"uid"`
+	Gid      int       `json:"gid"`
+	Uname    string    `json:"uname,omitempty"`
+	Gname    string    `json:"gname,omitempty"`
+	ModTime  time.Time `json:"mtime"`
+	// The data of the sparse files aren't contiguous.
+	Sparse bool `json:"sparse,omitempty"`
+
+	// Offset of the first header of the entry (including the PAX
+	// and GNU headers).
+	HeaderOffset int64 `json:"header_offset"`
+	// Offset of the data of the entry.
+	DataOffset int64 `json:"data_offset"`
+	// Offset of the end of the entry including the padding.
+	EndOffset int64 `json:"end_offset"`
+}
+
+func NewIndex() *Index {
+	return &Index{
+		Version:     IndexVersion,
+		Compression: tools.None,
+		Entries:     []*Entry{},
+		names:       make(map[string]int),
+	}
+}
+
+// GetIndexFile returns the path of the sidecar file of the index
+// of the tarball.
+func GetIndexFile(tarball string) string {
+	return tarball + IndexFileSuffix
+}
+
+// CleanName returns the absolute path of the name of an entry used
+// to search the entries (for example ./etc/ is /etc).
+func CleanName(name string) string {
+	return path.Clean("/" + name)
+}
+
+func blockAlign(n int64) int64 {
+	return (n + blockSize - 1) / blockSize * blockSize
+}
+
+// Add adds an entry to the index. An entry with the same name of an
+// entry already present replaces the previous entry on lookup.
+func (i *Index) Add(e *Entry) {
+	i.Entries = append(i.Entries, e)
+	if e.Typeflag != tar.TypeXGlobalHeader {
+		i.names[CleanName(e.Name)] = len(i.Entries) - 1
+	}
+}
+
+// Get returns the entry with the name in input or nil.
+func (i *Index) Get(name string) *Entry {
+	if pos, ok := i.names[CleanName(name)]; ok {
+		return i.Entries[pos]
+	}
+	return nil
+}
+
+// IsSeekable returns true if the tarball could be read with random
+// access.
+func (i *Index) IsSeekable() bool {
+	return i.Compression == tools.None || i.Compression == tools.ZstdSeekable
+}
+
+// Build reads the uncompressed tar stream and returns the index of
+// the entries.
+func Build(r io.Reader) (*Index, error) {
+	ans := NewIndex()
+
+	counter := tools.NewCountingReader(r)
+	tarReader := tar.NewReader(counter)
+
+	for {
+		offset := blockAlign(counter.Count())
+
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error on read tar header: %s", err.Error())
+		}
+
+		e := &Entry{
+			Name:         header.Name,
+			Typeflag:     header.Typeflag,
+			Linkname:     header.Linkname,
+			Size:         header.Size,
+			Mode:         header.Mode,
+			Uid:          header.Uid,
+			Gid:          header.Gid,
+			Uname:        header.Uname,
+			Gname:        header.Gname,
+			ModTime:      header.ModTime,
+			Sparse:       specs.IsSparseHeader(header),
+			HeaderOffset: offset,
+			DataOffset:   counter.Count(),
+		}
+
+		// The data of the sparse files are read with the holes
+		// inflated to reach the end of the entry.
+		_, err = io.Copy(io.Discard, tarReader)
+		if err != nil {
+			return nil, fmt.Errorf("Error on read data of the entry %s: %s",
+				header.Name, err.Error())
+		}
+		e.EndOffset = blockAlign(counter.Count())
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			// The records are already read by Next().
+			e.DataOffset = e.EndOffset - blockAlign(header.Size)
+		}
+
+		ans.Add(e)
+	}
+
+	return ans, nil
+}
+
+// BuildFile returns the index of the tarball. The compression is
+// detected from the content of the file.
+func BuildFile(tarball string) (*Index, error) {
+	stat, err := os.Stat(tarball)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := tools.NewTarReaderCompressionOpts(true)
+	err = tools.PrepareTarReader(tarball, opts)
+	if err != nil {
+		return nil, fmt.Errorf("Error on prepare reader: %s", err.Error())
+	}
+	defer opts.Close()
+
+	reader := opts.FileReader
+	if opts.CompressReader != nil {
+		reader = opts.CompressReader
+	}
+
+	ans, err := Build(reader)
+	if err != nil {
+		return nil, err
+	}
+	ans.Size = stat.Size()
+	ans.ModTime = stat.ModTime()
+	ans.Compression = opts.Mode
+
+	if opts.Mode == tools.Zstd {
+		f, err := os.Open(tarball)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		_, err = tools.ReadZstdSeekTable(f, stat.Size())
+		if err == nil {
+			ans.Compression = tools.ZstdSeekable
+		}
+	}
+
+	return ans, nil
+}
+
+// LoadIndex reads the index from the file.
+func LoadIndex(file string) (*Index, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	ans := NewIndex()
+	err = json.Unmarshal(data, ans)
+	if err != nil {
+		return nil, fmt.Errorf("Error on parse index %s: %s", file, err.Error())
+	}
+
+	if ans.Version != IndexVersion {
+		return nil, fmt.Errorf("Unsupported version %d of the index %s",
+			ans.Version, file)
+	}
+
+	entries := ans.Entries
+	ans.Entries = []*Entry{}
+	for _, e := range entries {
+		ans.Add(e)
+	}
+
+	return ans, nil
+}
+
+// WriteFile writes the index in JSON format.
+func (i *Index) WriteFile(file string) error {
+	data, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(file, data, 0644)
+}
@@ -0,0 +1,86 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package index_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestIndex(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Index Suite")
+}
+
+type testEntry struct {
+	Header  tar.Header
+	Content string
+}
+
+var longTestName = "usr/share/" + strings.Repeat("long-directory/", 10) + "file"
+
+// testEntries contains the entries of the tarball of the tests: a
+// PAX global header, a name longer than 100 chars and a file present
+// two times.
+var testEntries = []testEntry{
+	{Header: tar.Header{
+		Typeflag:   tar.TypeXGlobalHeader,
+		PAXRecords: map[string]string{"comment": "tar-formers"},
+	}},
+	{Header: tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}},
+	{
+		Header:  tar.Header{Name: "etc/os-release", Typeflag: tar.TypeReg, Mode: 0644},
+		Content: "NAME=first\n",
+	},
+	{
+		Header:  tar.Header{Name: longTestName, Typeflag: tar.TypeReg, Mode: 0644},
+		Content: strings.Repeat("x", 1500),
+	},
+	{Header: tar.Header{
+		Name: "etc/link", Typeflag: tar.TypeSymlink, Linkname: "os-release",
+	}},
+	{
+		Header:  tar.Header{Name: "./etc/os-release", Typeflag: tar.TypeReg, Mode: 0644},
+		Content: "NAME=second\n",
+	},
+	{
+		Header:  tar.Header{Name: "bin/sh", Typeflag: tar.TypeReg, Mode: 0755},
+		Content: "#!/bin/sh\n",
+	},
+}
+
+// newTestTarball returns the tarball with the entries.
+func newTestTarball(entries []testEntry) []byte {
+	buf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		h := e.Header
+		h.Size = int64(len(e.Content))
+		Expect(tw.WriteHeader(&h)).To(Succeed())
+		if e.Content != "" {
+			_, err := tw.Write([]byte(e.Content))
+			Expect(err).ToNot(HaveOccurred())
+		}
+	}
+	Expect(tw.Close()).To(Succeed())
+	return buf.Bytes()
+}
@@ -0,0 +1,305 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package index_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	index "github.com/geaaru/tar-formers/pkg/index"
+	"github.com/geaaru/tar-formers/pkg/tools"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// readEntry returns the content of the entry with the name.
+func readEntry(r *index.Reader, name string) string {
+	_, reader, err := r.Open(name)
+	Expect(err).ToNot(HaveOccurred())
+	data, err := io.ReadAll(reader)
+	Expect(err).ToNot(HaveOccurred())
+	return string(data)
+}
+
+var _ = Describe("Index", func() {
+
+	Context("Build", func() {
+		var data []byte
+		var idx *index.Index
+
+		BeforeEach(func() {
+			var err error
+			data = newTestTarball(testEntries)
+			idx, err = index.Build(bytes.NewReader(data))
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("indexes all the entries", func() {
+			Expect(idx.Entries).To(HaveLen(len(testEntries)))
+			Expect(idx.Entries[0].HeaderOffset).To(BeZero())
+
+			for i, e := range idx.Entries {
+				Expect(e.HeaderOffset%512).To(BeZero(), e.Name)
+				Expect(e.DataOffset%512).To(BeZero(), e.Name)
+				Expect(e.DataOffset).To(BeNumerically(">", e.HeaderOffset), e.Name)
+				if e.Typeflag != tar.TypeXGlobalHeader {
+					Expect(e.EndOffset-e.DataOffset).To(Equal((e.Size+511)/512*512), e.Name)
+				}
+				if i > 0 {
+					Expect(e.HeaderOffset).To(Equal(idx.Entries[i-1].EndOffset), e.Name)
+				}
+			}
+
+			// The end of the archive.
+			last := idx.Entries[len(idx.Entries)-1]
+			Expect(int64(len(data)) - last.EndOffset).To(BeNumerically(">=", 1024))
+		})
+
+		It("returns the last entry with the same name", func() {
+			for _, name := range []string{"etc/os-release", "./etc/os-release", "/etc/os-release"} {
+				e := idx.Get(name)
+				Expect(e).ToNot(BeNil(), name)
+				Expect(e.Name).To(Equal("./etc/os-release"))
+			}
+
+			Expect(idx.Get("etc").Typeflag).To(Equal(byte(tar.TypeDir)))
+			Expect(idx.Get(longTestName).Size).To(Equal(int64(1500)))
+			Expect(idx.Get("missing")).To(BeNil())
+		})
+
+		It("fails on a truncated tarball", func() {
+			_, err := index.Build(bytes.NewReader(data[:2000]))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("Reader", func() {
+		var tarball string
+		var r *index.Reader
+
+		BeforeEach(func() {
+			tarball = filepath.Join(GinkgoT().TempDir(), "test.tar")
+			Expect(os.WriteFile(tarball, newTestTarball(testEntries), 0644)).To(Succeed())
+
+			idx, err := index.BuildFile(tarball)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(idx.Compression).To(Equal(tools.None))
+			Expect(idx.WriteFile(index.GetIndexFile(tarball))).To(Succeed())
+
+			r, err = index.OpenFile(tarball)
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(r.Close)
+		})
+
+		It("reads the entries", func() {
+			Expect(readEntry(r, "etc/os-release")).To(Equal("NAME=second\n"))
+			Expect(readEntry(r, longTestName)).To(Equal(strings.Repeat("x", 1500)))
+			Expect(readEntry(r, "/bin/sh")).To(Equal("#!/bin/sh\n"))
+
+			header, _, err := r.Open("etc/link")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(header.Typeflag).To(Equal(byte(tar.TypeSymlink)))
+			Expect(header.Linkname).To(Equal("os-release"))
+
+			_, _, err = r.Open("missing")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("reads the data with random access", func() {
+			sr, err := r.OpenData(r.Index.Get(longTestName))
+			Expect(err).ToNot(HaveOccurred())
+
+			p := make([]byte, 10)
+			n, err := sr.ReadAt(p, 1495)
+			Expect(err).To(Equal(io.EOF))
+			Expect(string(p[:n])).To(Equal("xxxxx"))
+
+			_, err = r.OpenData(r.Index.Get("etc/link"))
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("returns the tar stream of the selected entries", func() {
+			tr := tar.NewReader(r.NewFilteredReader(func(e *index.Entry) bool {
+				return strings.HasPrefix(index.CleanName(e.Name), "/etc/")
+			}))
+
+			// The global header is always kept.
+			h, err := tr.Next()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(h.Typeflag).To(Equal(byte(tar.TypeXGlobalHeader)))
+			Expect(h.PAXRecords).To(HaveKeyWithValue("comment", "tar-formers"))
+
+			names := []string{}
+			contents := map[string]string{}
+			for {
+				h, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				Expect(err).ToNot(HaveOccurred())
+				names = append(names, h.Name)
+
+				data, err := io.ReadAll(tr)
+				Expect(err).ToNot(HaveOccurred())
+				contents[h.Name] = string(data)
+			}
+
+			Expect(names).To(Equal([]string{
+				"etc/os-release", "etc/link", "./etc/os-release",
+			}))
+			Expect(contents["./etc/os-release"]).To(Equal("NAME=second\n"))
+		})
+
+		It("loads the index from the file", func() {
+			idx, err := index.LoadIndex(index.GetIndexFile(tarball))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(idx.Entries).To(HaveLen(len(r.Index.Entries)))
+			Expect(idx.ModTime.Equal(r.Index.ModTime)).To(BeTrue())
+			for i, e := range idx.Entries {
+				Expect(e.Name).To(Equal(r.Index.Entries[i].Name))
+				Expect(e.HeaderOffset).To(Equal(r.Index.Entries[i].HeaderOffset))
+				Expect(e.DataOffset).To(Equal(r.Index.Entries[i].DataOffset))
+				Expect(e.EndOffset).To(Equal(r.Index.Entries[i].EndOffset))
+			}
+			Expect(idx.Get("etc/os-release").Name).To(Equal("./etc/os-release"))
+		})
+
+		It("rejects the index of another version", func() {
+			file := filepath.Join(GinkgoT().TempDir(), "old.index.json")
+			Expect(os.WriteFile(file,
+				[]byte(`{"version": 1, "entries": []}`), 0644)).To(Succeed())
+
+			_, err := index.LoadIndex(file)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("rejects the index of a tarball rewritten with the same size", func() {
+			entries := append([]testEntry{}, testEntries...)
+			entries[len(entries)-1] = testEntry{
+				Header:  tar.Header{Name: "bin/ls", Typeflag: tar.TypeReg, Mode: 0755},
+				Content: "#!/bin/ls\n",
+			}
+			data := newTestTarball(entries)
+			info, err := os.Stat(tarball)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(int64(len(data))).To(Equal(info.Size()))
+
+			Expect(os.WriteFile(tarball, data, 0644)).To(Succeed())
+			mtime := info.ModTime().Add(time.Second)
+			Expect(os.Chtimes(tarball, mtime, mtime)).To(Succeed())
+
+			_, err = index.OpenFile(tarball)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("doesn't match"))
+		})
+	})
+
+	Context("Compression", func() {
+		var dir string
+
+		BeforeEach(func() {
+			dir = GinkgoT().TempDir()
+		})
+
+		It("reads the tarball compressed with zstd-seekable", func() {
+			tarball := filepath.Join(dir, "test.tar.zst")
+			f, err := os.Create(tarball)
+			Expect(err).ToNot(HaveOccurred())
+
+			zw, err := tools.NewZstdSeekableWriter(f, 1024)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = zw.Write(newTestTarball(testEntries))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(zw.Close()).To(Succeed())
+			Expect(f.Close()).To(Succeed())
+
+			idx, err := index.BuildFile(tarball)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(idx.Compression).To(Equal(tools.ZstdSeekable))
+
+			r, err := index.Open(tarball, idx)
+			Expect(err).ToNot(HaveOccurred())
+			defer r.Close()
+
+			Expect(readEntry(r, "etc/os-release")).To(Equal("NAME=second\n"))
+			Expect(readEntry(r, longTestName)).To(Equal(strings.Repeat("x", 1500)))
+		})
+
+		It("rejects the random access of the tarball compressed with gzip", func() {
+			tarball := filepath.Join(dir, "test.tar.gz")
+			buf := bytes.NewBuffer(nil)
+			gw := gzip.NewWriter(buf)
+			_, err := gw.Write(newTestTarball(testEntries))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(gw.Close()).To(Succeed())
+			Expect(os.WriteFile(tarball, buf.Bytes(), 0644)).To(Succeed())
+
+			idx, err := index.BuildFile(tarball)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(idx.Compression).To(Equal(tools.Gzip))
+			Expect(idx.IsSeekable()).To(BeFalse())
+			Expect(idx.Get("etc/os-release")).ToNot(BeNil())
+
+			_, err = index.Open(tarball, idx)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("marks the sparse files", func() {
+			if _, err := exec.LookPath("tar"); err != nil {
+				Skip("GNU tar not available.")
+			}
+
+			src := filepath.Join(dir, "src")
+			Expect(os.MkdirAll(src, 0755)).To(Succeed())
+			f, err := os.Create(filepath.Join(src, "sparse"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(f.Truncate(1 << 20)).To(Succeed())
+			_, err = f.WriteAt([]byte("data"), 512<<10)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(f.Close()).To(Succeed())
+
+			tarball := filepath.Join(dir, "sparse.tar")
+			output, err := exec.Command("tar", "-S", "--format=posix",
+				"-cf", tarball, "-C", src, "sparse").CombinedOutput()
+			Expect(err).ToNot(HaveOccurred(), string(output))
+
+			idx, err := index.BuildFile(tarball)
+			Expect(err).ToNot(HaveOccurred())
+			e := idx.Get("sparse")
+			Expect(e).ToNot(BeNil())
+			Expect(e.Sparse).To(BeTrue())
+
+			r, err := index.Open(tarball, idx)
+			Expect(err).ToNot(HaveOccurred())
+			defer r.Close()
+
+			_, err = r.OpenData(e)
+			Expect(err).To(HaveOccurred())
+
+			content := readEntry(r, "sparse")
+			Expect(content).To(HaveLen(1 << 20))
+			Expect(content[512<<10 : 512<<10+4]).To(Equal("data"))
+		})
+	})
+})
@@ -0,0 +1,169 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package index
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/geaaru/tar-formers/pkg/tools"
+)
+
+// Reader reads the entries of an indexed tarball with random access.
+type Reader struct {
+	Index *Index
+
+	file *os.File
+	zstd *tools.ZstdSeekableReader
+	ra   io.ReaderAt
+	size int64
+}
+
+// Open opens the tarball described by the index. The tarball must be
+// uncompressed or compressed with zstd-seekable.
+func Open(tarball string, idx *Index) (*Reader, error) {
+	if !idx.IsSeekable() {
+		return nil, fmt.Errorf("Random access not supported for the %s compression",
+			idx.Compression)
+	}
+
+	f, err := os.Open(tarball)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if stat.Size() != idx.Size || !stat.ModTime().Equal(idx.ModTime) {
+		f.Close()
+		return nil, fmt.Errorf("The index doesn't match the tarball %s", tarball)
+	}
+
+	ans := &Reader{
+		Index: idx,
+		file:  f,
+		ra:    f,
+		size:  stat.Size(),
+	}
+
+	if idx.Compression == tools.ZstdSeekable {
+		z, err := tools.NewZstdSeekableReader(f, stat.Size())
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("Error on read seek table of %s: %s",
+				tarball, err.Error())
+		}
+		ans.zstd = z
+		ans.ra = z
+		ans.size = z.Size()
+	}
+
+	return ans, nil
+}
+
+// OpenFile opens the tarball with the index of the sidecar file.
+func OpenFile(tarball string) (*Reader, error) {
+	idx, err := LoadIndex(GetIndexFile(tarball))
+	if err != nil {
+		return nil, err
+	}
+
+	return Open(tarball, idx)
+}
+
+func (r *Reader) Close() error {
+	if r.zstd != nil {
+		r.zstd.Close()
+	}
+	return r.file.Close()
+}
+
+// section returns the reader of the uncompressed tar stream
+// from the offset to the end of the stream.
+func (r *Reader) section(offset int64) *io.SectionReader {
+	return io.NewSectionReader(r.ra, offset, r.size-offset)
+}
+
+// OpenEntry returns the header and the reader of the data of the
+// entry. Only the headers and the data of the entry are read.
+func (r *Reader) OpenEntry(e *Entry) (*tar.Header, io.Reader, error) {
+	tarReader := tar.NewReader(r.section(e.HeaderOffset))
+
+	header, err := tarReader.Next()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error on read header of %s: %s",
+			e.Name, err.Error())
+	}
+
+	if header.Name != e.Name {
+		return nil, nil, fmt.Errorf("The index doesn't match the entry %s", e.Name)
+	}
+
+	return header, tarReader, nil
+}
+
+// OpenData returns the reader with random access of the data of a
+// regular file. The data of the sparse files aren't contiguous and
+// then they must be read with OpenEntry.
+func (r *Reader) OpenData(e *Entry) (*io.SectionReader, error) {
+	if e.Sparse {
+		return nil, fmt.Errorf("Random access not supported for the sparse file %s",
+			e.Name)
+	}
+	if e.Typeflag != tar.TypeReg && e.Typeflag != tar.TypeRegA {
+		return nil, fmt.Errorf("The entry %s isn't a regular file", e.Name)
+	}
+
+	return io.NewSectionReader(r.ra, e.DataOffset, e.Size), nil
+}
+
+// Open returns the header and the reader of the data of the entry
+// with the name in input.
+func (r *Reader) Open(name string) (*tar.Header, io.Reader, error) {
+	e := r.Index.Get(name)
+	if e == nil {
+		return nil, nil, fmt.Errorf("Entry %s not found", name)
+	}
+
+	return r.OpenEntry(e)
+}
+
+// NewFilteredReader returns a tar stream with only the entries
+// selected by the filter. The PAX global headers are always present.
+func (r *Reader) NewFilteredReader(filter func(e *Entry) bool) io.Reader {
+	readers := []io.Reader{}
+
+	for _, e := range r.Index.Entries {
+		if e.Typeflag != tar.TypeXGlobalHeader && !filter(e) {
+			continue
+		}
+		readers = append(readers,
+			io.NewSectionReader(r.ra, e.HeaderOffset, e.EndOffset-e.HeaderOffset))
+	}
+
+	// End of the archive.
+	readers = append(readers, bytes.NewReader(make([]byte, 2*blockSize)))
+
+	return io.MultiReader(readers...)
+}
@@ -32,6 +32,8 @@ type Config struct {
 
 	General CGeneral `mapstructure:"general" json:"general,omitempty" yaml:"general,omitempty"`
 	Logging CLogging `mapstructure:"logging" json:"logging,omitempty" yaml:"logging,omitempty"`
+
+	Compression CompressionRules `mapstructure:"compression" json:"compression,omitempty" yaml:"compression,omitempty"`
 }
 
 type CGeneral struct {
@@ -72,6 +74,10 @@ func (c *Config) GetLogging() *CLogging {
 	return &c.Logging
 }
 
+func (c *Config) GetCompression() *CompressionRules {
+	return &c.Compression
+}
+
 func (c *Config) Unmarshal() error {
 	c.Viper.ReadInConfig()
 
@@ -93,6 +99,11 @@ func GenDefault(viper *v.Viper) {
 	viper.SetDefault("logging.json_format", false)
 	viper.SetDefault("logging.enable_emoji", true)
 	viper.SetDefault("logging.color", true)
+
+	viper.SetDefault("compression.level", 0)
+	viper.SetDefault("compression.workers", 0)
+	viper.SetDefault("compression.window_size", 0)
+	viper.SetDefault("compression.block_size", 0)
 }
 
 func (g *CGeneral) HasDebug() bool {
@@ -23,6 +23,64 @@ import (
 	"time"
 )
 
+const (
+	// Skip the sockets with a warning.
+	SocketsSkip = "skip"
+	// Abort the archiving on sockets.
+	SocketsFail = "fail"
+)
+
+const (
+	// Write the headers in USTAR format.
+	FormatUstar = "ustar"
+	// Write the headers in PAX format.
+	FormatPax = "pax"
+	// Write the headers in GNU format.
+	FormatGnu = "gnu"
+)
+
+// Env variable with the source date epoch of the reproducible builds.
+const SourceDateEpochEnv = "SOURCE_DATE_EPOCH"
+
+const (
+	// Extract the whiteouts as normal files.
+	WhiteoutsKeep = "keep"
+	// Remove the paths referenced by the whiteouts.
+	WhiteoutsApply = "apply"
+	// Convert the whiteouts in the overlayfs format.
+	WhiteoutsOverlay = "overlay"
+)
+
+const (
+	// Abort the extraction on unsafe entries.
+	UnsafeEntriesReject = "reject"
+	// Skip the unsafe entries.
+	UnsafeEntriesSkip = "skip"
+)
+
+const (
+	// Overwrite the existing files.
+	OverwriteReplace = "replace"
+	// Keep the existing files.
+	OverwriteKeepExisting = "keep-existing"
+	// Keep the existing files with a modification time
+	// newer or equal to the entry.
+	OverwriteKeepNewer = "keep-newer"
+	// Overwrite the existing files only if the content is different.
+	OverwriteIfDifferent = "if-different"
+	// Abort the extraction on existing files.
+	OverwriteFail = "fail"
+)
+
+const (
+	// Actions of the journal entries.
+	JournalCreated  = "created"
+	JournalReplaced = "replaced"
+	JournalChmod    = "chmod"
+	JournalSkipped  = "skipped"
+	JournalRemoved  = "removed"
+)
+
 type SpecFile struct {
 	File string `yaml:"-" json:"-"`
 
@@ -56,8 +114,22 @@ type SpecFile struct {
 	EnableMutex      bool `yaml:"enable_mutex,omitempty" json:"enable_mutex,omitempty"`
 	OverwritePerms   bool `yaml:"overwrite_perms,omitempty" json:"overwrite_perms,omitempty"`
 
+	// Define the root directory with the etc/passwd and etc/group files
+	// used by map_entities. On extraction, if it's empty is used
+	// the extraction directory. On archiving, if it's empty is used /.
+	EntitiesRoot string `yaml:"entities_root,omitempty" json:"entities_root,omitempty"`
+
+	// Resolve all the paths inside the extraction directory and
+	// check the entries that try to write outside of it.
+	SecureExtraction bool `yaml:"secure_extraction,omitempty" json:"secure_extraction,omitempty"`
+	// Define how to manage the unsafe entries: reject|skip.
+	// Default is reject.
+	UnsafeEntries string `yaml:"unsafe_entries,omitempty" json:"unsafe_entries,omitempty"`
+
 	mapModifier   map[string]bool  `yaml:"-" json:"-"`
 	ignoreRegexes []*regexp.Regexp `yaml:"-" json:"-"`
+	remapUids     []IdRemapRule    `yaml:"-" json:"-"`
+	remapGids     []IdRemapRule    `yaml:"-" json:"-"`
 
 	// Parallel max open files.
 	MaxOpenFiles int64 `yaml:"max_openfiles,omitempty" json:"max_openfiles,omitempty"`
@@ -66,6 +138,52 @@ type SpecFile struct {
 	// Validate extract when the file is been closed.
 	Validate bool `yaml:"validate,omitempty" json:"validate,omitempty"`
 
+	// Define how to manage the OCI whiteouts (.wh.<name> and
+	// .wh..wh..opq): keep|apply|overlay. Default is keep.
+	Whiteouts string `yaml:"whiteouts,omitempty" json:"whiteouts,omitempty"`
+
+	// Manage sparse files. On archiving the holes are detected and
+	// the files are written as PAX sparse entries. On extraction
+	// the blocks of zeros are created as holes.
+	Sparse bool `yaml:"sparse,omitempty" json:"sparse,omitempty"`
+
+	// Extract the files in a staging directory and move them
+	// to the target directory only on success. On error all
+	// the files created or replaced are restored.
+	Atomic bool `yaml:"atomic,omitempty" json:"atomic,omitempty"`
+
+	// Collect the journal of all the changes done by the extraction.
+	Journal bool `yaml:"journal,omitempty" json:"journal,omitempty"`
+	// Define the file where write the journal at the end of the
+	// extraction. The journal is written in JSON format if the file
+	// has the .json extension, otherwise in YAML format.
+	JournalFile string `yaml:"journal_file,omitempty" json:"journal_file,omitempty"`
+
+	// Define the list of paths protected (CONFIG_PROTECT style). The
+	// existing files with a different content are not overwritten
+	// and the new files are written as ._cfgNNNN_<name>.
+	ProtectPaths []string `yaml:"protect_paths,omitempty" json:"protect_paths,omitempty"`
+	// Define the list of paths excluded by the protection
+	// (CONFIG_PROTECT_MASK style).
+	ProtectMask []string `yaml:"protect_mask,omitempty" json:"protect_mask,omitempty"`
+
+	// Define how to manage the existing files on extraction:
+	// replace|keep-existing|keep-newer|if-different|fail.
+	// Default is replace.
+	OverwritePolicy string `yaml:"overwrite_policy,omitempty" json:"overwrite_policy,omitempty"`
+	// Define the overwrite policy of specific path prefixes.
+	OverwritePolicies []OverwriteRule `yaml:"overwrite_policies,omitempty" json:"overwrite_policies,omitempty"`
+
+	// Define the namespaces of the extended attributes to restore
+	// on extraction. An empty list means all the attributes.
+	XattrsInclude []string `yaml:"xattrs_include,omitempty" json:"xattrs_include,omitempty"`
+	// Define the namespaces of the extended attributes to skip
+	// on extraction.
+	XattrsExclude []string `yaml:"xattrs_exclude,omitempty" json:"xattrs_exclude,omitempty"`
+
+	// Define the limits used to process untrusted streams.
+	Limits *Limits `yaml:"limits,omitempty" json:"limits,omitempty"`
+
 	// Writer specific section
 	Writer *WriterRules `yaml:"writer,omitempty" json:"writer,omitempty"`
 }
@@ -73,6 +191,74 @@ type SpecFile struct {
 type WriterRules struct {
 	ArchiveDirs  []string `yaml:"dirs,omitempty" json:"dirs,omitempty"`
 	ArchiveFiles []string `yaml:"files,omitempty" json:"files,omitempty"`
+
+	// Define how to manage the sockets that could not be archived:
+	// skip|fail. Default is skip with a warning.
+	Sockets string `yaml:"sockets,omitempty" json:"sockets,omitempty"`
+
+	// Define the format of the tar headers: ustar|pax|gnu. By default
+	// the format is selected for every header by the fields used.
+	Format string `yaml:"format,omitempty" json:"format,omitempty"`
+	// Drop the fields that can't be represented by the ustar and gnu
+	// formats (atime, ctime, sub-second mtime and PAX records)
+	// instead of fail.
+	DropUnsupported bool `yaml:"drop_unsupported,omitempty" json:"drop_unsupported,omitempty"`
+
+	// Define the namespaces of the extended attributes to archive
+	// (for example user, security or trusted.overlay). An empty list
+	// means all the attributes.
+	XattrsInclude []string `yaml:"xattrs_include,omitempty" json:"xattrs_include,omitempty"`
+	// Define the namespaces of the extended attributes to exclude.
+	XattrsExclude []string `yaml:"xattrs_exclude,omitempty" json:"xattrs_exclude,omitempty"`
+
+	// Write a reproducible tarball: the directories and files are
+	// archived in lexical order, the modification times are clamped
+	// to the source date epoch and the access and change times are
+	// dropped.
+	Reproducible bool `yaml:"reproducible,omitempty" json:"reproducible,omitempty"`
+	// Define the source date epoch used to clamp the modification
+	// times. A zero value means to use the SOURCE_DATE_EPOCH env variable.
+	SourceDateEpoch int64 `yaml:"source_date_epoch,omitempty" json:"source_date_epoch,omitempty"`
+
+	// Set the owner of all the entries to Uid/Gid and Uname/Gname.
+	NormalizeOwner bool   `yaml:"normalize_owner,omitempty" json:"normalize_owner,omitempty"`
+	Uid            int    `yaml:"uid,omitempty" json:"uid,omitempty"`
+	Gid            int    `yaml:"gid,omitempty" json:"gid,omitempty"`
+	Uname          string `yaml:"uname,omitempty" json:"uname,omitempty"`
+	Gname          string `yaml:"gname,omitempty" json:"gname,omitempty"`
+
+	// Set the permissions of the entries to 0755 for directories
+	// and executables and to 0644 for the other files.
+	CanonicalModes bool `yaml:"canonical_modes,omitempty" json:"canonical_modes,omitempty"`
+
+	// Define the tuning of the compression of the tarball.
+	Compression *CompressionRules `yaml:"compression,omitempty" json:"compression,omitempty"`
+}
+
+// CompressionRules define the tuning of the compression. A zero
+// value means to use the default of the compression algorithm.
+type CompressionRules struct {
+	// Compression level (for example 1-9 for gz, 1-22 for zstd).
+	// Not supported by the config file: the level is valid only for
+	// the compression of the tarball of the writer.
+	Level int `mapstructure:"level,omitempty" yaml:"level,omitempty" json:"level,omitempty"`
+	// Compression level of the modes (for example zstd: 19), used
+	// only for the tarballs compressed with the mode.
+	Levels map[string]int `mapstructure:"levels,omitempty" yaml:"levels,omitempty" json:"levels,omitempty"`
+	// Number of goroutines used for the compression.
+	Workers int `mapstructure:"workers,omitempty" yaml:"workers,omitempty" json:"workers,omitempty"`
+	// Window or dictionary size in bytes.
+	WindowSize int `mapstructure:"window_size,omitempty" yaml:"window_size,omitempty" json:"window_size,omitempty"`
+	// Size in bytes of the compressed blocks.
+	BlockSize int `mapstructure:"block_size,omitempty" yaml:"block_size,omitempty" json:"block_size,omitempty"`
+}
+
+// IdRemapRule define the remap of the range of ids [Start, End]
+// to the range that begins with Target.
+type IdRemapRule struct {
+	Start  int
+	End    int
+	Target int
 }
 
 type RenameRule struct {
@@ -80,6 +266,27 @@ type RenameRule struct {
 	Dest   string `yaml:"dest" json:"dest"`
 }
 
+// Limits of the tar stream. A zero value means no limit.
+type Limits struct {
+	// Max number of entries.
+	MaxEntries int64 `yaml:"max_entries,omitempty" json:"max_entries,omitempty"`
+	// Max size of a single file in bytes.
+	MaxFileSize int64 `yaml:"max_file_size,omitempty" json:"max_file_size,omitempty"`
+	// Max size of all the files in bytes.
+	MaxTotalSize int64 `yaml:"max_total_size,omitempty" json:"max_total_size,omitempty"`
+	// Max length of the path and of the link target of the entries.
+	MaxPathLength int64 `yaml:"max_path_length,omitempty" json:"max_path_length,omitempty"`
+	// Max number of elements of the path of the entries.
+	MaxPathDepth int64 `yaml:"max_path_depth,omitempty" json:"max_path_depth,omitempty"`
+	// Max ratio between the decompressed bytes and the compressed bytes.
+	MaxCompressionRatio int64 `yaml:"max_compression_ratio,omitempty" json:"max_compression_ratio,omitempty"`
+}
+
+type OverwriteRule struct {
+	Prefix string `yaml:"prefix" json:"prefix"`
+	Policy string `yaml:"policy" json:"policy"`
+}
+
 type FileMeta struct {
 	Uid   int    // User ID of owner
 	Gid   int    // Group ID of owner
@@ -94,6 +301,11 @@ type FileMeta struct {
 
 	Xattrs     map[string]string // extend attributes
 	PAXRecords map[string]string // PAX extend headers records
+
+	Acls           map[string]string // POSIX ACLs (access, default) in text format
+	SELinuxLabel   string            // SELinux label
+	Fflags         string            // File flags (nodump, immutable, etc.)
+	UnknownRecords map[string]string // PAX records not interpreted
 }
 
 type Link struct {
@@ -104,3 +316,26 @@ type Link struct {
 	Mode     os.FileMode
 	Meta     FileMeta
 }
+
+type Journal struct {
+	Dir     string          `yaml:"dir" json:"dir"`
+	Entries []*JournalEntry `yaml:"entries" json:"entries"`
+}
+
+type JournalEntry struct {
+	Path     string `yaml:"path" json:"path"`
+	Action   string `yaml:"action" json:"action"`
+	Type     string `yaml:"type,omitempty" json:"type,omitempty"`
+	Mode     string `yaml:"mode,omitempty" json:"mode,omitempty"`
+	Uid      int    `yaml:"uid" json:"uid"`
+	Gid      int    `yaml:"gid" json:"gid"`
+	Uname    string `yaml:"uname,omitempty" json:"uname,omitempty"`
+	Gname    string `yaml:"gname,omitempty" json:"gname,omitempty"`
+	Size     int64  `yaml:"size" json:"size"`
+	Sha256   string `yaml:"sha256,omitempty" json:"sha256,omitempty"`
+	Linkname string `yaml:"linkname,omitempty" json:"linkname,omitempty"`
+	Reason   string `yaml:"reason,omitempty" json:"reason,omitempty"`
+	// The entry is been restored by the rollback of the atomic
+	// extraction.
+	RolledBack bool `yaml:"rolled_back,omitempty" json:"rolled_back,omitempty"`
+}
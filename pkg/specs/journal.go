@@ -0,0 +1,123 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package specs
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+func NewJournal(dir string) *Journal {
+	return &Journal{
+		Dir:     dir,
+		Entries: []*JournalEntry{},
+	}
+}
+
+// NewJournalEntry creates a journal entry with the type, the mode,
+// the owner and the size of the header.
+func NewJournalEntry(path, action string, header *tar.Header) *JournalEntry {
+	ans := &JournalEntry{
+		Path:   path,
+		Action: action,
+	}
+
+	if header != nil {
+		ans.Type = GetJournalType(header.Typeflag)
+		ans.Mode = fmt.Sprintf("%04o", header.Mode&07777)
+		ans.Uid = header.Uid
+		ans.Gid = header.Gid
+		ans.Uname = header.Uname
+		ans.Gname = header.Gname
+
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+			ans.Size = header.Size
+		case tar.TypeSymlink, tar.TypeLink:
+			ans.Linkname = header.Linkname
+		}
+	}
+
+	return ans
+}
+
+func GetJournalType(typeflag byte) string {
+	switch typeflag {
+	case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+		return "file"
+	case tar.TypeDir:
+		return "dir"
+	case tar.TypeSymlink:
+		return "symlink"
+	case tar.TypeLink:
+		return "hardlink"
+	case tar.TypeChar:
+		return "char"
+	case tar.TypeBlock:
+		return "block"
+	case tar.TypeFifo:
+		return "fifo"
+	default:
+		return "unknown"
+	}
+}
+
+func (j *Journal) Add(e *JournalEntry) {
+	j.Entries = append(j.Entries, e)
+}
+
+// MarkRolledBack marks all the entries as restored by the rollback
+// of the atomic extraction.
+func (j *Journal) MarkRolledBack() {
+	for _, e := range j.Entries {
+		e.RolledBack = true
+	}
+}
+
+// GetPaths returns the list of the paths created or replaced.
+func (j *Journal) GetPaths() []string {
+	ans := []string{}
+	for _, e := range j.Entries {
+		if !e.RolledBack && (e.Action == JournalCreated || e.Action == JournalReplaced) {
+			ans = append(ans, e.Path)
+		}
+	}
+	return ans
+}
+
+// WriteFile writes the journal in JSON format if the file has the
+// .json extension, otherwise in YAML format.
+func (j *Journal) WriteFile(file string) error {
+	var data []byte
+	var err error
+
+	if filepath.Ext(file) == ".json" {
+		data, err = json.MarshalIndent(j, "", "  ")
+	} else {
+		data, err = yaml.Marshal(j)
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(file, data, 0644)
+}
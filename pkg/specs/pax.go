@@ -0,0 +1,111 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package specs
+
+import (
+	"archive/tar"
+	"strings"
+)
+
+const (
+	PaxXattrPrefix = "SCHILY.xattr."
+	PaxAclPrefix   = "SCHILY.acl."
+	PaxAclAccess   = "SCHILY.acl.access"
+	PaxAclDefault  = "SCHILY.acl.default"
+	PaxSELinux     = "RHT.security.selinux"
+	PaxFflags      = "SCHILY.fflags"
+
+	SELinuxXattr = "security.selinux"
+)
+
+// The PAX records already managed by archive/tar.
+var paxHeaderRecords = map[string]bool{
+	"path":                 true,
+	"linkpath":             true,
+	"size":                 true,
+	"uid":                  true,
+	"gid":                  true,
+	"uname":                true,
+	"gname":                true,
+	"mtime":                true,
+	"atime":                true,
+	"ctime":                true,
+	"charset":              true,
+	"comment":              true,
+	"hdrcharset":           true,
+	"SCHILY.devmajor":      true,
+	"SCHILY.devminor":      true,
+	"GNU.sparse.major":     true,
+	"GNU.sparse.minor":     true,
+	"GNU.sparse.name":      true,
+	"GNU.sparse.realsize":  true,
+	"GNU.sparse.size":      true,
+	"GNU.sparse.numblocks": true,
+	"GNU.sparse.offset":    true,
+	"GNU.sparse.numbytes":  true,
+	"GNU.sparse.map":       true,
+}
+
+// IsSparseHeader returns true if the header read by the tar reader
+// describes a sparse file (GNU old format or PAX format).
+func IsSparseHeader(header *tar.Header) bool {
+	if header.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	if len(header.PAXRecords) > 0 {
+		for _, k := range []string{
+			"GNU.sparse.major", "GNU.sparse.map", "GNU.sparse.size",
+		} {
+			if _, ok := header.PAXRecords[k]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parsePAXRecords interprets the PAX records of the header: the
+// extended attributes, the POSIX ACLs, the SELinux label and the
+// file flags. The unknown records are available for the callbacks.
+func (m *FileMeta) parsePAXRecords(records map[string]string) {
+	m.Acls = make(map[string]string, 0)
+	m.UnknownRecords = make(map[string]string, 0)
+
+	xattrs := make(map[string]string, 0)
+	for k, v := range m.Xattrs {
+		xattrs[k] = v
+	}
+
+	for k, v := range records {
+		switch {
+		case strings.HasPrefix(k, PaxXattrPrefix):
+			xattrs[strings.TrimPrefix(k, PaxXattrPrefix)] = v
+		case strings.HasPrefix(k, PaxAclPrefix):
+			m.Acls[strings.TrimPrefix(k, PaxAclPrefix)] = v
+		case k == PaxSELinux:
+			m.SELinuxLabel = v
+		case k == PaxFflags:
+			m.Fflags = v
+		default:
+			if _, ok := paxHeaderRecords[k]; !ok {
+				m.UnknownRecords[k] = v
+			}
+		}
+	}
+
+	m.Xattrs = xattrs
+}
@@ -0,0 +1,160 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package specs
+
+import (
+	"archive/tar"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ParseIdRemapRules parses the remap_uids/remap_gids maps. The keys
+// could be a single id (ex. 1000) or a range of ids (ex. 1000-1999).
+// The value is the id to use for the first id of the range.
+func ParseIdRemapRules(m map[string]string) ([]IdRemapRule, error) {
+	ans := []IdRemapRule{}
+
+	for k, v := range m {
+		var err error
+		r := IdRemapRule{}
+
+		k = strings.TrimSpace(k)
+		if strings.Contains(k, "-") {
+			ids := strings.SplitN(k, "-", 2)
+			r.Start, err = parseId(ids[0])
+			if err != nil {
+				return ans, fmt.Errorf("Invalid remap key %s: %s", k, err.Error())
+			}
+			r.End, err = parseId(ids[1])
+			if err != nil {
+				return ans, fmt.Errorf("Invalid remap key %s: %s", k, err.Error())
+			}
+			if r.End < r.Start {
+				return ans, fmt.Errorf("Invalid remap key %s: invalid range", k)
+			}
+		} else {
+			r.Start, err = parseId(k)
+			if err != nil {
+				return ans, fmt.Errorf("Invalid remap key %s: %s", k, err.Error())
+			}
+			r.End = r.Start
+		}
+
+		r.Target, err = parseId(v)
+		if err != nil {
+			return ans, fmt.Errorf("Invalid remap value %s for key %s: %s",
+				v, k, err.Error())
+		}
+
+		if int64(r.Target)+int64(r.End-r.Start) > math.MaxUint32 {
+			return ans, fmt.Errorf("Invalid remap %s: %s: target range overflow", k, v)
+		}
+
+		ans = append(ans, r)
+	}
+
+	sort.Slice(ans, func(i, j int) bool {
+		return ans[i].Start < ans[j].Start
+	})
+
+	// Check for overlapped ranges
+	for i := 1; i < len(ans); i++ {
+		if ans[i].Start <= ans[i-1].End {
+			return ans, fmt.Errorf("Overlapped remap ranges %d-%d and %d-%d",
+				ans[i-1].Start, ans[i-1].End, ans[i].Start, ans[i].End)
+		}
+	}
+
+	return ans, nil
+}
+
+func parseId(s string) (int, error) {
+	id, err := strconv.ParseUint(strings.TrimSpace(s), 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	return int(id), nil
+}
+
+func remapId(rules []IdRemapRule, id int) int {
+	for _, r := range rules {
+		if id < r.Start {
+			break
+		}
+		if id <= r.End {
+			return r.Target + (id - r.Start)
+		}
+	}
+	return id
+}
+
+func (s *SpecFile) prepareRemap() error {
+	var err error
+
+	s.remapUids, err = ParseIdRemapRules(s.RemapUids)
+	if err != nil {
+		return fmt.Errorf("Error on parse remap_uids: %s", err.Error())
+	}
+
+	s.remapGids, err = ParseIdRemapRules(s.RemapGids)
+	if err != nil {
+		return fmt.Errorf("Error on parse remap_gids: %s", err.Error())
+	}
+
+	return nil
+}
+
+func (s *SpecFile) HasRemap() bool {
+	return len(s.RemapUids) > 0 || len(s.RemapGids) > 0 ||
+		len(s.RemapUsers) > 0 || len(s.RemapGroups) > 0
+}
+
+func (s *SpecFile) RemapUid(uid int) int {
+	return remapId(s.remapUids, uid)
+}
+
+func (s *SpecFile) RemapGid(gid int) int {
+	return remapId(s.remapGids, gid)
+}
+
+func (s *SpecFile) RemapUser(user string) string {
+	if u, ok := s.RemapUsers[user]; ok && user != "" {
+		return u
+	}
+	return user
+}
+
+func (s *SpecFile) RemapGroup(group string) string {
+	if g, ok := s.RemapGroups[group]; ok && group != "" {
+		return g
+	}
+	return group
+}
+
+// RemapHeader applies the remap rules to the owner of the header.
+func (s *SpecFile) RemapHeader(header *tar.Header) {
+	if !s.HasRemap() {
+		return
+	}
+	header.Uid = s.RemapUid(header.Uid)
+	header.Gid = s.RemapGid(header.Gid)
+	header.Uname = s.RemapUser(header.Uname)
+	header.Gname = s.RemapGroup(header.Gname)
+}
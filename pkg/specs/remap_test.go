@@ -0,0 +1,123 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package specs_test
+
+import (
+	"archive/tar"
+
+	. "github.com/geaaru/tar-formers/pkg/specs"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Remap", func() {
+
+	DescribeTable("ParseIdRemapRules",
+		func(m map[string]string, expected []IdRemapRule) {
+			rules, err := ParseIdRemapRules(m)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rules).To(Equal(expected))
+		},
+		Entry("no rules", map[string]string{}, []IdRemapRule{}),
+		Entry("single id", map[string]string{"1000": "2000"},
+			[]IdRemapRule{{Start: 1000, End: 1000, Target: 2000}}),
+		Entry("range", map[string]string{" 1000-1999 ": " 100000"},
+			[]IdRemapRule{{Start: 1000, End: 1999, Target: 100000}}),
+		Entry("range of one id", map[string]string{"5-5": "6"},
+			[]IdRemapRule{{Start: 5, End: 5, Target: 6}}),
+		Entry("adjacent ranges sorted by start",
+			map[string]string{"100-199": "2000", "0-99": "1000", "200": "0"},
+			[]IdRemapRule{
+				{Start: 0, End: 99, Target: 1000},
+				{Start: 100, End: 199, Target: 2000},
+				{Start: 200, End: 200, Target: 0},
+			}),
+		Entry("target range at the max id",
+			map[string]string{"0-9": "4294967286"},
+			[]IdRemapRule{{Start: 0, End: 9, Target: 4294967286}}),
+	)
+
+	DescribeTable("ParseIdRemapRules errors",
+		func(m map[string]string, msg string) {
+			_, err := ParseIdRemapRules(m)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(msg))
+		},
+		Entry("invalid id", map[string]string{"abc": "1"}, "Invalid remap key abc"),
+		Entry("negative id", map[string]string{"-1": "1"}, "Invalid remap key -1"),
+		Entry("missing end of range", map[string]string{"1000-": "1"}, "Invalid remap key 1000-"),
+		Entry("inverted range", map[string]string{"2000-1000": "1"}, "invalid range"),
+		Entry("id over 32 bit", map[string]string{"4294967296": "1"}, "Invalid remap key"),
+		Entry("invalid value", map[string]string{"1000": "x"}, "Invalid remap value x"),
+		Entry("value over 32 bit", map[string]string{"1000": "4294967296"}, "Invalid remap value"),
+		Entry("target range overflow", map[string]string{"0-10": "4294967290"},
+			"target range overflow"),
+		Entry("overlapped ranges", map[string]string{"0-100": "1000", "100-200": "2000"},
+			"Overlapped remap ranges 0-100 and 100-200"),
+		Entry("id inside a range", map[string]string{"0-100": "1000", "50": "2000"},
+			"Overlapped remap ranges"),
+	)
+
+	DescribeTable("RemapHeader",
+		func(header, expected tar.Header) {
+			s := NewSpecFile()
+			s.RemapUids = map[string]string{"1000-1999": "100000", "0": "500"}
+			s.RemapGids = map[string]string{"100": "200"}
+			s.RemapUsers = map[string]string{"foo": "bar"}
+			s.RemapGroups = map[string]string{"users": "staff"}
+			Expect(s.Prepare()).To(Succeed())
+
+			s.RemapHeader(&header)
+			Expect(header).To(Equal(expected))
+		},
+		Entry("ids in the ranges",
+			tar.Header{Uid: 1500, Gid: 100},
+			tar.Header{Uid: 100500, Gid: 200}),
+		Entry("start and end of the range",
+			tar.Header{Uid: 1000, Gid: 0},
+			tar.Header{Uid: 100000, Gid: 0}),
+		Entry("single id",
+			tar.Header{Uid: 0, Gid: 101},
+			tar.Header{Uid: 500, Gid: 101}),
+		Entry("ids outside the ranges",
+			tar.Header{Uid: 2000, Gid: 99},
+			tar.Header{Uid: 2000, Gid: 99}),
+		Entry("names",
+			tar.Header{Uid: 2000, Uname: "foo", Gname: "users"},
+			tar.Header{Uid: 2000, Uname: "bar", Gname: "staff"}),
+		Entry("names without rules",
+			tar.Header{Uid: 2000, Uname: "root", Gname: "root"},
+			tar.Header{Uid: 2000, Uname: "root", Gname: "root"}),
+	)
+
+	It("doesn't change the header without rules", func() {
+		s := NewSpecFile()
+		Expect(s.Prepare()).To(Succeed())
+
+		header := tar.Header{Uid: 1000, Gid: 1000, Uname: "foo", Gname: "foo"}
+		s.RemapHeader(&header)
+		Expect(header).To(Equal(tar.Header{Uid: 1000, Gid: 1000, Uname: "foo", Gname: "foo"}))
+	})
+
+	It("rejects the invalid rules on prepare", func() {
+		s := NewSpecFile()
+		s.RemapGids = map[string]string{"0-10": "5", "10": "1"}
+		err := s.Prepare()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("remap_gids"))
+	})
+})
@@ -18,10 +18,15 @@ package specs
 
 import (
 	"archive/tar"
+	"fmt"
 	"io/fs"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -46,6 +51,9 @@ func NewSpecFile() *SpecFile {
 		EnableMutex:      false,
 		OverwritePerms:   false,
 		Validate:         false,
+		SecureExtraction: false,
+		UnsafeEntries:    UnsafeEntriesReject,
+		Whiteouts:        WhiteoutsKeep,
 
 		mapModifier:   make(map[string]bool, 0),
 		ignoreRegexes: []*regexp.Regexp{},
@@ -78,6 +86,129 @@ func (s *SpecFile) OverwritePerms2Dir() bool {
 	return s.OverwritePerms
 }
 
+func (s *SpecFile) GetUnsafeEntriesPolicy() string {
+	if s.UnsafeEntries == UnsafeEntriesSkip {
+		return UnsafeEntriesSkip
+	}
+	return UnsafeEntriesReject
+}
+
+func (s *SpecFile) GetWhiteoutsMode() string {
+	switch s.Whiteouts {
+	case WhiteoutsApply, WhiteoutsOverlay:
+		return s.Whiteouts
+	default:
+		return WhiteoutsKeep
+	}
+}
+
+// IsSecureExtraction returns true if the paths must be resolved
+// inside the extraction directory. The apply and overlay whiteouts
+// modes remove existing paths and always use the secure extraction.
+func (s *SpecFile) IsSecureExtraction() bool {
+	return s.SecureExtraction || s.GetWhiteoutsMode() != WhiteoutsKeep
+}
+
+func (s *SpecFile) HasJournal() bool {
+	return s.Journal || s.JournalFile != ""
+}
+
+// GetOverwritePolicy returns the overwrite policy of the path. The
+// rule with the longest matching prefix wins over the default policy.
+func (s *SpecFile) GetOverwritePolicy(path string) string {
+	ans := s.OverwritePolicy
+	if len(s.OverwritePolicies) > 0 {
+		path = filepath.Clean("/" + path)
+		l := -1
+		for _, r := range s.OverwritePolicies {
+			if n := matchPathLen(path, []string{r.Prefix}); n > l {
+				l = n
+				ans = r.Policy
+			}
+		}
+	}
+
+	if ans == "" {
+		return OverwriteReplace
+	}
+	return ans
+}
+
+func (s *SpecFile) validateOverwritePolicies() error {
+	policies := []string{s.OverwritePolicy}
+	for _, r := range s.OverwritePolicies {
+		policies = append(policies, r.Policy)
+	}
+
+	for _, p := range policies {
+		switch p {
+		case "", OverwriteReplace, OverwriteKeepExisting, OverwriteKeepNewer,
+			OverwriteIfDifferent, OverwriteFail:
+		default:
+			return fmt.Errorf("Invalid overwrite policy %s", p)
+		}
+	}
+
+	return nil
+}
+
+func (s *SpecFile) IsXattrAllowed(name string) bool {
+	return isXattrAllowed(name, s.XattrsInclude, s.XattrsExclude)
+}
+
+// isXattrAllowed checks if the extended attribute is included
+// and not excluded by the namespaces lists.
+func isXattrAllowed(name string, include, exclude []string) bool {
+	if len(include) > 0 && !matchXattrNamespace(name, include) {
+		return false
+	}
+	return !matchXattrNamespace(name, exclude)
+}
+
+// matchXattrNamespace returns true if the extended attribute is
+// of one of the namespaces. The namespace could be defined with or
+// without the final dot (user or user.).
+func matchXattrNamespace(name string, namespaces []string) bool {
+	for _, ns := range namespaces {
+		ns = strings.TrimSuffix(ns, ".")
+		if name == ns || strings.HasPrefix(name, ns+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// IsPathProtected returns true if the path is under a protected path
+// and it isn't masked. The longest matching path wins.
+func (s *SpecFile) IsPathProtected(path string) bool {
+	if len(s.ProtectPaths) == 0 {
+		return false
+	}
+
+	path = filepath.Clean("/" + path)
+	protectLen := matchPathLen(path, s.ProtectPaths)
+	if protectLen < 0 {
+		return false
+	}
+
+	return protectLen > matchPathLen(path, s.ProtectMask)
+}
+
+// matchPathLen returns the length of the longest path of the list
+// that contains the path or -1.
+func matchPathLen(path string, paths []string) int {
+	ans := -1
+	for _, p := range paths {
+		p = filepath.Clean("/" + p)
+		if path == p || p == "/" || strings.HasPrefix(path, p+"/") {
+			if len(p) > ans {
+				ans = len(p)
+			}
+		}
+	}
+	return ans
+}
+
 func (s *SpecFile) IsFileTriggered(path string) bool {
 	if len(s.TriggeredFiles) == 0 && len(s.TriggeredMatchesPrefix) == 0 {
 		return true
@@ -110,6 +241,7 @@ func (s *SpecFile) Prepare() error {
 		}
 	}
 
+	s.ignoreRegexes = []*regexp.Regexp{}
 	if len(s.IgnoreRegexes) > 0 {
 		for _, f := range s.IgnoreRegexes {
 			r, err := regexp.Compile(f)
@@ -121,23 +253,40 @@ func (s *SpecFile) Prepare() error {
 		}
 	}
 
-	return nil
+	err := s.validateOverwritePolicies()
+	if err != nil {
+		return err
+	}
+
+	if s.Writer != nil {
+		_, err = s.Writer.GetFormat()
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.prepareRemap()
 }
 
-func (s *SpecFile) IsPath2Skip(resource string) bool {
-	ans := false
+// IsPathMatched returns true if the path matches one of the
+// match_prefix rules or if there aren't match_prefix rules.
+func (s *SpecFile) IsPathMatched(resource string) bool {
+	if len(s.MatchPrefix) == 0 {
+		return true
+	}
 
-	if len(s.MatchPrefix) > 0 {
-		for _, p := range s.MatchPrefix {
-			if strings.HasPrefix(resource, p) {
-				ans = true
-				break
-			}
+	for _, p := range s.MatchPrefix {
+		if strings.HasPrefix(resource, p) {
+			return true
 		}
-
-		ans = !ans
 	}
 
+	return false
+}
+
+func (s *SpecFile) IsPath2Skip(resource string) bool {
+	ans := !s.IsPathMatched(resource)
+
 	if len(s.IgnoreFiles) > 0 && !ans {
 		for _, f := range s.IgnoreFiles {
 			if f == resource {
@@ -191,6 +340,7 @@ func NewFileMeta(header *tar.Header) FileMeta {
 		ans.Xattrs = header.Xattrs
 		ans.PAXRecords = header.PAXRecords
 		ans.FileInfo = header.FileInfo()
+		ans.parsePAXRecords(header.PAXRecords)
 	}
 	return ans
 }
@@ -203,7 +353,64 @@ func NewWriter() *WriterRules {
 	return &WriterRules{
 		ArchiveDirs:  []string{},
 		ArchiveFiles: []string{},
+		Sockets:      SocketsSkip,
+	}
+}
+
+func (w *WriterRules) GetSocketsPolicy() string {
+	if w.Sockets == SocketsFail {
+		return SocketsFail
+	}
+	return SocketsSkip
+}
+
+func (w *WriterRules) IsXattrAllowed(name string) bool {
+	if w == nil {
+		return true
+	}
+	return isXattrAllowed(name, w.XattrsInclude, w.XattrsExclude)
+}
+
+// GetFormat returns the format of the tar headers. The unknown format
+// means that the format is selected for every header.
+func (w *WriterRules) GetFormat() (tar.Format, error) {
+	if w == nil {
+		return tar.FormatUnknown, nil
 	}
+
+	switch w.Format {
+	case "":
+		return tar.FormatUnknown, nil
+	case FormatUstar:
+		return tar.FormatUSTAR, nil
+	case FormatPax:
+		return tar.FormatPAX, nil
+	case FormatGnu:
+		return tar.FormatGNU, nil
+	}
+
+	return tar.FormatUnknown, fmt.Errorf("Invalid tar format %s", w.Format)
+}
+
+// GetSourceDateEpoch returns the time used to clamp the modification
+// times of the entries and false if the source date epoch is not defined.
+func (w *WriterRules) GetSourceDateEpoch() (time.Time, bool, error) {
+	if w.SourceDateEpoch > 0 {
+		return time.Unix(w.SourceDateEpoch, 0), true, nil
+	}
+
+	env := os.Getenv(SourceDateEpochEnv)
+	if env == "" {
+		return time.Time{}, false, nil
+	}
+
+	epoch, err := strconv.ParseInt(env, 10, 64)
+	if err != nil || epoch < 0 {
+		return time.Time{}, false, fmt.Errorf(
+			"Invalid %s value %s", SourceDateEpochEnv, env)
+	}
+
+	return time.Unix(epoch, 0), true, nil
 }
 
 func (w *WriterRules) AddDir(dir string) {
@@ -0,0 +1,219 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package tarfs
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"io/fs"
+	"time"
+
+	"github.com/geaaru/tar-formers/pkg/index"
+)
+
+// fileInfo is the info of a node with the name of the path used
+// to open it.
+type fileInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (i *fileInfo) Name() string {
+	return i.name
+}
+
+func newFileInfo(name string, n *node) fs.FileInfo {
+	header := &tar.Header{
+		Typeflag: tar.TypeDir,
+		Mode:     0755,
+		ModTime:  time.Unix(0, 0),
+	}
+
+	if e := n.entry; e != nil {
+		header = &tar.Header{
+			Name:     e.Name,
+			Typeflag: e.Typeflag,
+			Linkname: e.Linkname,
+			Size:     e.Size,
+			Mode:     e.Mode,
+			Uid:      e.Uid,
+			Gid:      e.Gid,
+			Uname:    e.Uname,
+			Gname:    e.Gname,
+			ModTime:  e.ModTime,
+		}
+	}
+
+	return &fileInfo{FileInfo: header.FileInfo(), name: name}
+}
+
+// file is an opened regular file (or special file without data).
+type file struct {
+	fs    *FS
+	entry *index.Entry
+	info  fs.FileInfo
+	path  string
+
+	reader  io.Reader
+	section *io.SectionReader
+	closed  bool
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+// open prepares the reader of the data. The data of the regular
+// files are read with random access.
+func (f *file) open() error {
+	if f.reader != nil {
+		return nil
+	}
+
+	if f.entry.Size > 0 && !f.entry.Sparse &&
+		(f.entry.Typeflag == tar.TypeReg || f.entry.Typeflag == tar.TypeRegA) {
+		section, err := f.fs.reader.OpenData(f.entry)
+		if err != nil {
+			return err
+		}
+		f.section = section
+		f.reader = section
+		return nil
+	}
+
+	_, reader, err := f.fs.reader.OpenEntry(f.entry)
+	if err != nil {
+		return err
+	}
+	f.reader = reader
+
+	return nil
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "read", Path: f.path, Err: fs.ErrClosed}
+	}
+
+	if err := f.open(); err != nil {
+		return 0, &fs.PathError{Op: "read", Path: f.path, Err: err}
+	}
+
+	return f.reader.Read(p)
+}
+
+// seekable returns the reader with random access of the data.
+func (f *file) seekable(op string) (*io.SectionReader, error) {
+	if f.closed {
+		return nil, &fs.PathError{Op: op, Path: f.path, Err: fs.ErrClosed}
+	}
+
+	if err := f.open(); err != nil {
+		return nil, &fs.PathError{Op: op, Path: f.path, Err: err}
+	}
+
+	if f.section == nil {
+		return nil, &fs.PathError{Op: op, Path: f.path,
+			Err: errors.New("random access not supported")}
+	}
+
+	return f.section, nil
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	section, err := f.seekable("seek")
+	if err != nil {
+		return 0, err
+	}
+	return section.Seek(offset, whence)
+}
+
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	section, err := f.seekable("read")
+	if err != nil {
+		return 0, err
+	}
+	return section.ReadAt(p, off)
+}
+
+func (f *file) Close() error {
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.path, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+// dir is an opened directory.
+type dir struct {
+	fs   *FS
+	node *node
+	info fs.FileInfo
+	path string
+
+	entries []fs.DirEntry
+	offset  int
+	closed  bool
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *dir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.path,
+		Err: errors.New("is a directory")}
+}
+
+func (d *dir) ReadDir(count int) ([]fs.DirEntry, error) {
+	if d.closed {
+		return nil, &fs.PathError{Op: "readdir", Path: d.path, Err: fs.ErrClosed}
+	}
+
+	if d.entries == nil {
+		entries, err := d.fs.dirEntries(d.node)
+		if err != nil {
+			return nil, err
+		}
+		d.entries = entries
+	}
+
+	remaining := d.entries[d.offset:]
+	if count <= 0 {
+		d.offset = len(d.entries)
+		return remaining, nil
+	}
+
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(remaining) {
+		count = len(remaining)
+	}
+	d.offset += count
+
+	return remaining[:count], nil
+}
+
+func (d *dir) Close() error {
+	if d.closed {
+		return &fs.PathError{Op: "close", Path: d.path, Err: fs.ErrClosed}
+	}
+	d.closed = true
+	return nil
+}
@@ -0,0 +1,391 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package tarfs
+
+import (
+	"archive/tar"
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/geaaru/tar-formers/pkg/index"
+	specs "github.com/geaaru/tar-formers/pkg/specs"
+	"github.com/geaaru/tar-formers/pkg/tools"
+)
+
+// Max number of symlinks followed to resolve a path (as Linux).
+const maxSymlinks = 40
+
+var errTooManyLinks = errors.New("too many levels of symbolic links")
+
+// FS is a read-only view of the entries of a tarball that implements
+// fs.FS, fs.ReadDirFS and fs.StatFS. The rename and the ignore rules
+// of the spec file are applied to the entries and the hardlinks and
+// the symlinks are resolved inside the archive.
+type FS struct {
+	reader *index.Reader
+	spec   *specs.SpecFile
+	root   *node
+	// Map of the paths of the tarball with the path of the node.
+	names map[string]string
+	// Close the reader on Close
+	owner bool
+}
+
+type node struct {
+	path     string
+	entry    *index.Entry
+	children map[string]*node
+}
+
+func (n *node) isDir() bool {
+	return n.entry == nil || n.entry.Typeflag == tar.TypeDir
+}
+
+func (n *node) isSymlink() bool {
+	return n.entry != nil && n.entry.Typeflag == tar.TypeSymlink
+}
+
+func (n *node) isHardlink() bool {
+	return n.entry != nil && n.entry.Typeflag == tar.TypeLink
+}
+
+// New returns the view of the tarball of the reader. The spec
+// could be nil. The reader is available only for the uncompressed
+// tarballs and for the tarballs compressed with zstd-seekable
+// (see index.Open).
+func New(r *index.Reader, spec *specs.SpecFile) (*FS, error) {
+	if spec == nil {
+		spec = specs.NewSpecFile()
+	}
+
+	err := spec.Prepare()
+	if err != nil {
+		return nil, err
+	}
+
+	ans := &FS{
+		reader: r,
+		spec:   spec,
+		root:   &node{path: ".", children: make(map[string]*node)},
+		names:  make(map[string]string),
+	}
+
+	for _, e := range r.Index.Entries {
+		if e.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+
+		absPath := spec.GetRename("/" + e.Name)
+		if spec.IsPath2Skip(absPath) {
+			continue
+		}
+
+		p := cleanPath(absPath)
+		ans.names[index.CleanName(e.Name)] = p
+		ans.add(p, e)
+	}
+
+	return ans, nil
+}
+
+// OpenFile returns the view of the tarball. The index of the sidecar
+// file is used if present, otherwise the tarball is indexed. Only
+// the uncompressed tarballs and the tarballs compressed with
+// zstd-seekable are supported: the other compressions are rejected
+// without read the whole tarball.
+func OpenFile(tarball string, spec *specs.SpecFile) (*FS, error) {
+	var idx *index.Index
+
+	err := checkCompression(tarball)
+	if err != nil {
+		return nil, err
+	}
+
+	indexFile := index.GetIndexFile(tarball)
+	if _, err = os.Stat(indexFile); err == nil {
+		idx, err = index.LoadIndex(indexFile)
+	} else {
+		idx, err = index.BuildFile(tarball)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := index.Open(tarball, idx)
+	if err != nil {
+		return nil, err
+	}
+
+	ans, err := New(r, spec)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	ans.owner = true
+
+	return ans, nil
+}
+
+// checkCompression returns an error if the tarball is compressed
+// with a format without random access. The zstd tarballs without
+// the seek table are rejected by index.Open.
+func checkCompression(tarball string) error {
+	f, err := os.Open(tarball)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	mode, _ := tools.PeekCompressionMode(bufio.NewReader(f))
+	if mode != tools.None && mode != tools.Zstd {
+		return fmt.Errorf(
+			"The tarball %s is compressed with %s: only the uncompressed and the zstd-seekable tarballs are supported",
+			tarball, mode)
+	}
+
+	return nil
+}
+
+// Close closes the tarball if opened with OpenFile.
+func (f *FS) Close() error {
+	if f.owner {
+		return f.reader.Close()
+	}
+	return nil
+}
+
+// cleanPath returns the path of the node of the absolute path.
+func cleanPath(absPath string) string {
+	p := strings.TrimPrefix(path.Clean("/"+absPath), "/")
+	if p == "" {
+		return "."
+	}
+	return p
+}
+
+// add adds the entry to the tree. The missing parent directories are
+// created and an entry with the same path of a previous entry
+// replaces it (as on extraction).
+func (f *FS) add(p string, e *index.Entry) {
+	if p == "." {
+		if e.Typeflag == tar.TypeDir {
+			f.root.entry = e
+		}
+		return
+	}
+
+	parent := f.root
+	elems := strings.Split(p, "/")
+	for i, elem := range elems[:len(elems)-1] {
+		child, ok := parent.children[elem]
+		if !ok || !child.isDir() {
+			child = &node{
+				path:     strings.Join(elems[:i+1], "/"),
+				children: make(map[string]*node),
+			}
+			parent.children[elem] = child
+		}
+		parent = child
+	}
+
+	name := elems[len(elems)-1]
+	n, ok := parent.children[name]
+	if ok && n.isDir() && e.Typeflag == tar.TypeDir {
+		// POST: keep the children of the directory.
+		n.entry = e
+		return
+	}
+
+	n = &node{path: p, entry: e}
+	if e.Typeflag == tar.TypeDir {
+		n.children = make(map[string]*node)
+	}
+	parent.children[name] = n
+}
+
+// resolve returns the node of the path. The symlinks of the parent
+// directories are followed and the symlink of the last element only
+// if follow is true.
+func (f *FS) resolve(name string, follow bool, links int) (*node, error) {
+	if name == "." {
+		return f.root, nil
+	}
+
+	cur := f.root
+	elems := strings.Split(name, "/")
+	for i, elem := range elems {
+		if !cur.isDir() {
+			return nil, fs.ErrNotExist
+		}
+
+		child, ok := cur.children[elem]
+		if !ok {
+			return nil, fs.ErrNotExist
+		}
+
+		last := i == len(elems)-1
+		if child.isSymlink() && (!last || follow) {
+			if links >= maxSymlinks {
+				return nil, errTooManyLinks
+			}
+
+			target := child.entry.Linkname
+			if !path.IsAbs(target) {
+				target = path.Join("/"+cur.path, target)
+			}
+			target = cleanPath(path.Join(append([]string{target}, elems[i+1:]...)...))
+
+			return f.resolve(target, follow, links+1)
+		}
+
+		cur = child
+	}
+
+	return cur, nil
+}
+
+// hardlinkTarget returns the node with the data of the hardlink.
+func (f *FS) hardlinkTarget(n *node) (*node, error) {
+	for links := 0; n.isHardlink(); links++ {
+		if links >= maxSymlinks {
+			return nil, errTooManyLinks
+		}
+
+		p, ok := f.names[index.CleanName(n.entry.Linkname)]
+		if !ok {
+			return nil, fs.ErrNotExist
+		}
+
+		target, err := f.resolve(p, false, 0)
+		if err != nil {
+			return nil, err
+		}
+		n = target
+	}
+
+	return n, nil
+}
+
+// lookup returns the node of the path and the node with the data of
+// the hardlinks.
+func (f *FS) lookup(op, name string, follow bool) (*node, *node, error) {
+	if !fs.ValidPath(name) {
+		return nil, nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	n, err := f.resolve(name, follow, 0)
+	if err != nil {
+		return nil, nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	data, err := f.hardlinkTarget(n)
+	if err != nil {
+		return nil, nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	return n, data, nil
+}
+
+func (f *FS) Open(name string) (fs.File, error) {
+	_, n, err := f.lookup("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	info := newFileInfo(path.Base(name), n)
+	if n.isDir() {
+		return &dir{fs: f, node: n, info: info, path: name}, nil
+	}
+
+	return &file{fs: f, entry: n.entry, info: info, path: name}, nil
+}
+
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	_, n, err := f.lookup("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return newFileInfo(path.Base(name), n), nil
+}
+
+// Lstat returns the info of the path without following the symlink
+// of the last element.
+func (f *FS) Lstat(name string) (fs.FileInfo, error) {
+	_, n, err := f.lookup("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return newFileInfo(path.Base(name), n), nil
+}
+
+// ReadLink returns the destination of the symlink.
+func (f *FS) ReadLink(name string) (string, error) {
+	n, _, err := f.lookup("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+
+	if !n.isSymlink() {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+
+	return n.entry.Linkname, nil
+}
+
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	_, n, err := f.lookup("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if !n.isDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name,
+			Err: fmt.Errorf("not a directory")}
+	}
+
+	return f.dirEntries(n)
+}
+
+// dirEntries returns the entries of the directory sorted by name.
+// The symlinks aren't followed.
+func (f *FS) dirEntries(n *node) ([]fs.DirEntry, error) {
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ans := make([]fs.DirEntry, 0, len(names))
+	for _, name := range names {
+		data, err := f.hardlinkTarget(n.children[name])
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir",
+				Path: path.Join(n.path, name), Err: err}
+		}
+		ans = append(ans, fs.FileInfoToDirEntry(newFileInfo(name, data)))
+	}
+
+	return ans, nil
+}
@@ -0,0 +1,210 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package tarfs_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing/fstest"
+
+	"github.com/geaaru/tar-formers/pkg/index"
+	specs "github.com/geaaru/tar-formers/pkg/specs"
+	. "github.com/geaaru/tar-formers/pkg/tarfs"
+	"github.com/geaaru/tar-formers/pkg/tools"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Tarfs", func() {
+
+	Context("Uncompressed tarball", func() {
+		var dir, tarball string
+		var fsys *FS
+
+		BeforeEach(func() {
+			var err error
+			dir = GinkgoT().TempDir()
+			tarball = newTestTarball(dir, testEntries)
+			fsys, err = OpenFile(tarball, nil)
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(fsys.Close)
+		})
+
+		It("implements the io/fs interfaces", func() {
+			Expect(fstest.TestFS(fsys,
+				"etc/os-release", "etc/link", "etc/abs", "usr/bin/sh",
+				"usr/bin/bash", "bin", "var/empty",
+			)).To(Succeed())
+		})
+
+		It("reads the last entry with the same name", func() {
+			data, err := fs.ReadFile(fsys, "etc/os-release")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(Equal("NAME=second\n"))
+		})
+
+		It("resolves the symlinks inside the archive", func() {
+			for _, name := range []string{"etc/link", "etc/abs"} {
+				data, err := fs.ReadFile(fsys, name)
+				Expect(err).ToNot(HaveOccurred(), name)
+				Expect(string(data)).To(Equal("NAME=second\n"), name)
+
+				info, err := fsys.Lstat(name)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(info.Mode() & fs.ModeSymlink).ToNot(BeZero())
+			}
+
+			link, err := fsys.ReadLink("etc/abs")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(link).To(Equal("/etc/os-release"))
+
+			// The symlink of a parent directory.
+			data, err := fs.ReadFile(fsys, "bin/bash")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(Equal("#!/bin/sh\n"))
+
+			_, err = fsys.ReadLink("etc/os-release")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("reads the data of the hardlinks", func() {
+			data, err := fs.ReadFile(fsys, "usr/bin/bash")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(Equal("#!/bin/sh\n"))
+
+			info, err := fsys.Stat("usr/bin/bash")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Name()).To(Equal("bash"))
+			Expect(info.Mode().IsRegular()).To(BeTrue())
+			Expect(info.Size()).To(Equal(int64(len("#!/bin/sh\n"))))
+
+			f, err := fsys.Open("usr/bin/bash")
+			Expect(err).ToNot(HaveOccurred())
+			defer f.Close()
+			p := make([]byte, 3)
+			n, err := f.(io.ReaderAt).ReadAt(p, 2)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(p[:n])).To(Equal("/bi"))
+		})
+
+		It("reads the directories", func() {
+			names := func(name string) []string {
+				entries, err := fsys.ReadDir(name)
+				Expect(err).ToNot(HaveOccurred(), name)
+				ans := []string{}
+				for _, e := range entries {
+					ans = append(ans, e.Name())
+				}
+				return ans
+			}
+
+			Expect(names(".")).To(Equal([]string{"bin", "etc", "usr", "var"}))
+			Expect(names("etc")).To(Equal([]string{"abs", "link", "os-release"}))
+			// The directory of a symlink.
+			Expect(names("bin")).To(Equal([]string{"bash", "sh"}))
+			Expect(names("var/empty")).To(BeEmpty())
+
+			entries, err := fsys.ReadDir(".")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(entries[0].Type() & fs.ModeSymlink).ToNot(BeZero())
+			Expect(entries[1].IsDir()).To(BeTrue())
+
+			_, err = fsys.ReadDir("etc/os-release")
+			Expect(err).To(HaveOccurred())
+			_, err = fsys.ReadDir("missing")
+			Expect(err).To(MatchError(fs.ErrNotExist))
+		})
+
+		It("applies the rename and the ignore rules", func() {
+			idx, err := index.BuildFile(tarball)
+			Expect(err).ToNot(HaveOccurred())
+			r, err := index.Open(tarball, idx)
+			Expect(err).ToNot(HaveOccurred())
+			defer r.Close()
+
+			spec := specs.NewSpecFile()
+			spec.Rename = []specs.RenameRule{
+				{Source: "/usr/bin/sh", Dest: "/usr/bin/dash"},
+			}
+			spec.IgnoreRegexes = []string{"^/var"}
+
+			view, err := New(r, spec)
+			Expect(err).ToNot(HaveOccurred())
+
+			data, err := fs.ReadFile(view, "usr/bin/dash")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(Equal("#!/bin/sh\n"))
+			// The hardlink follows the renamed target.
+			data, err = fs.ReadFile(view, "usr/bin/bash")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(Equal("#!/bin/sh\n"))
+
+			_, err = view.Stat("usr/bin/sh")
+			Expect(err).To(MatchError(fs.ErrNotExist))
+			_, err = view.Stat("var")
+			Expect(err).To(MatchError(fs.ErrNotExist))
+		})
+	})
+
+	Context("Compressed tarball", func() {
+		var dir string
+		var data []byte
+
+		BeforeEach(func() {
+			var err error
+			dir = GinkgoT().TempDir()
+			data, err = os.ReadFile(newTestTarball(dir, testEntries))
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("reads the tarball compressed with zstd-seekable", func() {
+			tarball := filepath.Join(dir, "test.tar.zst")
+			f, err := os.Create(tarball)
+			Expect(err).ToNot(HaveOccurred())
+			zw, err := tools.NewZstdSeekableWriter(f, 256)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = zw.Write(data)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(zw.Close()).To(Succeed())
+			Expect(f.Close()).To(Succeed())
+
+			fsys, err := OpenFile(tarball, nil)
+			Expect(err).ToNot(HaveOccurred())
+			defer fsys.Close()
+
+			Expect(fstest.TestFS(fsys, "etc/os-release", "usr/bin/bash")).To(Succeed())
+		})
+
+		It("rejects the tarball compressed with gzip", func() {
+			tarball := filepath.Join(dir, "test.tar.gz")
+			buf := bytes.NewBuffer(nil)
+			gw := gzip.NewWriter(buf)
+			_, err := gw.Write(data)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(gw.Close()).To(Succeed())
+			Expect(os.WriteFile(tarball, buf.Bytes(), 0644)).To(Succeed())
+
+			_, err = OpenFile(tarball, nil)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("compressed with gz"))
+		})
+	})
+})
@@ -0,0 +1,90 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package tarfs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestTarfs(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Tarfs Suite")
+}
+
+type testEntry struct {
+	Header  tar.Header
+	Content string
+}
+
+// testEntries contains the entries of the tarball of the tests: the
+// parent directories of usr/bin aren't in the tarball.
+var testEntries = []testEntry{
+	{Header: tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}},
+	{
+		Header:  tar.Header{Name: "etc/os-release", Typeflag: tar.TypeReg, Mode: 0644},
+		Content: "NAME=first\n",
+	},
+	{Header: tar.Header{
+		Name: "etc/link", Typeflag: tar.TypeSymlink, Linkname: "os-release",
+	}},
+	{Header: tar.Header{
+		Name: "etc/abs", Typeflag: tar.TypeSymlink, Linkname: "/etc/os-release",
+	}},
+	{
+		Header:  tar.Header{Name: "usr/bin/sh", Typeflag: tar.TypeReg, Mode: 0755},
+		Content: "#!/bin/sh\n",
+	},
+	{Header: tar.Header{
+		Name: "usr/bin/bash", Typeflag: tar.TypeLink, Linkname: "usr/bin/sh",
+	}},
+	{Header: tar.Header{
+		Name: "bin", Typeflag: tar.TypeSymlink, Linkname: "usr/bin",
+	}},
+	{Header: tar.Header{Name: "var/empty/", Typeflag: tar.TypeDir, Mode: 0755}},
+	{
+		Header:  tar.Header{Name: "./etc/os-release", Typeflag: tar.TypeReg, Mode: 0644},
+		Content: "NAME=second\n",
+	},
+}
+
+// newTestTarball writes the tarball with the entries in the directory
+// and returns the path.
+func newTestTarball(dir string, entries []testEntry) string {
+	buf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		h := e.Header
+		h.Size = int64(len(e.Content))
+		Expect(tw.WriteHeader(&h)).To(Succeed())
+		if e.Content != "" {
+			_, err := tw.Write([]byte(e.Content))
+			Expect(err).ToNot(HaveOccurred())
+		}
+	}
+	Expect(tw.Close()).To(Succeed())
+
+	tarball := filepath.Join(dir, "test.tar")
+	Expect(os.WriteFile(tarball, buf.Bytes(), 0644)).To(Succeed())
+	return tarball
+}
@@ -0,0 +1,248 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package tools
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	AclXattrAccess  = "system.posix_acl_access"
+	AclXattrDefault = "system.posix_acl_default"
+
+	aclXattrVersion = 2
+	aclUndefinedId  = 0xFFFFFFFF
+
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+)
+
+type AclEntry struct {
+	Tag  uint16
+	Perm uint16
+	Id   uint32
+}
+
+// AclIdMapper returns the id to use for the qualifier of an ACL entry
+// of a user or of a group. The name is empty if the qualifier is only
+// numeric and the id is -1 if the numeric id isn't available.
+type AclIdMapper func(name string, id int, group bool) (int, error)
+
+// AclXattrToText converts the POSIX ACL in the linux xattr format
+// to the text format used by the SCHILY.acl.* PAX records. The users
+// and the groups are written with the numeric id.
+func AclXattrToText(data []byte) (string, error) {
+	if len(data) < 4 || (len(data)-4)%8 != 0 {
+		return "", fmt.Errorf("Invalid ACL size %d", len(data))
+	}
+
+	if v := binary.LittleEndian.Uint32(data[0:4]); v != aclXattrVersion {
+		return "", fmt.Errorf("Invalid ACL version %d", v)
+	}
+
+	entries := []string{}
+	for i := 4; i < len(data); i += 8 {
+		e := AclEntry{
+			Tag:  binary.LittleEndian.Uint16(data[i : i+2]),
+			Perm: binary.LittleEndian.Uint16(data[i+2 : i+4]),
+			Id:   binary.LittleEndian.Uint32(data[i+4 : i+8]),
+		}
+
+		perm := aclPermToText(e.Perm)
+		switch e.Tag {
+		case aclUserObj:
+			entries = append(entries, "user::"+perm)
+		case aclUser:
+			entries = append(entries, fmt.Sprintf("user:%d:%s", e.Id, perm))
+		case aclGroupObj:
+			entries = append(entries, "group::"+perm)
+		case aclGroup:
+			entries = append(entries, fmt.Sprintf("group:%d:%s", e.Id, perm))
+		case aclMask:
+			entries = append(entries, "mask::"+perm)
+		case aclOther:
+			entries = append(entries, "other::"+perm)
+		default:
+			return "", fmt.Errorf("Invalid ACL tag %d", e.Tag)
+		}
+	}
+
+	return strings.Join(entries, ","), nil
+}
+
+// AclTextToXattr converts the POSIX ACL in text format to the linux
+// xattr format. The entries could be separated by comma or newline and
+// could have the numeric id as fourth field (star format). The
+// qualifiers are resolved with the mapper. Without mapper only the
+// numeric ids are accepted.
+func AclTextToXattr(text string, mapper AclIdMapper) ([]byte, error) {
+	entries := []AclEntry{}
+
+	text = strings.ReplaceAll(text, "\n", ",")
+	for _, s := range strings.Split(text, ",") {
+		// Drop comments
+		if idx := strings.Index(s, "#"); idx >= 0 {
+			s = s[:idx]
+		}
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		fields := strings.Split(s, ":")
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("Invalid ACL entry %s", s)
+		}
+
+		perm, err := aclTextToPerm(fields[2])
+		if err != nil {
+			return nil, err
+		}
+
+		e := AclEntry{Perm: perm, Id: aclUndefinedId}
+		qualifier := fields[1]
+		if qualifier != "" && len(fields) > 3 && fields[3] != "" {
+			qualifier += ":" + fields[3]
+		}
+
+		switch fields[0] {
+		case "user", "u":
+			if qualifier == "" {
+				e.Tag = aclUserObj
+			} else {
+				e.Tag = aclUser
+				e.Id, err = aclLookupId(qualifier, false, mapper)
+			}
+		case "group", "g":
+			if qualifier == "" {
+				e.Tag = aclGroupObj
+			} else {
+				e.Tag = aclGroup
+				e.Id, err = aclLookupId(qualifier, true, mapper)
+			}
+		case "mask", "m":
+			e.Tag = aclMask
+		case "other", "o":
+			e.Tag = aclOther
+		default:
+			return nil, fmt.Errorf("Invalid ACL tag %s", fields[0])
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, e)
+	}
+
+	// The kernel requires the entries sorted by tag and id.
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Tag != entries[j].Tag {
+			return entries[i].Tag < entries[j].Tag
+		}
+		return entries[i].Id < entries[j].Id
+	})
+
+	ans := make([]byte, 4+8*len(entries))
+	binary.LittleEndian.PutUint32(ans[0:4], aclXattrVersion)
+	for i, e := range entries {
+		off := 4 + 8*i
+		binary.LittleEndian.PutUint16(ans[off:off+2], e.Tag)
+		binary.LittleEndian.PutUint16(ans[off+2:off+4], e.Perm)
+		binary.LittleEndian.PutUint32(ans[off+4:off+8], e.Id)
+	}
+
+	return ans, nil
+}
+
+func aclPermToText(perm uint16) string {
+	ans := []byte("---")
+	if perm&4 != 0 {
+		ans[0] = 'r'
+	}
+	if perm&2 != 0 {
+		ans[1] = 'w'
+	}
+	if perm&1 != 0 {
+		ans[2] = 'x'
+	}
+	return string(ans)
+}
+
+func aclTextToPerm(s string) (uint16, error) {
+	var ans uint16
+	for _, c := range s {
+		switch c {
+		case 'r':
+			ans |= 4
+		case 'w':
+			ans |= 2
+		case 'x':
+			ans |= 1
+		case '-':
+		default:
+			return 0, fmt.Errorf("Invalid ACL permissions %s", s)
+		}
+	}
+	return ans, nil
+}
+
+// aclLookupId returns the id of the user or group. The qualifier
+// could be the numeric id, the name or the name and the numeric id
+// separated by colon (star format).
+func aclLookupId(qualifier string, group bool, mapper AclIdMapper) (uint32, error) {
+	name, sid := qualifier, ""
+	if idx := strings.Index(qualifier, ":"); idx >= 0 {
+		name, sid = qualifier[:idx], qualifier[idx+1:]
+	} else if _, err := strconv.ParseUint(qualifier, 10, 32); err == nil {
+		name, sid = "", qualifier
+	}
+
+	id := -1
+	if sid != "" {
+		v, err := strconv.ParseUint(sid, 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid ACL id %s", sid)
+		}
+		id = int(v)
+	}
+
+	if mapper != nil {
+		ans, err := mapper(name, id, group)
+		if err != nil {
+			return 0, err
+		}
+		id = ans
+	}
+
+	if id < 0 || int64(id) >= aclUndefinedId {
+		kind := "user"
+		if group {
+			kind = "group"
+		}
+		return 0, fmt.Errorf("Unable to resolve ACL %s %s", kind, name)
+	}
+
+	return uint32(id), nil
+}
@@ -0,0 +1,85 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package tools_test
+
+import (
+	"fmt"
+
+	. "github.com/geaaru/tar-formers/pkg/tools"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Acl", func() {
+
+	Context("Text format", func() {
+
+		It("converts the numeric ids without mapper", func() {
+			text := "user::rw-,user:1000:r--,group::r--,group:100:rwx,mask::rwx,other::---"
+
+			data, err := AclTextToXattr(text, nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			ans, err := AclXattrToText(data)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ans).To(Equal(text))
+		})
+
+		It("fails on the names without mapper", func() {
+			_, err := AclTextToXattr("user::rw-,user:foo:r--,group::r--,mask::r--,other::---", nil)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("foo"))
+		})
+
+		It("resolves the qualifiers with the mapper", func() {
+			type call struct {
+				Name  string
+				Id    int
+				Group bool
+			}
+			calls := []call{}
+			mapper := func(name string, id int, group bool) (int, error) {
+				calls = append(calls, call{name, id, group})
+				if name == "unknown" {
+					return 0, fmt.Errorf("%s not found", name)
+				}
+				if id < 0 {
+					return 3000, nil
+				}
+				return id + 10000, nil
+			}
+
+			data, err := AclTextToXattr(
+				"user::rw-\nuser:foo:r--\nuser:bar:r--:1000\ngroup::r--\ngroup:200:rwx\nmask::rwx\nother::---",
+				mapper)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(calls).To(Equal([]call{
+				{"foo", -1, false},
+				{"bar", 1000, false},
+				{"", 200, true},
+			}))
+
+			ans, err := AclXattrToText(data)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ans).To(Equal(
+				"user::rw-,user:3000:r--,user:11000:r--,group::r--,group:10200:rwx,mask::rwx,other::---"))
+
+			_, err = AclTextToXattr("user::rw-,user:unknown:r--,group::r--,mask::r--,other::---", mapper)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
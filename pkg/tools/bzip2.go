@@ -0,0 +1,91 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package tools
+
+import (
+	"bytes"
+	"io"
+
+	bzip2 "github.com/dsnet/compress/bzip2"
+)
+
+const bzip2DefaultLevel = 9
+
+// ParallelBzip2Writer compresses the chunks of the stream in parallel
+// as concatenated bzip2 streams (as pbzip2). The concatenated streams
+// are decompressed by the standard bzip2 tools.
+type ParallelBzip2Writer struct {
+	*parallelWriter
+	level int
+}
+
+// NewParallelBzip2Writer returns a writer that compresses the chunks
+// of blockSize bytes with the workers. With 0 the default level (9)
+// and a chunk size near to the block size of the level (level x 100KB)
+// are used.
+func NewParallelBzip2Writer(w io.Writer, level, blockSize, workers int) *ParallelBzip2Writer {
+	if level <= 0 {
+		level = bzip2DefaultLevel
+	}
+	if blockSize <= 0 {
+		// A chunk could be expanded by the initial RLE. The chunk
+		// is reduced to be compressed in a single block.
+		blockSize = level*100000 - level*100000/50
+	}
+
+	z := &ParallelBzip2Writer{level: level}
+	z.parallelWriter = newParallelWriter(w, z.compressBlock, blockSize, workers)
+
+	return z
+}
+
+func (z *ParallelBzip2Writer) compressBlock(data []byte) *compressedBlock {
+	ans := &compressedBlock{size: len(data)}
+
+	var buf bytes.Buffer
+	bw, err := bzip2.NewWriter(&buf, &bzip2.WriterConfig{Level: z.level})
+	if err == nil {
+		_, err = bw.Write(data)
+	}
+	if err == nil {
+		err = bw.Close()
+	}
+	if err != nil {
+		ans.err = err
+		return ans
+	}
+
+	ans.data = buf.Bytes()
+	return ans
+}
+
+// Close writes the last chunk. With an empty input an empty stream
+// is written. The underlying writer is not closed.
+func (z *ParallelBzip2Writer) Close() error {
+	if z.parallelWriter.closed {
+		return nil
+	}
+
+	if z.parallelWriter.blocks == 0 && len(z.parallelWriter.buf) == 0 &&
+		len(z.parallelWriter.pending) == 0 {
+		// POST: the empty block is written as an empty stream.
+		z.parallelWriter.buf = []byte{}
+		z.parallelWriter.submit()
+	}
+
+	return z.parallelWriter.Close()
+}
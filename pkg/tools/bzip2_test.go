@@ -0,0 +1,87 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package tools_test
+
+import (
+	"bytes"
+	"io"
+
+	. "github.com/geaaru/tar-formers/pkg/tools"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	bzip2 "github.com/dsnet/compress/bzip2"
+)
+
+// newTestBzip2Writer returns a bzip2 writer with chunks of 128KB
+// compressed by 3 workers.
+func newTestBzip2Writer(w io.Writer) io.WriteCloser {
+	return NewParallelBzip2Writer(w, 1, 128<<10, 3)
+}
+
+func decompressBzip2(data []byte) ([]byte, error) {
+	r, err := bzip2.NewReader(bytes.NewReader(data), nil)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+var _ = Describe("Bzip2", func() {
+
+	Context("Parallel writer", func() {
+		for name, size := range testSizes {
+			name, size := name, size
+
+			It("compresses and decompresses "+name+" data", func() {
+				data := newTestData(size)
+				out, err := decompressBzip2(compressTestData(data, newTestBzip2Writer))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(bytes.Equal(out, data)).To(BeTrue())
+			})
+
+			It("is decompressed by bzip2 with "+name+" data", func() {
+				data := newTestData(size)
+				out := pipeCommand(compressTestData(data, newTestBzip2Writer),
+					"bzip2", "-d", "-c")
+				Expect(bytes.Equal(out, data)).To(BeTrue())
+			})
+		}
+
+		It("writes the same stream with a different number of workers", func() {
+			data := newTestData(700 << 10)
+			expected := compressTestData(data, newTestBzip2Writer)
+
+			for _, workers := range []int{1, 2, 8} {
+				compressed := compressTestData(data, func(w io.Writer) io.WriteCloser {
+					return NewParallelBzip2Writer(w, 1, 128<<10, workers)
+				})
+				Expect(bytes.Equal(compressed, expected)).To(BeTrue())
+			}
+		})
+
+		It("uses the default level and chunk size", func() {
+			data := newTestData(2 << 20)
+			compressed := compressTestData(data, func(w io.Writer) io.WriteCloser {
+				return NewParallelBzip2Writer(w, 0, 0, 0)
+			})
+
+			out := pipeCommand(compressed, "bzip2", "-d", "-c")
+			Expect(bytes.Equal(out, data)).To(BeTrue())
+		})
+	})
+})
@@ -21,10 +21,10 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"runtime"
 	"strings"
 
 	bzip2 "github.com/dsnet/compress/bzip2"
+	s2 "github.com/klauspost/compress/s2"
 	zstd "github.com/klauspost/compress/zstd"
 	gzip "github.com/klauspost/pgzip"
 	xz "github.com/ulikunitz/xz"
@@ -33,16 +33,40 @@ import (
 type CompressionMode string
 
 const (
-	None  CompressionMode = "none"
-	Gzip  CompressionMode = "gz"
-	Zstd  CompressionMode = "zstd"
-	Xz    CompressionMode = "xz"
-	Bzip2 CompressionMode = "bz2"
+	None   CompressionMode = "none"
+	Gzip   CompressionMode = "gz"
+	Zstd   CompressionMode = "zstd"
+	Xz     CompressionMode = "xz"
+	Bzip2  CompressionMode = "bz2"
+	Lz4    CompressionMode = "lz4"
+	S2     CompressionMode = "s2"
+	Snappy CompressionMode = "sz"
+	Lzip   CompressionMode = "lz"
+	// Zstd frames aligned to the entries of the tarball with
+	// the seek table.
+	ZstdSeekable CompressionMode = "zstd-seekable"
+	// Detect the compression from the content of the stream.
+	Auto CompressionMode = "auto"
 )
 
 type TarCompressionOpts struct {
-	UseExt         bool
-	Mode           CompressionMode
+	UseExt bool
+	Mode   CompressionMode
+	// Write the same compressed stream for the same input
+	// independently of the number of CPUs.
+	Reproducible bool
+	// Compression level (DefaultLevel for the default of the algorithm).
+	Level int
+	// Compression level of the modes used when Level is not defined.
+	Levels map[CompressionMode]int
+	// Use the extreme preset of the level (only xz).
+	Extreme bool
+	// Number of goroutines used for the compression.
+	Workers int
+	// Window or dictionary size in bytes.
+	WindowSize int
+	// Size in bytes of the compressed blocks.
+	BlockSize      int
 	FileWriter     io.WriteCloser
 	CompressWriter io.WriteCloser
 }
@@ -61,10 +85,22 @@ func ParseCompressionMode(s string) CompressionMode {
 		ans = Gzip
 	} else if s == "zstd" || s == "zst" {
 		ans = Zstd
+	} else if s == "zstd-seekable" {
+		ans = ZstdSeekable
 	} else if s == "xz" {
 		ans = Xz
 	} else if s == "bz2" || s == "bzip2" {
 		ans = Bzip2
+	} else if s == "lz4" {
+		ans = Lz4
+	} else if s == "s2" {
+		ans = S2
+	} else if s == "snappy" || s == "sz" {
+		ans = Snappy
+	} else if s == "lzip" || s == "lz" {
+		ans = Lzip
+	} else if s == "auto" {
+		ans = Auto
 	}
 
 	return ans
@@ -81,6 +117,14 @@ func GetCompressionMode(file string) CompressionMode {
 		cMode = Xz
 	} else if strings.HasSuffix(file, ".bz2") || strings.HasSuffix(file, ".bzip2") {
 		cMode = Bzip2
+	} else if strings.HasSuffix(file, ".lz4") {
+		cMode = Lz4
+	} else if strings.HasSuffix(file, ".s2") {
+		cMode = S2
+	} else if strings.HasSuffix(file, ".sz") || strings.HasSuffix(file, ".snappy") {
+		cMode = Snappy
+	} else if strings.HasSuffix(file, ".lz") || strings.HasSuffix(file, ".lzip") {
+		cMode = Lzip
 	}
 	return cMode
 }
@@ -88,6 +132,7 @@ func GetCompressionMode(file string) CompressionMode {
 func NewTarCompressionOpts(useExt bool) *TarCompressionOpts {
 	return &TarCompressionOpts{
 		UseExt:         useExt,
+		Level:          DefaultLevel,
 		FileWriter:     nil,
 		CompressWriter: nil,
 	}
@@ -151,54 +196,95 @@ func (ncw *NopCloseReader) Close() error {
 }
 
 func PrepareTarReader(file string, opts *TarReaderCompressionOpts) error {
+	var r io.ReadCloser
 	var err error
-	cMode := None
+	extMode := None
 
 	if file == "-" {
 		// POST: Using stdint for read
-		r := bufio.NewReader(os.Stdin)
-		opts.FileReader = NewNopCloseReader(r)
-
-		if !opts.UseExt {
-			cMode = opts.Mode
-		}
+		r = NewNopCloseReader(os.Stdin)
 	} else {
-		opts.FileReader, err = os.OpenFile(file, os.O_RDONLY, 0666)
+		r, err = os.OpenFile(file, os.O_RDONLY, 0666)
 		if err != nil {
 			return fmt.Errorf(
 				"Error on open file %s: %s", file, err.Error())
 		}
 
 		if opts.UseExt {
-			cMode = GetCompressionMode(file)
-		} else {
-			cMode = opts.Mode
+			extMode = GetCompressionMode(file)
+		}
+	}
+
+	return opts.prepare(r, extMode)
+}
+
+// PrepareTarStreamReader prepares the decompression of the stream
+// with the compression defined by the Mode of the options. With the
+// UseExt option or the Auto mode the compression is detected by the
+// content of the stream.
+func PrepareTarStreamReader(r io.ReadCloser, opts *TarReaderCompressionOpts) error {
+	return opts.prepare(r, None)
+}
+
+func (o *TarReaderCompressionOpts) prepare(r io.ReadCloser, extMode CompressionMode) error {
+	var err error
+
+	reader := NewBufferedReadCloser(r)
+	o.FileReader = reader
+
+	cMode := o.Mode
+	if o.UseExt || cMode == "" || cMode == Auto {
+		var ok bool
+		cMode, ok = PeekCompressionMode(reader.Reader)
+		if !ok && extMode != None {
+			// POST: unknown content. Using the extension of the file.
+			cMode = extMode
 		}
 	}
+	o.Mode = cMode
+
+	// Count the compressed bytes to permit the check of the
+	// compression ratio.
+	compressed := NewCountingReader(o.FileReader)
 
 	switch cMode {
 	case Gzip:
-		opts.CompressReader, err = gzip.NewReader(opts.FileReader)
+		o.CompressReader, err = gzip.NewReader(compressed)
 		if err != nil {
 			return err
 		}
-	case Zstd:
-		r, err := zstd.NewReader(opts.FileReader)
+	case Zstd, ZstdSeekable:
+		r, err := zstd.NewReader(compressed)
 		if err != nil {
 			return err
 		}
-		opts.CompressReader = r.IOReadCloser()
+		o.CompressReader = r.IOReadCloser()
 	case Xz:
-		r, err := xz.NewReader(opts.FileReader)
+		r, err := xz.NewReader(compressed)
 		if err != nil {
 			return err
 		}
-		opts.CompressReader = NewNopCloseReader(r)
+		o.CompressReader = NewNopCloseReader(r)
 	case Bzip2:
-		opts.CompressReader, err = bzip2.NewReader(opts.FileReader, nil)
+		o.CompressReader, err = bzip2.NewReader(compressed, nil)
+		if err != nil {
+			return err
+		}
+	case Lz4:
+		o.CompressReader = NewLz4Reader(compressed)
+	case S2, Snappy:
+		// The s2 reader supports also the snappy framed streams.
+		o.CompressReader = NewNopCloseReader(s2.NewReader(compressed))
+	case Lzip:
+		r, err := NewLzipReader(bufio.NewReader(compressed))
 		if err != nil {
 			return err
 		}
+		o.CompressReader = r
+	}
+
+	if o.CompressReader != nil {
+		o.CompressReader = NewDecompressReader(o.CompressReader, compressed)
 	}
 
 	return nil
@@ -206,48 +292,36 @@ func PrepareTarReader(file string, opts *TarReaderCompressionOpts) error {
 
 func PrepareTarWriter(file string, opts *TarCompressionOpts) error {
 	var err error
-	cMode := None
+	cMode := opts.Mode
+
+	if opts.UseExt {
+		cMode = None
+		if file != "-" {
+			cMode = GetCompressionMode(file)
+		}
+	}
+
+	opts.applyLevels(cMode)
+
+	err = opts.checkTuning(cMode)
+	if err != nil {
+		return err
+	}
 
 	if file == "-" {
 		// POST: Using stdout for write
 		w := bufio.NewWriter(os.Stdout)
 		opts.FileWriter = NewNopCloseWriter(w)
-
-		if !opts.UseExt {
-			cMode = opts.Mode
-		}
 	} else {
 		opts.FileWriter, err = os.Create(file)
 		if err != nil {
 			return fmt.Errorf(
 				"Error on create file %s: %s", file, err.Error())
 		}
-
-		if opts.UseExt {
-			cMode = GetCompressionMode(file)
-		} else {
-			cMode = opts.Mode
-		}
 	}
 
-	switch cMode {
-
-	case Gzip:
-		w := gzip.NewWriter(opts.FileWriter)
-		w.SetConcurrency(1<<20, runtime.NumCPU())
-		opts.CompressWriter = w
-	case Zstd:
-		opts.CompressWriter, err = zstd.NewWriter(opts.FileWriter)
-		if err != nil {
-			return err
-		}
-	case Xz:
-		opts.CompressWriter, err = xz.NewWriter(opts.FileWriter)
-		if err != nil {
-			return err
-		}
-	case Bzip2:
-		opts.CompressWriter, err = bzip2.NewWriter(opts.FileWriter, nil)
+	if cMode != None {
+		opts.CompressWriter, err = opts.newCompressWriter(cMode, opts.FileWriter)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,79 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package tools
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// CompressionStats provides the number of bytes read from the
+// compressed stream and the number of bytes decompressed.
+type CompressionStats interface {
+	CompressedBytes() int64
+	DecompressedBytes() int64
+}
+
+// CountingReader counts the bytes read from the reader. The counter
+// could be read while the reader is used by another goroutine.
+type CountingReader struct {
+	io.Reader
+	count int64
+}
+
+// DecompressReader wraps a decompressor and counts the bytes
+// read from the compressed stream and returned decompressed.
+type DecompressReader struct {
+	io.ReadCloser
+	compressed   *CountingReader
+	decompressed int64
+}
+
+func NewCountingReader(r io.Reader) *CountingReader {
+	return &CountingReader{Reader: r}
+}
+
+func (c *CountingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	atomic.AddInt64(&c.count, int64(n))
+	return n, err
+}
+
+func (c *CountingReader) Count() int64 {
+	return atomic.LoadInt64(&c.count)
+}
+
+func NewDecompressReader(r io.ReadCloser, compressed *CountingReader) *DecompressReader {
+	return &DecompressReader{
+		ReadCloser: r,
+		compressed: compressed,
+	}
+}
+
+func (d *DecompressReader) Read(p []byte) (int, error) {
+	n, err := d.ReadCloser.Read(p)
+	atomic.AddInt64(&d.decompressed, int64(n))
+	return n, err
+}
+
+func (d *DecompressReader) CompressedBytes() int64 {
+	return d.compressed.Count()
+}
+
+func (d *DecompressReader) DecompressedBytes() int64 {
+	return atomic.LoadInt64(&d.decompressed)
+}
@@ -0,0 +1,138 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package tools
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+const (
+	// Size of the buffer used to sniff the compression of the streams.
+	detectBufferSize = 64 * 1024
+	tarBlockSize     = 512
+)
+
+var (
+	gzipMagic      = []byte{0x1f, 0x8b}
+	zstdMagic      = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	xzMagic        = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	bzip2Magic     = []byte{'B', 'Z', 'h'}
+	lz4Magic       = []byte{0x04, 0x22, 0x4d, 0x18}
+	lz4LegacyMagic = []byte{0x02, 0x21, 0x4c, 0x18}
+	s2Magic        = []byte{0xff, 0x06, 0x00, 0x00, 'S', '2', 's', 'T', 'w', 'O'}
+	snappyMagic    = []byte{0xff, 0x06, 0x00, 0x00, 's', 'N', 'a', 'P', 'p', 'Y'}
+	ustarMagic     = []byte{'u', 's', 't', 'a', 'r'}
+)
+
+// BufferedReadCloser permits to peek the data of a stream
+// and to close the original stream.
+type BufferedReadCloser struct {
+	*bufio.Reader
+	closer io.Closer
+}
+
+func NewBufferedReadCloser(r io.ReadCloser) *BufferedReadCloser {
+	return &BufferedReadCloser{
+		Reader: bufio.NewReaderSize(r, detectBufferSize),
+		closer: r,
+	}
+}
+
+func (b *BufferedReadCloser) Close() error {
+	return b.closer.Close()
+}
+
+// isSkippableFrame returns true if the data begins with the magic
+// number of the skippable frames (0x184D2A50-0x184D2A5F) used by
+// both zstd and lz4.
+func isSkippableFrame(data []byte) bool {
+	if len(data) < 4 {
+		return false
+	}
+	return binary.LittleEndian.Uint32(data)&0xfffffff0 == 0x184d2a50
+}
+
+// DetectCompressionMode returns the compression of the stream
+// that begins with the data. The None mode is returned for the
+// plain tar streams and for the unknown data.
+func DetectCompressionMode(data []byte) CompressionMode {
+	// Skip the skippable frames to identify the frame format.
+	skippable := false
+	for isSkippableFrame(data) {
+		skippable = true
+		if len(data) < 8 {
+			return Zstd
+		}
+		size := int64(binary.LittleEndian.Uint32(data[4:8]))
+		if int64(len(data)) < 8+size {
+			// The next frame is not available. The skippable frames
+			// are mainly used by zstd.
+			return Zstd
+		}
+		data = data[8+size:]
+	}
+
+	switch {
+	case bytes.HasPrefix(data, zstdMagic):
+		return Zstd
+	case bytes.HasPrefix(data, lz4Magic), bytes.HasPrefix(data, lz4LegacyMagic):
+		return Lz4
+	case skippable:
+		return Zstd
+	case bytes.HasPrefix(data, gzipMagic):
+		return Gzip
+	case bytes.HasPrefix(data, xzMagic):
+		return Xz
+	case len(data) > 3 && bytes.HasPrefix(data, bzip2Magic) &&
+		data[3] >= '1' && data[3] <= '9':
+		return Bzip2
+	case bytes.HasPrefix(data, s2Magic):
+		return S2
+	case bytes.HasPrefix(data, snappyMagic):
+		return Snappy
+	case bytes.HasPrefix(data, lzipMagic):
+		return Lzip
+	}
+
+	return None
+}
+
+// IsTarHeader returns true if the data begins with a ustar, pax
+// or gnu tar header.
+func IsTarHeader(data []byte) bool {
+	return len(data) >= tarBlockSize && bytes.Equal(data[257:262], ustarMagic)
+}
+
+// PeekCompressionMode returns the compression of the stream without
+// consuming data. The second value is false if the stream is neither
+// compressed with a known format nor a ustar tar stream.
+func PeekCompressionMode(r *bufio.Reader) (CompressionMode, bool) {
+	data, _ := r.Peek(tarBlockSize)
+	if isSkippableFrame(data) {
+		data, _ = r.Peek(r.Size())
+	}
+
+	mode := DetectCompressionMode(data)
+	if mode != None {
+		return mode, true
+	}
+
+	return None, IsTarHeader(data)
+}
@@ -0,0 +1,160 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package tools_test
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+
+	. "github.com/geaaru/tar-formers/pkg/tools"
+	zstd "github.com/klauspost/compress/zstd"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/ulikunitz/xz"
+)
+
+// newSkippableFrame returns a zstd skippable frame with the size.
+func newSkippableFrame(size int) []byte {
+	ans := make([]byte, 8+size)
+	binary.LittleEndian.PutUint32(ans, 0x184d2a5e)
+	binary.LittleEndian.PutUint32(ans[4:], uint32(size))
+	return ans
+}
+
+// newTarHeader returns the first block of a tarball with the format.
+func newTarHeader(format tar.Format) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	Expect(tw.WriteHeader(&tar.Header{
+		Name: "file", Typeflag: tar.TypeReg, Mode: 0644, Size: 4, Format: format,
+	})).To(Succeed())
+	_, err := tw.Write([]byte("data"))
+	Expect(err).ToNot(HaveOccurred())
+	Expect(tw.Close()).To(Succeed())
+	return buf.Bytes()
+}
+
+// peekTestData returns the compression of the data and checks that
+// the data is not consumed.
+func peekTestData(data []byte) (CompressionMode, bool) {
+	r := bufio.NewReaderSize(bytes.NewReader(data), 64*1024)
+	mode, ok := PeekCompressionMode(r)
+
+	rest, err := io.ReadAll(r)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(rest).To(Equal(data))
+
+	return mode, ok
+}
+
+// expectCompressionMode checks the compression of the data.
+func expectCompressionMode(data []byte, mode CompressionMode) {
+	m, ok := peekTestData(data)
+	Expect(ok).To(BeTrue())
+	Expect(m).To(Equal(mode))
+}
+
+func concat(data ...[]byte) []byte {
+	return bytes.Join(data, nil)
+}
+
+var _ = Describe("Detect", func() {
+
+	DescribeTable("PeekCompressionMode",
+		func(data []byte, mode CompressionMode, ok bool) {
+			m, found := peekTestData(data)
+			Expect(m).To(Equal(mode))
+			Expect(found).To(Equal(ok))
+		},
+		Entry("gzip magic", []byte{0x1f, 0x8b, 0x08, 0x00}, Gzip, true),
+		Entry("zstd magic", []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00}, Zstd, true),
+		Entry("xz magic", []byte{0xfd, '7', 'z', 'X', 'Z', 0x00, 0x00}, Xz, true),
+		Entry("bzip2 magic", []byte("BZh91AY&SY"), Bzip2, true),
+		Entry("lz4 magic", []byte{0x04, 0x22, 0x4d, 0x18, 0x64}, Lz4, true),
+		Entry("lz4 legacy magic", []byte{0x02, 0x21, 0x4c, 0x18, 0x00}, Lz4, true),
+		Entry("s2 magic", []byte{0xff, 0x06, 0x00, 0x00, 'S', '2', 's', 'T', 'w', 'O'}, S2, true),
+		Entry("snappy magic", []byte{0xff, 0x06, 0x00, 0x00, 's', 'N', 'a', 'P', 'p', 'Y'}, Snappy, true),
+		Entry("lzip magic", []byte{'L', 'Z', 'I', 'P', 0x01}, Lzip, true),
+
+		Entry("skippable frame before zstd frame",
+			concat(newSkippableFrame(16), []byte{0x28, 0xb5, 0x2f, 0xfd}), Zstd, true),
+		Entry("skippable frames before lz4 frame",
+			concat(newSkippableFrame(0), newSkippableFrame(4), []byte{0x04, 0x22, 0x4d, 0x18}),
+			Lz4, true),
+		Entry("skippable frame larger than the buffer",
+			concat(newSkippableFrame(128*1024), []byte{0x04, 0x22, 0x4d, 0x18}), Zstd, true),
+		Entry("truncated skippable frame", newSkippableFrame(16)[:6], Zstd, true),
+		Entry("only skippable frame", newSkippableFrame(16), Zstd, true),
+
+		Entry("empty input", []byte{}, None, false),
+		Entry("input shorter than gzip magic", []byte{0x1f}, None, false),
+		Entry("input shorter than zstd magic", []byte{0x28, 0xb5, 0x2f}, None, false),
+		Entry("input shorter than xz magic", []byte{0xfd, '7', 'z'}, None, false),
+		Entry("bzip2 magic without level", []byte("BZh"), None, false),
+		Entry("bzip2 magic with invalid level", []byte("BZh0"), None, false),
+		Entry("input shorter than skippable frame", []byte{0x5e, 0x2a, 0x4d}, None, false),
+
+		Entry("ustar tarball", newTarHeader(tar.FormatUSTAR), None, true),
+		Entry("pax tarball", newTarHeader(tar.FormatPAX), None, true),
+		Entry("gnu tarball", newTarHeader(tar.FormatGNU), None, true),
+		Entry("truncated tar header", newTarHeader(tar.FormatUSTAR)[:300], None, false),
+		Entry("unknown data", bytes.Repeat([]byte("tar-formers"), 100), None, false),
+	)
+
+	Context("Compressed streams", func() {
+		data := newTarHeader(tar.FormatPAX)
+
+		It("detects the streams of the writers", func() {
+			var buf bytes.Buffer
+			gw := gzip.NewWriter(&buf)
+			_, err := gw.Write(data)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(gw.Close()).To(Succeed())
+			expectCompressionMode(buf.Bytes(), Gzip)
+
+			buf.Reset()
+			zw, err := zstd.NewWriter(&buf)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = zw.Write(data)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(zw.Close()).To(Succeed())
+			expectCompressionMode(buf.Bytes(), Zstd)
+
+			buf.Reset()
+			xw, err := xz.NewWriter(&buf)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = xw.Write(data)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(xw.Close()).To(Succeed())
+			expectCompressionMode(buf.Bytes(), Xz)
+		})
+
+		It("detects the zstd-seekable streams as zstd", func() {
+			var buf bytes.Buffer
+			zw, err := NewZstdSeekableWriter(&buf, 1024)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = zw.Write(data)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(zw.Close()).To(Succeed())
+			expectCompressionMode(buf.Bytes(), Zstd)
+		})
+	})
+})
@@ -0,0 +1,164 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package tools
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// EntitiesDb contains the users and groups read from the
+// passwd and group files of a specific root.
+type EntitiesDb struct {
+	Root string
+
+	Users  map[string]int
+	Groups map[string]int
+	Uids   map[int]string
+	Gids   map[int]string
+}
+
+func NewEntitiesDb(root string) *EntitiesDb {
+	return &EntitiesDb{
+		Root:   root,
+		Users:  make(map[string]int, 0),
+		Groups: make(map[string]int, 0),
+		Uids:   make(map[int]string, 0),
+		Gids:   make(map[int]string, 0),
+	}
+}
+
+// NewEntitiesDbFromRoot reads the files etc/passwd and etc/group
+// under the directory root. The symlinks of the paths are resolved
+// inside the root. A missing file is not an error.
+func NewEntitiesDbFromRoot(root string) (*EntitiesDb, error) {
+	ans := NewEntitiesDb(root)
+
+	passwd, err := SecureJoin(root, filepath.Join("etc", "passwd"), true)
+	if err != nil {
+		return nil, fmt.Errorf("Error on resolve passwd file under %s: %s",
+			root, err.Error())
+	}
+
+	err = ans.ReadPasswd(passwd)
+	if err != nil {
+		return nil, err
+	}
+
+	group, err := SecureJoin(root, filepath.Join("etc", "group"), true)
+	if err != nil {
+		return nil, fmt.Errorf("Error on resolve group file under %s: %s",
+			root, err.Error())
+	}
+
+	err = ans.ReadGroup(group)
+	if err != nil {
+		return nil, err
+	}
+
+	return ans, nil
+}
+
+func (e *EntitiesDb) ReadPasswd(file string) error {
+	return parseEntitiesFile(file, 3, func(name string, id int) {
+		if _, ok := e.Users[name]; !ok {
+			e.Users[name] = id
+		}
+		if _, ok := e.Uids[id]; !ok {
+			e.Uids[id] = name
+		}
+	})
+}
+
+func (e *EntitiesDb) ReadGroup(file string) error {
+	return parseEntitiesFile(file, 3, func(name string, id int) {
+		if _, ok := e.Groups[name]; !ok {
+			e.Groups[name] = id
+		}
+		if _, ok := e.Gids[id]; !ok {
+			e.Gids[id] = name
+		}
+	})
+}
+
+func (e *EntitiesDb) IsEmpty() bool {
+	return len(e.Users) == 0 && len(e.Groups) == 0
+}
+
+func (e *EntitiesDb) GetUid(user string) (int, bool) {
+	uid, ok := e.Users[user]
+	return uid, ok
+}
+
+func (e *EntitiesDb) GetGid(group string) (int, bool) {
+	gid, ok := e.Groups[group]
+	return gid, ok
+}
+
+func (e *EntitiesDb) GetUser(uid int) (string, bool) {
+	user, ok := e.Uids[uid]
+	return user, ok
+}
+
+func (e *EntitiesDb) GetGroup(gid int) (string, bool) {
+	group, ok := e.Gids[gid]
+	return group, ok
+}
+
+// parseEntitiesFile parses a file in the passwd/group format and
+// calls the callback for every valid entry with the name and the id
+// available on the field at the position idField (1-based).
+func parseEntitiesFile(file string, idField int, f func(string, int)) error {
+	fd, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("Error on open file %s: %s", file, err.Error())
+	}
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, ":")
+		if len(fields) < idField || fields[0] == "" {
+			continue
+		}
+
+		id, err := strconv.ParseUint(fields[idField-1], 10, 32)
+		if err != nil {
+			continue
+		}
+
+		f(fields[0], int(id))
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("Error on read file %s: %s", file, err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,696 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package tools
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// Implementation of the LZ4 frame format:
+// https://github.com/lz4/lz4/blob/dev/doc/lz4_Frame_format.md
+//
+// TODO: replace the codec with github.com/pierrec/lz4/v4 when the
+// module is available in the vendor directory. The codec is used
+// only by newLz4Writer and by the reader of PrepareTarReader, the
+// interoperability with the lz4 tool is checked by the tests.
+
+const (
+	lz4FrameMagicNumber  = 0x184d2204
+	lz4LegacyMagicNumber = 0x184c2102
+
+	lz4FlagVersion       = 0x40
+	lz4FlagIndependent   = 0x20
+	lz4FlagBlockChecksum = 0x10
+	lz4FlagContentSize   = 0x08
+	lz4FlagContentCheck  = 0x04
+	lz4FlagDictId        = 0x01
+
+	lz4UncompressedBit = 0x80000000
+
+	lz4MinMatch     = 4
+	lz4LastLiterals = 5
+	lz4MfLimit      = 12
+	lz4HashLog      = 16
+	lz4MaxOffset    = 65535
+	lz4WindowSize   = 64 * 1024
+	lz4LegacyBlock  = 8 * 1024 * 1024
+	// Block size used by default by the writer (4MB).
+	lz4WriterBlockId = 7
+	lz4MinBlockId    = 4
+)
+
+var ErrLz4Corrupted = errors.New("lz4: corrupted stream")
+
+func lz4BlockSize(id byte) int {
+	return 1 << (8 + 2*uint(id))
+}
+
+// Lz4Reader decompresses a stream of LZ4 frames (including the
+// legacy frames and the skippable frames).
+type Lz4Reader struct {
+	r   io.Reader
+	hdr [8]byte
+
+	inFrame  bool
+	legacy   bool
+	magic    uint32
+	hasMagic bool
+
+	independent   bool
+	blockChecksum bool
+	contentCheck  bool
+	maxBlock      int
+	digest        *xxh32
+
+	src  []byte
+	dec  []byte
+	out  []byte
+	hist []byte
+	pos  int
+}
+
+func NewLz4Reader(r io.Reader) *Lz4Reader {
+	return &Lz4Reader{r: r}
+}
+
+func (z *Lz4Reader) Close() error {
+	return nil
+}
+
+func (z *Lz4Reader) Read(p []byte) (int, error) {
+	for z.pos >= len(z.out) {
+		if err := z.nextBlock(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, z.out[z.pos:])
+	z.pos += n
+	return n, nil
+}
+
+func (z *Lz4Reader) readUint32(eofAllowed bool) (uint32, error) {
+	n, err := io.ReadFull(z.r, z.hdr[:4])
+	if err != nil {
+		if n == 0 && err == io.EOF && eofAllowed {
+			return 0, io.EOF
+		}
+		return 0, io.ErrUnexpectedEOF
+	}
+	return binary.LittleEndian.Uint32(z.hdr[:4]), nil
+}
+
+func (z *Lz4Reader) readFrameHeader() error {
+	if _, err := io.ReadFull(z.r, z.hdr[:2]); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	flg, bd := z.hdr[0], z.hdr[1]
+
+	if flg&0xc0 != lz4FlagVersion {
+		return fmt.Errorf("lz4: unsupported frame version %d", flg>>6)
+	}
+	if flg&lz4FlagDictId != 0 {
+		return errors.New("lz4: frames with dictionary are not supported")
+	}
+	id := (bd >> 4) & 0x7
+	if id < 4 {
+		return ErrLz4Corrupted
+	}
+
+	desc := []byte{flg, bd}
+	if flg&lz4FlagContentSize != 0 {
+		var size [8]byte
+		if _, err := io.ReadFull(z.r, size[:]); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		desc = append(desc, size[:]...)
+	}
+
+	if _, err := io.ReadFull(z.r, z.hdr[:1]); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	if byte(xxh32Sum(desc)>>8) != z.hdr[0] {
+		return errors.New("lz4: invalid frame header checksum")
+	}
+
+	z.independent = flg&lz4FlagIndependent != 0
+	z.blockChecksum = flg&lz4FlagBlockChecksum != 0
+	z.contentCheck = flg&lz4FlagContentCheck != 0
+	z.maxBlock = lz4BlockSize(id)
+	z.digest = newXxh32()
+	z.hist = z.hist[:0]
+
+	return nil
+}
+
+func (z *Lz4Reader) nextBlock() error {
+	z.out = z.out[:0]
+	z.pos = 0
+
+	for !z.inFrame {
+		magic := z.magic
+		if !z.hasMagic {
+			var err error
+			magic, err = z.readUint32(true)
+			if err != nil {
+				return err
+			}
+		}
+		z.hasMagic = false
+
+		switch {
+		case magic == lz4FrameMagicNumber:
+			if err := z.readFrameHeader(); err != nil {
+				return err
+			}
+			z.inFrame = true
+			z.legacy = false
+		case magic == lz4LegacyMagicNumber:
+			z.inFrame = true
+			z.legacy = true
+			z.maxBlock = lz4LegacyBlock
+			z.hist = z.hist[:0]
+		case magic&0xfffffff0 == 0x184d2a50:
+			size, err := z.readUint32(false)
+			if err != nil {
+				return err
+			}
+			if _, err := io.CopyN(io.Discard, z.r, int64(size)); err != nil {
+				return io.ErrUnexpectedEOF
+			}
+		default:
+			return errors.New("lz4: invalid magic number")
+		}
+	}
+
+	if z.legacy {
+		size, err := z.readUint32(true)
+		if err != nil {
+			return err
+		}
+
+		if size == lz4FrameMagicNumber || size == lz4LegacyMagicNumber ||
+			size&0xfffffff0 == 0x184d2a50 {
+			// POST: a new frame begins.
+			z.inFrame = false
+			z.magic = size
+			z.hasMagic = true
+			return nil
+		}
+
+		return z.readBlock(size, false)
+	}
+
+	size, err := z.readUint32(false)
+	if err != nil {
+		return err
+	}
+
+	if size == 0 {
+		// EndMark
+		z.inFrame = false
+		if z.contentCheck {
+			sum, err := z.readUint32(false)
+			if err != nil {
+				return err
+			}
+			if sum != z.digest.Sum32() {
+				return errors.New("lz4: invalid content checksum")
+			}
+		}
+		return nil
+	}
+
+	uncompressed := size&lz4UncompressedBit != 0
+	return z.readBlock(size&^lz4UncompressedBit, uncompressed)
+}
+
+func (z *Lz4Reader) readBlock(size uint32, uncompressed bool) error {
+	if int(size) > z.maxBlock+z.maxBlock/255+16 {
+		return ErrLz4Corrupted
+	}
+
+	if cap(z.src) < int(size) {
+		z.src = make([]byte, size)
+	}
+	src := z.src[:size]
+	if _, err := io.ReadFull(z.r, src); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+
+	if z.blockChecksum {
+		sum, err := z.readUint32(false)
+		if err != nil {
+			return err
+		}
+		if sum != xxh32Sum(src) {
+			return errors.New("lz4: invalid block checksum")
+		}
+	}
+
+	if uncompressed {
+		if int(size) > z.maxBlock {
+			return ErrLz4Corrupted
+		}
+		z.out = append(z.out, src...)
+	} else {
+		// The matches could refer to the previous blocks.
+		if cap(z.dec) < len(z.hist)+z.maxBlock {
+			z.dec = make([]byte, 0, len(z.hist)+z.maxBlock)
+		}
+		buf := append(z.dec[:0], z.hist...)
+
+		buf, err := lz4DecompressBlock(src, buf, len(z.hist)+z.maxBlock)
+		if err != nil {
+			return err
+		}
+		z.out = append(z.out, buf[len(z.hist):]...)
+	}
+
+	if !z.legacy && !z.independent {
+		z.hist = append(z.hist, z.out...)
+		if len(z.hist) > lz4WindowSize {
+			z.hist = append(z.hist[:0], z.hist[len(z.hist)-lz4WindowSize:]...)
+		}
+	}
+
+	if z.digest != nil && !z.legacy {
+		z.digest.Write(z.out)
+	}
+
+	return nil
+}
+
+// lz4DecompressBlock decompresses the block appending the data to dst
+// that could contain the data of the previous blocks.
+func lz4DecompressBlock(src, dst []byte, limit int) ([]byte, error) {
+	i := 0
+	for i < len(src) {
+		token := src[i]
+		i++
+
+		litLen := int(token >> 4)
+		if litLen == 15 {
+			for {
+				if i >= len(src) {
+					return nil, ErrLz4Corrupted
+				}
+				b := src[i]
+				i++
+				litLen += int(b)
+				if b != 255 {
+					break
+				}
+			}
+		}
+
+		if litLen > len(src)-i || len(dst)+litLen > limit {
+			return nil, ErrLz4Corrupted
+		}
+		dst = append(dst, src[i:i+litLen]...)
+		i += litLen
+
+		if i == len(src) {
+			// The last sequence contains only literals.
+			break
+		}
+
+		if i+2 > len(src) {
+			return nil, ErrLz4Corrupted
+		}
+		offset := int(src[i]) | int(src[i+1])<<8
+		i += 2
+
+		matchLen := int(token & 15)
+		if matchLen == 15 {
+			for {
+				if i >= len(src) {
+					return nil, ErrLz4Corrupted
+				}
+				b := src[i]
+				i++
+				matchLen += int(b)
+				if b != 255 {
+					break
+				}
+			}
+		}
+		matchLen += lz4MinMatch
+
+		if offset == 0 || offset > len(dst) || len(dst)+matchLen > limit {
+			return nil, ErrLz4Corrupted
+		}
+
+		start := len(dst) - offset
+		if offset >= matchLen {
+			dst = append(dst, dst[start:start+matchLen]...)
+		} else {
+			// Overlapped match
+			for k := 0; k < matchLen; k++ {
+				dst = append(dst, dst[start+k])
+			}
+		}
+	}
+
+	return dst, nil
+}
+
+// Lz4Writer compresses the data in a LZ4 frame with independent
+// blocks (4MB by default) and the content checksum.
+type Lz4Writer struct {
+	w      io.Writer
+	id     byte
+	buf    []byte
+	dst    []byte
+	table  []int32
+	digest *xxh32
+	header bool
+	closed bool
+}
+
+func NewLz4Writer(w io.Writer) *Lz4Writer {
+	return NewLz4WriterSize(w, 0)
+}
+
+// NewLz4WriterSize returns a writer that uses the smallest block
+// size of the format (64KB, 256KB, 1MB or 4MB) not less than the
+// size in input. With 0 the default size is used.
+func NewLz4WriterSize(w io.Writer, blockSize int) *Lz4Writer {
+	id := byte(lz4WriterBlockId)
+	if blockSize > 0 {
+		id = lz4MinBlockId
+		for id < lz4WriterBlockId && lz4BlockSize(id) < blockSize {
+			id++
+		}
+	}
+
+	size := lz4BlockSize(id)
+	return &Lz4Writer{
+		w:      w,
+		id:     id,
+		buf:    make([]byte, 0, size),
+		table:  make([]int32, 1<<lz4HashLog),
+		digest: newXxh32(),
+	}
+}
+
+func (z *Lz4Writer) writeHeader() error {
+	z.header = true
+
+	flg := byte(lz4FlagVersion | lz4FlagIndependent | lz4FlagContentCheck)
+	bd := z.id << 4
+
+	hdr := make([]byte, 7)
+	binary.LittleEndian.PutUint32(hdr, lz4FrameMagicNumber)
+	hdr[4] = flg
+	hdr[5] = bd
+	hdr[6] = byte(xxh32Sum(hdr[4:6]) >> 8)
+
+	_, err := z.w.Write(hdr)
+	return err
+}
+
+func (z *Lz4Writer) Write(p []byte) (int, error) {
+	if z.closed {
+		return 0, errors.New("lz4: write on closed writer")
+	}
+
+	n := 0
+	for len(p) > 0 {
+		free := cap(z.buf) - len(z.buf)
+		if free > len(p) {
+			free = len(p)
+		}
+		z.buf = append(z.buf, p[:free]...)
+		p = p[free:]
+		n += free
+
+		if len(z.buf) == cap(z.buf) {
+			if err := z.flushBlock(); err != nil {
+				return n, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+func (z *Lz4Writer) flushBlock() error {
+	if !z.header {
+		if err := z.writeHeader(); err != nil {
+			return err
+		}
+	}
+
+	if len(z.buf) == 0 {
+		return nil
+	}
+
+	z.digest.Write(z.buf)
+
+	for i := range z.table {
+		z.table[i] = 0
+	}
+	z.dst = lz4CompressBlock(z.buf, z.dst[:0], z.table)
+
+	var size [4]byte
+	data := z.dst
+	if len(z.dst) >= len(z.buf) {
+		// Store the block uncompressed.
+		data = z.buf
+		binary.LittleEndian.PutUint32(size[:], uint32(len(data))|lz4UncompressedBit)
+	} else {
+		binary.LittleEndian.PutUint32(size[:], uint32(len(data)))
+	}
+
+	if _, err := z.w.Write(size[:]); err != nil {
+		return err
+	}
+	if _, err := z.w.Write(data); err != nil {
+		return err
+	}
+
+	z.buf = z.buf[:0]
+	return nil
+}
+
+// Close writes the last block and the end of the frame. The
+// underlying writer is not closed.
+func (z *Lz4Writer) Close() error {
+	if z.closed {
+		return nil
+	}
+	z.closed = true
+
+	if err := z.flushBlock(); err != nil {
+		return err
+	}
+
+	var end [8]byte
+	binary.LittleEndian.PutUint32(end[4:], z.digest.Sum32())
+	_, err := z.w.Write(end[:])
+	return err
+}
+
+// lz4CompressBlock compresses the data of src with the LZ4 block
+// format using a greedy match finder.
+func lz4CompressBlock(src, dst []byte, table []int32) []byte {
+	anchor := 0
+
+	if len(src) > lz4MfLimit {
+		limit := len(src) - lz4MfLimit
+		maxEnd := len(src) - lz4LastLiterals
+
+		for i := 0; i < limit; {
+			seq := binary.LittleEndian.Uint32(src[i:])
+			h := (seq * 2654435761) >> (32 - lz4HashLog)
+			ref := int(table[h]) - 1
+			table[h] = int32(i + 1)
+
+			if ref < 0 || i-ref > lz4MaxOffset ||
+				binary.LittleEndian.Uint32(src[ref:]) != seq {
+				i++
+				continue
+			}
+
+			// Extend the match backward
+			for i > anchor && ref > 0 && src[i-1] == src[ref-1] {
+				i--
+				ref--
+			}
+
+			matchLen := lz4MinMatch
+			for i+matchLen < maxEnd && src[i+matchLen] == src[ref+matchLen] {
+				matchLen++
+			}
+
+			dst = lz4AppendSequence(dst, src[anchor:i], i-ref, matchLen)
+			i += matchLen
+			anchor = i
+		}
+	}
+
+	return lz4AppendSequence(dst, src[anchor:], 0, 0)
+}
+
+func lz4AppendLength(dst []byte, l int) []byte {
+	for l >= 255 {
+		dst = append(dst, 255)
+		l -= 255
+	}
+	return append(dst, byte(l))
+}
+
+// lz4AppendSequence appends the literals and the match to the block.
+// A zero match length is used for the last sequence.
+func lz4AppendSequence(dst, literals []byte, offset, matchLen int) []byte {
+	litLen := len(literals)
+	ml := matchLen - lz4MinMatch
+
+	token := byte(0)
+	if litLen >= 15 {
+		token = 15 << 4
+	} else {
+		token = byte(litLen << 4)
+	}
+	if matchLen > 0 {
+		if ml >= 15 {
+			token |= 15
+		} else {
+			token |= byte(ml)
+		}
+	}
+
+	dst = append(dst, token)
+	if litLen >= 15 {
+		dst = lz4AppendLength(dst, litLen-15)
+	}
+	dst = append(dst, literals...)
+
+	if matchLen > 0 {
+		dst = append(dst, byte(offset), byte(offset>>8))
+		if ml >= 15 {
+			dst = lz4AppendLength(dst, ml-15)
+		}
+	}
+
+	return dst
+}
+
+// Implementation of the xxHash32 algorithm used by the LZ4 checksums.
+const (
+	xxh32Prime1 uint32 = 2654435761
+	xxh32Prime2 uint32 = 2246822519
+	xxh32Prime3 uint32 = 3266489917
+	xxh32Prime4 uint32 = 668265263
+	xxh32Prime5 uint32 = 374761393
+)
+
+type xxh32 struct {
+	v     [4]uint32
+	mem   [16]byte
+	n     int
+	total uint64
+}
+
+func newXxh32() *xxh32 {
+	var seed uint32
+	return &xxh32{
+		v: [4]uint32{
+			seed + xxh32Prime1 + xxh32Prime2,
+			seed + xxh32Prime2,
+			seed,
+			seed - xxh32Prime1,
+		},
+	}
+}
+
+func xxh32Round(v, input uint32) uint32 {
+	return bits.RotateLeft32(v+input*xxh32Prime2, 13) * xxh32Prime1
+}
+
+func (x *xxh32) stripe(b []byte) {
+	x.v[0] = xxh32Round(x.v[0], binary.LittleEndian.Uint32(b))
+	x.v[1] = xxh32Round(x.v[1], binary.LittleEndian.Uint32(b[4:]))
+	x.v[2] = xxh32Round(x.v[2], binary.LittleEndian.Uint32(b[8:]))
+	x.v[3] = xxh32Round(x.v[3], binary.LittleEndian.Uint32(b[12:]))
+}
+
+func (x *xxh32) Write(p []byte) (int, error) {
+	n := len(p)
+	x.total += uint64(n)
+
+	if x.n > 0 {
+		c := copy(x.mem[x.n:], p)
+		x.n += c
+		p = p[c:]
+		if x.n < 16 {
+			return n, nil
+		}
+		x.stripe(x.mem[:])
+		x.n = 0
+	}
+
+	for len(p) >= 16 {
+		x.stripe(p)
+		p = p[16:]
+	}
+
+	x.n = copy(x.mem[:], p)
+	return n, nil
+}
+
+func (x *xxh32) Sum32() uint32 {
+	var h uint32
+
+	if x.total >= 16 {
+		h = bits.RotateLeft32(x.v[0], 1) + bits.RotateLeft32(x.v[1], 7) +
+			bits.RotateLeft32(x.v[2], 12) + bits.RotateLeft32(x.v[3], 18)
+	} else {
+		h = x.v[2] + xxh32Prime5
+	}
+	h += uint32(x.total)
+
+	p := x.mem[:x.n]
+	for len(p) >= 4 {
+		h += binary.LittleEndian.Uint32(p) * xxh32Prime3
+		h = bits.RotateLeft32(h, 17) * xxh32Prime4
+		p = p[4:]
+	}
+	for _, b := range p {
+		h += uint32(b) * xxh32Prime5
+		h = bits.RotateLeft32(h, 11) * xxh32Prime1
+	}
+
+	h ^= h >> 15
+	h *= xxh32Prime2
+	h ^= h >> 13
+	h *= xxh32Prime3
+	h ^= h >> 16
+
+	return h
+}
+
+func xxh32Sum(data []byte) uint32 {
+	x := newXxh32()
+	x.Write(data)
+	return x.Sum32()
+}
@@ -0,0 +1,107 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package tools_test
+
+import (
+	"bytes"
+	"io"
+
+	. "github.com/geaaru/tar-formers/pkg/tools"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func newTestLz4Writer(w io.Writer) io.WriteCloser {
+	return NewLz4WriterSize(w, 64<<10)
+}
+
+func decompressLz4(data []byte) ([]byte, error) {
+	return io.ReadAll(NewLz4Reader(bytes.NewReader(data)))
+}
+
+var _ = Describe("Lz4", func() {
+
+	Context("Round-trip", func() {
+		for name, size := range testSizes {
+			name, size := name, size
+
+			It("compresses and decompresses "+name+" data", func() {
+				data := newTestData(size)
+				out, err := decompressLz4(compressTestData(data, newTestLz4Writer))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(bytes.Equal(out, data)).To(BeTrue())
+			})
+
+			It("is decompressed by lz4 with "+name+" data", func() {
+				data := newTestData(size)
+				out := pipeCommand(compressTestData(data, newTestLz4Writer),
+					"lz4", "-d", "-c")
+				Expect(bytes.Equal(out, data)).To(BeTrue())
+			})
+		}
+
+		It("writes blocks of the default size", func() {
+			data := newTestData(5 << 20)
+			compressed := compressTestData(data, func(w io.Writer) io.WriteCloser {
+				return NewLz4Writer(w)
+			})
+
+			out, err := decompressLz4(compressed)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(bytes.Equal(out, data)).To(BeTrue())
+		})
+
+		It("detects the corrupted content checksum", func() {
+			compressed := compressTestData(newTestData(1000), newTestLz4Writer)
+			compressed[len(compressed)-1] ^= 0xff
+
+			_, err := decompressLz4(compressed)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("Interoperability", func() {
+		for _, args := range [][]string{
+			{"-c"},
+			{"-c", "-B4", "-BD"},
+			{"-c", "-B5", "--content-size", "-BX"},
+			{"-c", "-l"},
+		} {
+			args := args
+
+			It("decompresses the lz4 output with options "+args[len(args)-1], func() {
+				for name, size := range testSizes {
+					data := newTestData(size)
+					out, err := decompressLz4(pipeCommand(data, "lz4", args...))
+					Expect(err).ToNot(HaveOccurred(), name)
+					Expect(bytes.Equal(out, data)).To(BeTrue(), name)
+				}
+			})
+		}
+
+		It("decompresses concatenated frames", func() {
+			a := newTestData(1000)
+			b := newTestData(70 << 10)
+			compressed := append(compressTestData(a, newTestLz4Writer),
+				pipeCommand(b, "lz4", "-c")...)
+
+			out, err := decompressLz4(compressed)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(bytes.Equal(out, append(a, b...))).To(BeTrue())
+		})
+	})
+})
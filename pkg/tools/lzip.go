@@ -0,0 +1,321 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package tools
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// Implementation of the lzip format over the LZMA codec:
+// https://www.nongnu.org/lzip/manual/lzip_manual.html#File-format
+
+const (
+	lzipHeaderSize  = 6
+	lzipTrailerSize = 20
+	lzipMinDictSize = 1 << 12
+	lzipMaxDictSize = 1 << 29
+	// Dictionary size used by the writer (8MB, as lzip -6).
+	lzipWriterDictSize = 1 << 23
+)
+
+var lzipMagic = []byte{'L', 'Z', 'I', 'P'}
+
+// LzipReader decompresses a lzip stream with one or more members.
+type LzipReader struct {
+	r      *bufio.Reader
+	member *lzipMemberReader
+	lz     *lzma.Reader
+	crc    uint32
+	size   uint64
+	done   bool
+}
+
+// lzipMemberReader provides the LZMA header built from the lzip
+// header followed by the LZMA data of the member. The LZMA decoder
+// reads the data byte by byte and then the trailer is not consumed.
+type lzipMemberReader struct {
+	r      *bufio.Reader
+	header []byte
+	n      uint64
+}
+
+func (m *lzipMemberReader) Read(p []byte) (int, error) {
+	if len(m.header) > 0 {
+		n := copy(p, m.header)
+		m.header = m.header[n:]
+		return n, nil
+	}
+	n, err := m.r.Read(p)
+	m.n += uint64(n)
+	return n, err
+}
+
+func (m *lzipMemberReader) ReadByte() (byte, error) {
+	if len(m.header) > 0 {
+		b := m.header[0]
+		m.header = m.header[1:]
+		return b, nil
+	}
+	b, err := m.r.ReadByte()
+	if err == nil {
+		m.n++
+	}
+	return b, err
+}
+
+func NewLzipReader(r io.Reader) (*LzipReader, error) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+
+	z := &LzipReader{r: br}
+	if err := z.nextMember(); err != nil {
+		if err == io.EOF {
+			return nil, errors.New("lzip: empty stream")
+		}
+		return nil, err
+	}
+
+	return z, nil
+}
+
+func (z *LzipReader) Close() error {
+	return nil
+}
+
+func (z *LzipReader) nextMember() error {
+	header := make([]byte, lzipHeaderSize)
+	n, err := io.ReadFull(z.r, header)
+	if err != nil {
+		if n == 0 && err == io.EOF {
+			return io.EOF
+		}
+		return io.ErrUnexpectedEOF
+	}
+
+	if !bytes.Equal(header[:4], lzipMagic) {
+		return errors.New("lzip: invalid magic number")
+	}
+	if header[4] != 1 {
+		return fmt.Errorf("lzip: unsupported version %d", header[4])
+	}
+
+	dictSize := uint32(1) << (header[5] & 0x1f)
+	dictSize -= (dictSize / 16) * uint32((header[5]>>5)&0x07)
+	if dictSize < lzipMinDictSize || dictSize > lzipMaxDictSize {
+		return fmt.Errorf("lzip: invalid dictionary size %d", dictSize)
+	}
+
+	lzHeader := make([]byte, lzma.HeaderLen)
+	lzHeader[0] = lzma.Properties{LC: 3, LP: 0, PB: 2}.Code()
+	binary.LittleEndian.PutUint32(lzHeader[1:5], dictSize)
+	// Unknown size: the member ends with the EOS marker.
+	binary.LittleEndian.PutUint64(lzHeader[5:], ^uint64(0))
+
+	z.member = &lzipMemberReader{r: z.r, header: lzHeader}
+	z.lz, err = lzma.NewReader(z.member)
+	if err != nil {
+		return err
+	}
+	z.crc = 0
+	z.size = 0
+
+	return nil
+}
+
+func (z *LzipReader) checkTrailer() error {
+	trailer := make([]byte, lzipTrailerSize)
+	if _, err := io.ReadFull(z.r, trailer); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+
+	if binary.LittleEndian.Uint32(trailer) != z.crc {
+		return errors.New("lzip: invalid CRC")
+	}
+	if binary.LittleEndian.Uint64(trailer[4:]) != z.size {
+		return errors.New("lzip: invalid data size")
+	}
+	memberSize := lzipHeaderSize + z.member.n + lzipTrailerSize
+	if binary.LittleEndian.Uint64(trailer[12:]) != memberSize {
+		return errors.New("lzip: invalid member size")
+	}
+
+	return nil
+}
+
+func (z *LzipReader) Read(p []byte) (int, error) {
+	for !z.done {
+		n, err := z.lz.Read(p)
+		z.crc = crc32.Update(z.crc, crc32.IEEETable, p[:n])
+		z.size += uint64(n)
+
+		if err == io.EOF {
+			if err := z.checkTrailer(); err != nil {
+				return n, err
+			}
+
+			err = z.nextMember()
+			if err == io.EOF {
+				z.done = true
+			} else if err != nil {
+				return n, err
+			}
+		} else if err != nil {
+			return n, err
+		}
+
+		if n > 0 {
+			return n, nil
+		}
+	}
+
+	return 0, io.EOF
+}
+
+// LzipWriter compresses the data in a lzip member.
+type LzipWriter struct {
+	w    *lzipBodyWriter
+	lz   *lzma.Writer
+	crc  uint32
+	size uint64
+}
+
+// lzipBodyWriter drops the LZMA header written by the LZMA writer
+// and counts the bytes of the member.
+type lzipBodyWriter struct {
+	w    io.Writer
+	skip int
+	n    uint64
+}
+
+func (b *lzipBodyWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if b.skip > 0 {
+		s := b.skip
+		if s > len(p) {
+			s = len(p)
+		}
+		b.skip -= s
+		p = p[s:]
+	}
+
+	nw, err := b.w.Write(p)
+	b.n += uint64(nw)
+	if err != nil {
+		return n - len(p) + nw, err
+	}
+	return n, nil
+}
+
+// lzipDictSizeCode returns the coded dictionary size of the header
+// with the smallest dictionary size not less than the size in input.
+func lzipDictSizeCode(size int) (byte, int) {
+	if size < lzipMinDictSize {
+		size = lzipMinDictSize
+	}
+
+	n := 12
+	for (1<<n) < size && n < 29 {
+		n++
+	}
+
+	base := 1 << n
+	for k := 7; k > 0; k-- {
+		if n > 12 && base-(base/16)*k >= size {
+			return byte(n) | byte(k<<5), base - (base/16)*k
+		}
+	}
+	return byte(n), base
+}
+
+func NewLzipWriter(w io.Writer) (*LzipWriter, error) {
+	return NewLzipWriterSize(w, lzipWriterDictSize)
+}
+
+// NewLzipWriterSize returns a writer that uses a dictionary with
+// at least the size in input. With 0 the default size is used.
+func NewLzipWriterSize(w io.Writer, dictSize int) (*LzipWriter, error) {
+	if dictSize <= 0 {
+		dictSize = lzipWriterDictSize
+	}
+	if dictSize > lzipMaxDictSize {
+		return nil, fmt.Errorf("lzip: invalid dictionary size %d", dictSize)
+	}
+	code, dictSize := lzipDictSizeCode(dictSize)
+
+	header := append([]byte{}, lzipMagic...)
+	header = append(header, 1, code)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	z := &LzipWriter{
+		w: &lzipBodyWriter{w: w, skip: lzma.HeaderLen},
+	}
+
+	cfg := lzma.WriterConfig{
+		Properties: &lzma.Properties{LC: 3, LP: 0, PB: 2},
+		DictCap:    dictSize,
+		EOSMarker:  true,
+	}
+	lz, err := cfg.NewWriter(z.w)
+	if err != nil {
+		return nil, err
+	}
+	z.lz = lz
+
+	return z, nil
+}
+
+func (z *LzipWriter) Write(p []byte) (int, error) {
+	n, err := z.lz.Write(p)
+	z.crc = crc32.Update(z.crc, crc32.IEEETable, p[:n])
+	z.size += uint64(n)
+	return n, err
+}
+
+// Close writes the end of the LZMA stream and the trailer of the
+// member. The underlying writer is not closed.
+func (z *LzipWriter) Close() error {
+	if z.lz == nil {
+		return nil
+	}
+
+	err := z.lz.Close()
+	z.lz = nil
+	if err != nil {
+		return err
+	}
+
+	trailer := make([]byte, lzipTrailerSize)
+	binary.LittleEndian.PutUint32(trailer, z.crc)
+	binary.LittleEndian.PutUint64(trailer[4:], z.size)
+	binary.LittleEndian.PutUint64(trailer[12:],
+		lzipHeaderSize+z.w.n+lzipTrailerSize)
+
+	_, err = z.w.w.Write(trailer)
+	return err
+}
@@ -0,0 +1,146 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package tools_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+
+	. "github.com/geaaru/tar-formers/pkg/tools"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// newTestLzipWriter returns a lzip writer with a dictionary of 64KB
+// to compress the multi-block data with a window smaller than data.
+func newTestLzipWriter(w io.Writer) io.WriteCloser {
+	lw, err := NewLzipWriterSize(w, 64<<10)
+	Expect(err).ToNot(HaveOccurred())
+	return lw
+}
+
+func decompressLzip(data []byte) ([]byte, error) {
+	r, err := NewLzipReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+var _ = Describe("Lzip", func() {
+
+	Context("Round-trip", func() {
+		for name, size := range testSizes {
+			name, size := name, size
+
+			It("compresses and decompresses "+name+" data", func() {
+				data := newTestData(size)
+				out, err := decompressLzip(compressTestData(data, newTestLzipWriter))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(bytes.Equal(out, data)).To(BeTrue())
+			})
+
+			It("is decompressed by lzip with "+name+" data", func() {
+				data := newTestData(size)
+				out := pipeCommand(compressTestData(data, newTestLzipWriter),
+					"lzip", "-d", "-c")
+				Expect(bytes.Equal(out, data)).To(BeTrue())
+			})
+		}
+
+		It("decompresses multiple members", func() {
+			a := newTestData(1000)
+			b := newTestData(100 << 10)
+			compressed := append(compressTestData(a, newTestLzipWriter),
+				compressTestData(b, newTestLzipWriter)...)
+
+			out, err := decompressLzip(compressed)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(bytes.Equal(out, append(a, b...))).To(BeTrue())
+		})
+
+		It("rejects an empty stream", func() {
+			_, err := decompressLzip([]byte{})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("Header and trailer", func() {
+
+		It("writes the dictionary size in the header", func() {
+			compressed := compressTestData(newTestData(1000), newTestLzipWriter)
+			Expect(compressed[:5]).To(Equal([]byte{'L', 'Z', 'I', 'P', 1}))
+			// 64KB: 2^16 without fractions.
+			Expect(compressed[5]).To(Equal(byte(16)))
+
+			compressed = compressTestData(newTestData(1000), func(w io.Writer) io.WriteCloser {
+				lw, err := NewLzipWriterSize(w, 3<<20)
+				Expect(err).ToNot(HaveOccurred())
+				return lw
+			})
+			// 3MB: 2^22 - 4 * 2^22/16.
+			Expect(compressed[5]).To(Equal(byte(22 | 4<<5)))
+		})
+
+		for name, size := range testSizes {
+			name, size := name, size
+
+			It("writes the trailer with "+name+" data", func() {
+				data := newTestData(size)
+				compressed := compressTestData(data, newTestLzipWriter)
+				Expect(len(compressed)).To(BeNumerically(">", 26))
+
+				trailer := compressed[len(compressed)-20:]
+				Expect(binary.LittleEndian.Uint32(trailer)).To(
+					Equal(crc32.ChecksumIEEE(data)))
+				Expect(binary.LittleEndian.Uint64(trailer[4:])).To(
+					Equal(uint64(len(data))))
+				Expect(binary.LittleEndian.Uint64(trailer[12:])).To(
+					Equal(uint64(len(compressed))))
+			})
+		}
+
+		for _, field := range []struct {
+			Name   string
+			Offset int
+		}{
+			{"CRC", 0},
+			{"data size", 4},
+			{"member size", 12},
+		} {
+			field := field
+
+			It("detects the corrupted "+field.Name+" of the trailer", func() {
+				compressed := compressTestData(newTestData(1000), newTestLzipWriter)
+				compressed[len(compressed)-20+field.Offset] ^= 0x01
+
+				_, err := decompressLzip(compressed)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring(field.Name))
+			})
+		}
+
+		It("detects the truncated trailer", func() {
+			compressed := compressTestData(newTestData(1000), newTestLzipWriter)
+
+			_, err := decompressLzip(compressed[:len(compressed)-5])
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
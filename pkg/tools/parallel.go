@@ -0,0 +1,165 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package tools
+
+import (
+	"errors"
+	"io"
+)
+
+// compressedBlock is the result of the compression of a block.
+type compressedBlock struct {
+	data []byte
+	// Size of the uncompressed data.
+	size int
+	// Size of the block without the padding (used by xz).
+	unpadded int
+	err      error
+}
+
+type blockCompressFunc func(data []byte) *compressedBlock
+
+// parallelWriter splits the stream in blocks of the same size that
+// are compressed independently by the workers and written in order.
+// At most workers blocks are compressed at the same time and then
+// the memory used is bounded by the block size and the workers.
+type parallelWriter struct {
+	w         io.Writer
+	compress  blockCompressFunc
+	onBlock   func(b *compressedBlock)
+	blockSize int
+	workers   int
+	buf       []byte
+	pending   []chan *compressedBlock
+	blocks    int
+	err       error
+	closed    bool
+}
+
+func newParallelWriter(w io.Writer, compress blockCompressFunc,
+	blockSize, workers int) *parallelWriter {
+	if workers <= 0 {
+		workers = 1
+	}
+	return &parallelWriter{
+		w:         w,
+		compress:  compress,
+		blockSize: blockSize,
+		workers:   workers,
+		pending:   []chan *compressedBlock{},
+	}
+}
+
+func (p *parallelWriter) Write(data []byte) (int, error) {
+	if p.closed {
+		return 0, errors.New("write on closed writer")
+	}
+	if p.err != nil {
+		return 0, p.err
+	}
+
+	n := 0
+	for len(data) > 0 {
+		if p.buf == nil {
+			p.buf = make([]byte, 0, p.blockSize)
+		}
+
+		free := cap(p.buf) - len(p.buf)
+		if free > len(data) {
+			free = len(data)
+		}
+		p.buf = append(p.buf, data[:free]...)
+		data = data[free:]
+		n += free
+
+		if len(p.buf) == cap(p.buf) {
+			if err := p.submit(); err != nil {
+				return n, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// submit starts the compression of the current block.
+func (p *parallelWriter) submit() error {
+	if len(p.pending) == p.workers {
+		if err := p.writeBlock(); err != nil {
+			return err
+		}
+	}
+
+	block := p.buf
+	p.buf = nil
+
+	ch := make(chan *compressedBlock, 1)
+	p.pending = append(p.pending, ch)
+	go func() {
+		ch <- p.compress(block)
+	}()
+
+	return nil
+}
+
+// writeBlock waits the oldest block and writes it.
+func (p *parallelWriter) writeBlock() error {
+	b := <-p.pending[0]
+	p.pending = p.pending[1:]
+
+	if b.err != nil {
+		p.err = b.err
+		return b.err
+	}
+
+	if _, err := p.w.Write(b.data); err != nil {
+		p.err = err
+		return err
+	}
+	p.blocks++
+
+	if p.onBlock != nil {
+		p.onBlock(b)
+	}
+
+	return nil
+}
+
+// Close compresses the last block and waits for all the blocks.
+// The underlying writer is not closed.
+func (p *parallelWriter) Close() error {
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+
+	if p.err == nil && len(p.buf) > 0 {
+		p.submit()
+	}
+
+	for len(p.pending) > 0 {
+		if p.err != nil {
+			// Drain the workers.
+			<-p.pending[0]
+			p.pending = p.pending[1:]
+			continue
+		}
+		p.writeBlock()
+	}
+
+	return p.err
+}
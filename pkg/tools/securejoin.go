@@ -0,0 +1,192 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package tools
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Max number of symlinks followed on resolve a path.
+const maxSymlinksResolved = 255
+
+// IsPathEscaping returns true if the path, lexically cleaned, goes
+// outside of the directory where it's joined.
+func IsPathEscaping(path string) bool {
+	if filepath.IsAbs(path) {
+		// An absolute path is always joined to the root.
+		return false
+	}
+	p := filepath.Clean(path)
+	return p == ".." || strings.HasPrefix(p, "../")
+}
+
+// SecureJoin joins the path unsafePath to the directory root resolving
+// all symlinks of the parent directories inside the root, like the
+// openat2 RESOLVE_IN_ROOT semantics. Absolute symlinks are resolved
+// relative to the root and the .. components never go over the root.
+// If followLast is true also the last component is resolved when
+// it's a symlink.
+func SecureJoin(root, unsafePath string, followLast bool) (string, error) {
+	root = filepath.Clean(root)
+
+	parent, last := filepath.Split(filepath.Clean("/" + unsafePath))
+	if last == "" {
+		// POST: the path is the root
+		return root, nil
+	}
+
+	ans, err := secureJoinOpenat2(root, parent)
+	if err != nil {
+		// Fallback to the userspace resolution.
+		ans, err = secureJoinUserspace(root, parent, true)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if !followLast {
+		return filepath.Join(ans, last), nil
+	}
+
+	// Resolve the last element from the resolved parent.
+	return secureJoinUserspace(root,
+		filepath.Join(strings.TrimPrefix(ans, root), last), true)
+}
+
+// secureJoinOpenat2 resolves the directory unsafeDir under root through
+// the openat2 syscall. It returns an error if the syscall is not
+// available or if the directory doesn't exist.
+func secureJoinOpenat2(root, unsafeDir string) (string, error) {
+	unsafeDir = strings.TrimPrefix(filepath.Clean(unsafeDir), "/")
+	if unsafeDir == "" {
+		return root, nil
+	}
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+
+	rootFd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return "", err
+	}
+	defer unix.Close(rootFd)
+
+	fd, err := unix.Openat2(rootFd, unsafeDir, &unix.OpenHow{
+		Flags:   unix.O_PATH | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_IN_ROOT | unix.RESOLVE_NO_MAGICLINKS,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer unix.Close(fd)
+
+	realPath, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", fd))
+	if err != nil {
+		return "", err
+	}
+
+	if realPath == realRoot {
+		return root, nil
+	}
+
+	if !strings.HasPrefix(realPath, realRoot+"/") {
+		return "", fmt.Errorf("Path %s resolved outside of the root %s",
+			unsafeDir, root)
+	}
+
+	return filepath.Join(root, strings.TrimPrefix(realPath, realRoot)), nil
+}
+
+// secureJoinUserspace resolves the path unsafePath under root following
+// the symlinks and maintaining every component inside the root.
+func secureJoinUserspace(root, unsafePath string, followLast bool) (string, error) {
+	resolved := "/"
+	nSymlinks := 0
+
+	for unsafePath != "" {
+		var c string
+
+		if i := strings.IndexRune(unsafePath, '/'); i == -1 {
+			c, unsafePath = unsafePath, ""
+		} else {
+			c, unsafePath = unsafePath[:i], unsafePath[i+1:]
+		}
+
+		if c == "" || c == "." {
+			continue
+		}
+
+		// NOTE: resolved doesn't contain symlinks so the
+		//       lexical resolution of .. is correct.
+		next := filepath.Join(resolved, c)
+		if next == "/" {
+			resolved = next
+			continue
+		}
+
+		if unsafePath == "" && !followLast {
+			resolved = next
+			break
+		}
+
+		fullPath := filepath.Join(root, next)
+		info, err := os.Lstat(fullPath)
+		if err != nil {
+			if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+				// The path doesn't exist. The next components
+				// are joined as is.
+				resolved = next
+				continue
+			}
+			return "", err
+		}
+
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		nSymlinks++
+		if nSymlinks > maxSymlinksResolved {
+			return "", &os.PathError{
+				Op: "securejoin", Path: filepath.Join(root, unsafePath),
+				Err: syscall.ELOOP,
+			}
+		}
+
+		dest, err := os.Readlink(fullPath)
+		if err != nil {
+			return "", err
+		}
+
+		if filepath.IsAbs(dest) {
+			resolved = "/"
+		}
+		unsafePath = dest + "/" + unsafePath
+	}
+
+	return filepath.Join(root, resolved), nil
+}
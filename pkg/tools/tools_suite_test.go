@@ -0,0 +1,87 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package tools_test
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os/exec"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestTools(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Tools Suite")
+}
+
+// newTestData returns n bytes of data with both compressible and
+// random parts.
+func newTestData(n int) []byte {
+	ans := make([]byte, 0, n)
+	r := rand.New(rand.NewSource(int64(n)))
+	line := []byte("tar-formers compression test line\n")
+
+	for len(ans) < n {
+		chunk := make([]byte, 256)
+		r.Read(chunk)
+		ans = append(ans, chunk...)
+		for i := 0; i < 8; i++ {
+			ans = append(ans, line...)
+		}
+	}
+
+	return ans[:n]
+}
+
+// pipeCommand runs the command with the input in the stdin and returns
+// the stdout. The test is skipped if the command is not available.
+func pipeCommand(input []byte, name string, args ...string) []byte {
+	if _, err := exec.LookPath(name); err != nil {
+		Skip(name + " not available.")
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	Expect(err).ToNot(HaveOccurred(), stderr.String())
+
+	return out
+}
+
+// compressTestData compresses the data with the writer of w.
+func compressTestData(data []byte, newWriter func(w io.Writer) io.WriteCloser) []byte {
+	var buf bytes.Buffer
+	w := newWriter(&buf)
+	_, err := w.Write(data)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(w.Close()).To(Succeed())
+	return buf.Bytes()
+}
+
+// testSizes are the sizes of the data used by the round-trip tests.
+var testSizes = map[string]int{
+	"empty":       0,
+	"sub-block":   1000,
+	"multi-block": 700 << 10,
+}
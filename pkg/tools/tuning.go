@@ -0,0 +1,375 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package tools
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"runtime"
+	"strconv"
+	"strings"
+
+	s2 "github.com/klauspost/compress/s2"
+	zstd "github.com/klauspost/compress/zstd"
+	gzip "github.com/klauspost/pgzip"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// Level used when the compression level is not defined.
+const DefaultLevel = -1
+
+// Dictionary sizes of the xz presets 0-9.
+var xzPresetDictCaps = []int{
+	256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20,
+	8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20,
+}
+
+// Dictionary sizes of the lzip levels 0-9.
+var lzipLevelDictSizes = []int{
+	64 << 10, 1 << 20, 3 << 19, 2 << 20, 3 << 20,
+	4 << 20, 8 << 20, 16 << 20, 24 << 20, 32 << 20,
+}
+
+// ParseCompression parses the compression in the format
+// <mode>[:<level>[e]], for example zstd:19, xz:9e or gz:1.
+// With an empty mode (for example :9) the mode is selected
+// by the extension of the file and the level is validated
+// on prepare the writer.
+func (o *TarCompressionOpts) ParseCompression(s string) error {
+	mode, level, found := strings.Cut(s, ":")
+
+	if mode != "" {
+		o.UseExt = false
+		o.Mode = ParseCompressionMode(mode)
+		if o.Mode == None && mode != string(None) {
+			return fmt.Errorf("Invalid compression %s", mode)
+		}
+	} else if !found {
+		return errors.New("Invalid empty compression")
+	}
+
+	if found {
+		// The extreme presets of xz are accepted for compatibility,
+		// but the encoder doesn't have a slower mode: only the
+		// dictionary size of the level is used.
+		if strings.HasSuffix(level, "e") {
+			o.Extreme = true
+			level = strings.TrimSuffix(level, "e")
+		}
+
+		l, err := strconv.Atoi(level)
+		if err != nil || l < 0 {
+			return fmt.Errorf("Invalid compression level %s", level)
+		}
+		o.Level = l
+
+		if mode != "" {
+			return o.checkLevelMode(o.Mode)
+		}
+	}
+
+	return nil
+}
+
+// SetLevels sets the compression level of the modes. The levels
+// already defined for the same modes are replaced.
+func (o *TarCompressionOpts) SetLevels(levels map[string]int) error {
+	for mode, level := range levels {
+		m := ParseCompressionMode(mode)
+		if m == None || m == Auto {
+			return fmt.Errorf("Invalid compression %s of the levels", mode)
+		}
+		if level < 0 {
+			return fmt.Errorf("Invalid level %d for %s compression", level, m)
+		}
+
+		if o.Levels == nil {
+			o.Levels = make(map[CompressionMode]int)
+		}
+		o.Levels[m] = level
+	}
+
+	return nil
+}
+
+// applyLevels sets the level of the mode if the level is not
+// defined. The levels of zstd are used also for zstd-seekable.
+func (o *TarCompressionOpts) applyLevels(mode CompressionMode) {
+	if o.Level != DefaultLevel {
+		return
+	}
+
+	if l, ok := o.Levels[mode]; ok {
+		o.Level = l
+	} else if l, ok := o.Levels[Zstd]; ok && mode == ZstdSeekable {
+		o.Level = l
+	}
+}
+
+// SetTuning sets the tuning of the compression. The zero values
+// are ignored (then the level 0 of xz and lzip is available only
+// with ParseCompression).
+func (o *TarCompressionOpts) SetTuning(level, workers, windowSize, blockSize int) {
+	if level > 0 {
+		o.Level = level
+	}
+	if workers > 0 {
+		o.Workers = workers
+	}
+	if windowSize > 0 {
+		o.WindowSize = windowSize
+	}
+	if blockSize > 0 {
+		o.BlockSize = blockSize
+	}
+}
+
+func (o *TarCompressionOpts) getWorkers() int {
+	if o.Workers > 0 {
+		return o.Workers
+	}
+	return runtime.NumCPU()
+}
+
+func (o *TarCompressionOpts) checkLevel(mode CompressionMode, min, max int) error {
+	if o.Level != DefaultLevel && (o.Level < min || o.Level > max) {
+		return fmt.Errorf("Invalid level %d for %s compression (%d-%d)",
+			o.Level, mode, min, max)
+	}
+	return nil
+}
+
+// checkLevelMode validates the level and the extreme preset
+// with the mode.
+func (o *TarCompressionOpts) checkLevelMode(mode CompressionMode) error {
+	if o.Extreme && mode != Xz {
+		return fmt.Errorf("The extreme level is not supported by %s compression",
+			mode)
+	}
+
+	if mode == None && o.Level != DefaultLevel {
+		return errors.New("The level is not supported without compression")
+	}
+
+	return nil
+}
+
+// checkTuning validates the tuning options for the compression.
+func (o *TarCompressionOpts) checkTuning(mode CompressionMode) error {
+	if o.Workers < 0 || o.WindowSize < 0 || o.BlockSize < 0 {
+		return fmt.Errorf("Invalid negative tuning value for %s compression", mode)
+	}
+
+	err := o.checkLevelMode(mode)
+	if err != nil {
+		return err
+	}
+
+	switch mode {
+	case Gzip:
+		return o.checkLevel(mode, 1, 9)
+	case Zstd, ZstdSeekable:
+		if mode == ZstdSeekable && o.BlockSize*zstdSeekableMaxFrameFactor > zstdSeekableMaxFrameSize {
+			return fmt.Errorf("Invalid block size %d for %s compression (max 256MB)",
+				o.BlockSize, mode)
+		}
+		if o.WindowSize > 0 && (o.WindowSize < zstd.MinWindowSize ||
+			o.WindowSize > zstd.MaxWindowSize || bits.OnesCount(uint(o.WindowSize)) != 1) {
+			return fmt.Errorf("Invalid window size %d for %s compression: "+
+				"it must be a power of 2 between %d and %d", o.WindowSize, mode,
+				zstd.MinWindowSize, zstd.MaxWindowSize)
+		}
+		return o.checkLevel(mode, 1, 22)
+	case Xz:
+		if o.WindowSize > 0 && o.WindowSize < lzma.MinDictCap {
+			return fmt.Errorf("Invalid window size %d for %s compression",
+				o.WindowSize, mode)
+		}
+		return o.checkLevel(mode, 0, 9)
+	case Bzip2:
+		return o.checkLevel(mode, 1, 9)
+	case Lz4:
+		if o.BlockSize > lz4BlockSize(lz4WriterBlockId) {
+			return fmt.Errorf("Invalid block size %d for %s compression (max 4MB)",
+				o.BlockSize, mode)
+		}
+		if o.Level != DefaultLevel {
+			return fmt.Errorf("The level is not supported by %s compression", mode)
+		}
+	case S2, Snappy:
+		if o.BlockSize > 0 && (o.BlockSize < 4<<10 || o.BlockSize > 4<<20) {
+			return fmt.Errorf("Invalid block size %d for %s compression (4KB-4MB)",
+				o.BlockSize, mode)
+		}
+		if mode == Snappy && o.BlockSize > 64<<10 {
+			return fmt.Errorf("Invalid block size %d for %s compression (max 64KB)",
+				o.BlockSize, mode)
+		}
+		return o.checkLevel(mode, 1, 3)
+	case Lzip:
+		if o.WindowSize > 0 && (o.WindowSize < lzipMinDictSize ||
+			o.WindowSize > lzipMaxDictSize) {
+			return fmt.Errorf("Invalid window size %d for %s compression",
+				o.WindowSize, mode)
+		}
+		return o.checkLevel(mode, 0, 9)
+	}
+
+	return nil
+}
+
+func (o *TarCompressionOpts) newGzipWriter(w io.Writer) (io.WriteCloser, error) {
+	level := gzip.DefaultCompression
+	if o.Level != DefaultLevel {
+		level = o.Level
+	}
+
+	gw, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return nil, err
+	}
+
+	blockSize := 1 << 20
+	if o.BlockSize > 0 {
+		blockSize = o.BlockSize
+	}
+
+	err = gw.SetConcurrency(blockSize, o.getWorkers())
+	if err != nil {
+		return nil, err
+	}
+
+	return gw, nil
+}
+
+func (o *TarCompressionOpts) getZstdOptions() []zstd.EOption {
+	zopts := []zstd.EOption{}
+
+	if o.Level != DefaultLevel {
+		zopts = append(zopts,
+			zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(o.Level)))
+	}
+	if o.Reproducible {
+		zopts = append(zopts, zstd.WithEncoderConcurrency(1))
+	} else if o.Workers > 0 {
+		zopts = append(zopts, zstd.WithEncoderConcurrency(o.Workers))
+	}
+	if o.WindowSize > 0 {
+		zopts = append(zopts, zstd.WithWindowSize(o.WindowSize))
+	}
+
+	return zopts
+}
+
+func (o *TarCompressionOpts) newZstdWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w, o.getZstdOptions()...)
+}
+
+func (o *TarCompressionOpts) newZstdSeekableWriter(w io.Writer) (io.WriteCloser, error) {
+	return NewZstdSeekableWriter(w, o.BlockSize, o.getZstdOptions()...)
+}
+
+func (o *TarCompressionOpts) newXzWriter(w io.Writer) (io.WriteCloser, error) {
+	dictCap := 0
+	if o.Level != DefaultLevel {
+		dictCap = xzPresetDictCaps[o.Level]
+	}
+	if o.WindowSize > 0 {
+		dictCap = o.WindowSize
+	}
+
+	return NewParallelXzWriter(w, dictCap, o.BlockSize, o.getWorkers())
+}
+
+func (o *TarCompressionOpts) newBzip2Writer(w io.Writer) (io.WriteCloser, error) {
+	level := 0
+	if o.Level != DefaultLevel {
+		level = o.Level
+	}
+
+	return NewParallelBzip2Writer(w, level, o.BlockSize, o.getWorkers()), nil
+}
+
+func (o *TarCompressionOpts) newLz4Writer(w io.Writer) (io.WriteCloser, error) {
+	return NewLz4WriterSize(w, o.BlockSize), nil
+}
+
+func (o *TarCompressionOpts) newS2Writer(w io.Writer, snappy bool) (io.WriteCloser, error) {
+	sopts := []s2.WriterOption{}
+
+	if snappy {
+		sopts = append(sopts, s2.WriterSnappyCompat())
+	}
+
+	switch o.Level {
+	case 2:
+		sopts = append(sopts, s2.WriterBetterCompression())
+	case 3:
+		sopts = append(sopts, s2.WriterBestCompression())
+	}
+
+	if o.Reproducible {
+		sopts = append(sopts, s2.WriterConcurrency(1))
+	} else if o.Workers > 0 {
+		sopts = append(sopts, s2.WriterConcurrency(o.Workers))
+	}
+	if o.BlockSize > 0 {
+		sopts = append(sopts, s2.WriterBlockSize(o.BlockSize))
+	}
+
+	return s2.NewWriter(w, sopts...), nil
+}
+
+func (o *TarCompressionOpts) newLzipWriter(w io.Writer) (io.WriteCloser, error) {
+	dictSize := 0
+	if o.Level != DefaultLevel {
+		dictSize = lzipLevelDictSizes[o.Level]
+	}
+	if o.WindowSize > 0 {
+		dictSize = o.WindowSize
+	}
+
+	return NewLzipWriterSize(w, dictSize)
+}
+
+// newCompressWriter returns the writer of the compression.
+func (o *TarCompressionOpts) newCompressWriter(mode CompressionMode, w io.Writer) (io.WriteCloser, error) {
+	switch mode {
+	case Gzip:
+		return o.newGzipWriter(w)
+	case Zstd:
+		return o.newZstdWriter(w)
+	case ZstdSeekable:
+		return o.newZstdSeekableWriter(w)
+	case Xz:
+		return o.newXzWriter(w)
+	case Bzip2:
+		return o.newBzip2Writer(w)
+	case Lz4:
+		return o.newLz4Writer(w)
+	case S2:
+		return o.newS2Writer(w, false)
+	case Snappy:
+		return o.newS2Writer(w, true)
+	case Lzip:
+		return o.newLzipWriter(w)
+	}
+
+	return nil, nil
+}
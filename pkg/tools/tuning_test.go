@@ -0,0 +1,156 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package tools_test
+
+import (
+	"path/filepath"
+
+	. "github.com/geaaru/tar-formers/pkg/tools"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// prepareTestWriter prepares the writer of the file under a temporary
+// directory and returns the level used.
+func prepareTestWriter(opts *TarCompressionOpts, file string) (int, error) {
+	err := PrepareTarWriter(filepath.Join(GinkgoT().TempDir(), file), opts)
+	opts.Close()
+	return opts.Level, err
+}
+
+var _ = Describe("Tuning", func() {
+
+	DescribeTable("ParseCompression",
+		func(s string, mode CompressionMode, useExt bool, level int, extreme bool) {
+			opts := NewTarCompressionOpts(true)
+			Expect(opts.ParseCompression(s)).To(Succeed())
+			Expect(opts.Mode).To(Equal(mode))
+			Expect(opts.UseExt).To(Equal(useExt))
+			Expect(opts.Level).To(Equal(level))
+			Expect(opts.Extreme).To(Equal(extreme))
+		},
+		Entry("mode", "zstd", Zstd, false, DefaultLevel, false),
+		Entry("mode and level", "zstd:19", Zstd, false, 19, false),
+		Entry("extreme preset of xz", "xz:9e", Xz, false, 9, true),
+		Entry("level of the extension", ":9", CompressionMode(""), true, 9, false),
+		Entry("extreme preset of the extension", ":6e", CompressionMode(""), true, 6, true),
+	)
+
+	DescribeTable("ParseCompression errors",
+		func(s string) {
+			opts := NewTarCompressionOpts(true)
+			Expect(opts.ParseCompression(s)).ToNot(Succeed())
+		},
+		Entry("empty mode and level", ":"),
+		Entry("empty extreme level", ":e"),
+		Entry("invalid mode", "foo:1"),
+		Entry("invalid level", "gz:x"),
+		Entry("negative level", "gz:-1"),
+		Entry("extreme preset of gz", "gz:9e"),
+		Entry("extreme preset of zstd", "zstd:19e"),
+		Entry("level without compression", "none:1"),
+	)
+
+	DescribeTable("Level of the extension",
+		func(s, file string, valid bool) {
+			opts := NewTarCompressionOpts(true)
+			Expect(opts.ParseCompression(s)).To(Succeed())
+			_, err := prepareTestWriter(opts, file)
+			if valid {
+				Expect(err).ToNot(HaveOccurred())
+			} else {
+				Expect(err).To(HaveOccurred())
+			}
+		},
+		Entry("extreme preset of xz", ":9e", "test.tar.xz", true),
+		Entry("extreme preset of gz", ":9e", "test.tar.gz", false),
+		Entry("extreme preset of zstd", ":3e", "test.tar.zst", false),
+		Entry("level of gz", ":9", "test.tar.gz", true),
+		Entry("level out of the range of gz", ":19", "test.tar.gz", false),
+		Entry("level without compression", ":9", "test.tar", false),
+	)
+
+	Context("Levels per mode", func() {
+
+		It("uses the level of the mode of the tarball", func() {
+			newOpts := func() *TarCompressionOpts {
+				opts := NewTarCompressionOpts(true)
+				Expect(opts.SetLevels(map[string]int{"zstd": 19, "gzip": 9})).To(Succeed())
+				return opts
+			}
+
+			level, err := prepareTestWriter(newOpts(), "test.tar.zst")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(level).To(Equal(19))
+
+			level, err = prepareTestWriter(newOpts(), "test.tar.gz")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(level).To(Equal(9))
+
+			// The level of zstd isn't used for the other modes.
+			level, err = prepareTestWriter(newOpts(), "test.tar.bz2")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(level).To(Equal(DefaultLevel))
+
+			level, err = prepareTestWriter(newOpts(), "test.tar.lz4")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(level).To(Equal(DefaultLevel))
+
+			level, err = prepareTestWriter(newOpts(), "test.tar")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(level).To(Equal(DefaultLevel))
+		})
+
+		It("uses the level of zstd for zstd-seekable", func() {
+			opts := NewTarCompressionOpts(true)
+			Expect(opts.SetLevels(map[string]int{"zstd": 19})).To(Succeed())
+			Expect(opts.ParseCompression("zstd-seekable")).To(Succeed())
+
+			level, err := prepareTestWriter(opts, "test.tar.zst")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(level).To(Equal(19))
+		})
+
+		It("uses the level of the compression option", func() {
+			opts := NewTarCompressionOpts(true)
+			Expect(opts.SetLevels(map[string]int{"gz": 9})).To(Succeed())
+			Expect(opts.ParseCompression(":1")).To(Succeed())
+
+			level, err := prepareTestWriter(opts, "test.tar.gz")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(level).To(Equal(1))
+		})
+
+		It("replaces the levels of the same mode", func() {
+			opts := NewTarCompressionOpts(true)
+			Expect(opts.SetLevels(map[string]int{"zstd": 19, "xz": 6})).To(Succeed())
+			Expect(opts.SetLevels(map[string]int{"zst": 3})).To(Succeed())
+			Expect(opts.Levels).To(Equal(map[CompressionMode]int{Zstd: 3, Xz: 6}))
+		})
+
+		It("rejects the invalid levels", func() {
+			opts := NewTarCompressionOpts(true)
+			Expect(opts.SetLevels(map[string]int{"foo": 1})).ToNot(Succeed())
+			Expect(opts.SetLevels(map[string]int{"auto": 1})).ToNot(Succeed())
+			Expect(opts.SetLevels(map[string]int{"gz": -1})).ToNot(Succeed())
+
+			Expect(opts.SetLevels(map[string]int{"gz": 19})).To(Succeed())
+			_, err := prepareTestWriter(opts, "test.tar.gz")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
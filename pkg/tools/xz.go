@@ -0,0 +1,245 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package tools
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// Implementation of a xz writer that compresses the blocks of
+// the stream in parallel:
+// https://tukaani.org/xz/xz-file-format.txt
+
+const (
+	xzFlagCrc64      = 0x04
+	xzFilterLzma2    = 0x21
+	xzBlockCheckSize = 8
+	// Minimum size of the blocks (the xz default is 3 times
+	// the dictionary size).
+	xzMinBlockSize     = 1 << 20
+	xzDefaultDictCap   = 8 << 20
+	xzBlockSizeFlag    = 0x40
+	xzUncompressedFlag = 0x80
+)
+
+var (
+	xzHeaderMagic = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	xzFooterMagic = []byte{'Y', 'Z'}
+	xzCrc64Table  = crc64.MakeTable(crc64.ECMA)
+)
+
+type xzIndexRecord struct {
+	unpadded     uint64
+	uncompressed uint64
+}
+
+// ParallelXzWriter writes a xz stream with the blocks compressed
+// in parallel. Every block contains the compressed and the
+// uncompressed size and then it could be decompressed in parallel
+// too.
+type ParallelXzWriter struct {
+	*parallelWriter
+	w       io.Writer
+	dictCap int
+	header  bool
+	records []xzIndexRecord
+}
+
+// NewParallelXzWriter returns a writer that compresses the blocks of
+// blockSize bytes with the workers. With 0 the default dictionary
+// capacity (8MB) and the default block size (3 times the dictionary)
+// are used.
+func NewParallelXzWriter(w io.Writer, dictCap, blockSize, workers int) (*ParallelXzWriter, error) {
+	if dictCap <= 0 {
+		dictCap = xzDefaultDictCap
+	}
+	if blockSize <= 0 {
+		blockSize = 3 * dictCap
+		if blockSize < xzMinBlockSize {
+			blockSize = xzMinBlockSize
+		}
+	}
+
+	z := &ParallelXzWriter{
+		w:       w,
+		dictCap: dictCap,
+		records: []xzIndexRecord{},
+	}
+
+	// The dictionary isn't bigger than the block.
+	if z.dictCap > blockSize {
+		z.dictCap = blockSize
+	}
+	if z.dictCap < lzma.MinDictCap {
+		z.dictCap = lzma.MinDictCap
+	}
+
+	cfg := lzma.Writer2Config{DictCap: z.dictCap}
+	if err := cfg.Verify(); err != nil {
+		return nil, err
+	}
+
+	z.parallelWriter = newParallelWriter(&xzStreamWriter{z}, z.compressBlock,
+		blockSize, workers)
+	z.parallelWriter.onBlock = func(b *compressedBlock) {
+		z.records = append(z.records, xzIndexRecord{
+			unpadded:     uint64(b.unpadded),
+			uncompressed: uint64(b.size),
+		})
+	}
+
+	return z, nil
+}
+
+// xzStreamWriter writes the stream header before the first block.
+type xzStreamWriter struct {
+	z *ParallelXzWriter
+}
+
+func (s *xzStreamWriter) Write(p []byte) (int, error) {
+	if err := s.z.writeHeader(); err != nil {
+		return 0, err
+	}
+	return s.z.w.Write(p)
+}
+
+func xzStreamFlags() []byte {
+	return []byte{0x00, xzFlagCrc64}
+}
+
+func xzPutUvarint(buf *bytes.Buffer, v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	buf.Write(b[:n])
+}
+
+func xzPadding(n int) int {
+	return (4 - n%4) % 4
+}
+
+func (z *ParallelXzWriter) writeHeader() error {
+	if z.header {
+		return nil
+	}
+	z.header = true
+
+	hdr := append([]byte{}, xzHeaderMagic...)
+	flags := xzStreamFlags()
+	hdr = append(hdr, flags...)
+	hdr = binary.LittleEndian.AppendUint32(hdr, crc32.ChecksumIEEE(flags))
+
+	_, err := z.w.Write(hdr)
+	return err
+}
+
+func (z *ParallelXzWriter) compressBlock(data []byte) *compressedBlock {
+	ans := &compressedBlock{size: len(data)}
+
+	dictCap := z.dictCap
+	if len(data) < dictCap {
+		dictCap = len(data)
+		if dictCap < lzma.MinDictCap {
+			dictCap = lzma.MinDictCap
+		}
+	}
+
+	var comp bytes.Buffer
+	lz, err := lzma.Writer2Config{DictCap: dictCap}.NewWriter2(&comp)
+	if err == nil {
+		_, err = lz.Write(data)
+	}
+	if err == nil {
+		err = lz.Close()
+	}
+	if err != nil {
+		ans.err = err
+		return ans
+	}
+
+	// Block header
+	var hdr bytes.Buffer
+	hdr.WriteByte(0)
+	hdr.WriteByte(xzBlockSizeFlag | xzUncompressedFlag)
+	xzPutUvarint(&hdr, uint64(comp.Len()))
+	xzPutUvarint(&hdr, uint64(len(data)))
+	hdr.WriteByte(xzFilterLzma2)
+	hdr.WriteByte(1)
+	hdr.WriteByte(lzma.EncodeDictCap(int64(dictCap)))
+	hdr.Write(make([]byte, xzPadding(hdr.Len())))
+	header := hdr.Bytes()
+	header[0] = byte((len(header)+4)/4 - 1)
+	header = binary.LittleEndian.AppendUint32(header, crc32.ChecksumIEEE(header))
+
+	block := make([]byte, 0, len(header)+comp.Len()+3+xzBlockCheckSize)
+	block = append(block, header...)
+	block = append(block, comp.Bytes()...)
+	block = append(block, make([]byte, xzPadding(comp.Len()))...)
+	block = binary.LittleEndian.AppendUint64(block, crc64.Checksum(data, xzCrc64Table))
+
+	ans.data = block
+	ans.unpadded = len(header) + comp.Len() + xzBlockCheckSize
+
+	return ans
+}
+
+// Close writes the last block, the index and the footer of the
+// stream. The underlying writer is not closed.
+func (z *ParallelXzWriter) Close() error {
+	if z.parallelWriter.closed {
+		return nil
+	}
+
+	err := z.parallelWriter.Close()
+	if err != nil {
+		return err
+	}
+
+	if err = z.writeHeader(); err != nil {
+		return err
+	}
+
+	// Index
+	var index bytes.Buffer
+	index.WriteByte(0)
+	xzPutUvarint(&index, uint64(len(z.records)))
+	for _, r := range z.records {
+		xzPutUvarint(&index, r.unpadded)
+		xzPutUvarint(&index, r.uncompressed)
+	}
+	index.Write(make([]byte, xzPadding(index.Len())))
+	indexData := binary.LittleEndian.AppendUint32(index.Bytes(),
+		crc32.ChecksumIEEE(index.Bytes()))
+
+	// Footer
+	footer := binary.LittleEndian.AppendUint32(nil, uint32(len(indexData)/4-1))
+	footer = append(footer, xzStreamFlags()...)
+	footer = append(binary.LittleEndian.AppendUint32(nil, crc32.ChecksumIEEE(footer)),
+		footer...)
+	footer = append(footer, xzFooterMagic...)
+
+	if _, err = z.w.Write(indexData); err != nil {
+		return err
+	}
+	_, err = z.w.Write(footer)
+	return err
+}
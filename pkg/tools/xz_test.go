@@ -0,0 +1,93 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package tools_test
+
+import (
+	"bytes"
+	"io"
+
+	. "github.com/geaaru/tar-formers/pkg/tools"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	xz "github.com/ulikunitz/xz"
+)
+
+// newTestXzWriter returns a xz writer with blocks of 128KB
+// compressed by 3 workers.
+func newTestXzWriter(w io.Writer) io.WriteCloser {
+	xw, err := NewParallelXzWriter(w, 64<<10, 128<<10, 3)
+	Expect(err).ToNot(HaveOccurred())
+	return xw
+}
+
+func decompressXz(data []byte) ([]byte, error) {
+	r, err := xz.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+var _ = Describe("Xz", func() {
+
+	Context("Parallel writer", func() {
+		for name, size := range testSizes {
+			name, size := name, size
+
+			It("compresses and decompresses "+name+" data", func() {
+				data := newTestData(size)
+				out, err := decompressXz(compressTestData(data, newTestXzWriter))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(bytes.Equal(out, data)).To(BeTrue())
+			})
+
+			It("is decompressed by xz with "+name+" data", func() {
+				data := newTestData(size)
+				out := pipeCommand(compressTestData(data, newTestXzWriter),
+					"xz", "-d", "-c")
+				Expect(bytes.Equal(out, data)).To(BeTrue())
+			})
+		}
+
+		It("writes the same stream with a different number of workers", func() {
+			data := newTestData(700 << 10)
+			expected := compressTestData(data, newTestXzWriter)
+
+			for _, workers := range []int{1, 2, 8} {
+				compressed := compressTestData(data, func(w io.Writer) io.WriteCloser {
+					xw, err := NewParallelXzWriter(w, 64<<10, 128<<10, workers)
+					Expect(err).ToNot(HaveOccurred())
+					return xw
+				})
+				Expect(bytes.Equal(compressed, expected)).To(BeTrue())
+			}
+		})
+
+		It("uses the default dictionary and block size", func() {
+			data := newTestData(700 << 10)
+			compressed := compressTestData(data, func(w io.Writer) io.WriteCloser {
+				xw, err := NewParallelXzWriter(w, 0, 0, 0)
+				Expect(err).ToNot(HaveOccurred())
+				return xw
+			})
+
+			out := pipeCommand(compressed, "xz", "-d", "-c")
+			Expect(bytes.Equal(out, data)).To(BeTrue())
+		})
+	})
+})
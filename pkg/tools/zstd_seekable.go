@@ -0,0 +1,442 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package tools
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	zstd "github.com/klauspost/compress/zstd"
+)
+
+// Implementation of the zstd seekable format:
+// https://github.com/facebook/zstd/blob/dev/contrib/seekable_format/zstd_seekable_compression_format.md
+//
+// The stream is a sequence of independent zstd frames followed by a
+// skippable frame with the seek table. The standard zstd decoders
+// ignore the seek table.
+
+const (
+	zstdSkippableMagicSeekTable = 0x184D2A5E
+	zstdSeekableMagicNumber     = 0x8F92EAB1
+	zstdSeekableFooterSize      = 9
+	zstdSeekableChecksumFlag    = 0x80
+	// Default size of the uncompressed data of the frames.
+	zstdSeekableFrameSize = 1 << 20
+	// The frames are split inside an entry bigger than the
+	// frame size multiplied by this factor.
+	zstdSeekableMaxFrameFactor = 4
+	// Max size of a frame of the seek table.
+	zstdSeekableMaxFrameSize = 1 << 30
+)
+
+// EntryWriter is implemented by the compression writers that align
+// the compressed stream to the entries of the tarball.
+type EntryWriter interface {
+	// BeginEntry is called before the headers of every entry
+	// after the padding of the previous entry.
+	BeginEntry() error
+}
+
+// ZstdSeekableFrame describes a frame of the seek table.
+type ZstdSeekableFrame struct {
+	CompressedOffset   int64
+	CompressedSize     int64
+	DecompressedOffset int64
+	DecompressedSize   int64
+}
+
+// zstdCountingWriter counts the bytes written.
+type zstdCountingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *zstdCountingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// ZstdSeekableWriter writes a zstd seekable stream. A new frame is
+// started on the first entry of the tarball after that the current
+// frame reaches the frame size. The entries bigger than the frame
+// size are split in more frames.
+type ZstdSeekableWriter struct {
+	w         *zstdCountingWriter
+	enc       *zstd.Encoder
+	frameSize int64
+	maxSize   int64
+
+	inFrame     bool
+	frameStart  int64
+	frameLength int64
+	frames      []ZstdSeekableFrame
+	closed      bool
+}
+
+// NewZstdSeekableWriter returns a writer that starts a new frame
+// every frameSize bytes of uncompressed data at the beginning of an
+// entry. With 0 the default size (1MB) is used.
+func NewZstdSeekableWriter(w io.Writer, frameSize int, opts ...zstd.EOption) (*ZstdSeekableWriter, error) {
+	if frameSize <= 0 {
+		frameSize = zstdSeekableFrameSize
+	}
+	if frameSize*zstdSeekableMaxFrameFactor > zstdSeekableMaxFrameSize {
+		return nil, fmt.Errorf("zstd: invalid seekable frame size %d", frameSize)
+	}
+
+	z := &ZstdSeekableWriter{
+		w:         &zstdCountingWriter{w: w},
+		frameSize: int64(frameSize),
+		maxSize:   int64(frameSize) * zstdSeekableMaxFrameFactor,
+		frames:    []ZstdSeekableFrame{},
+	}
+
+	enc, err := zstd.NewWriter(nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	z.enc = enc
+
+	return z, nil
+}
+
+func (z *ZstdSeekableWriter) Write(p []byte) (int, error) {
+	if z.closed {
+		return 0, errors.New("zstd: write on closed writer")
+	}
+
+	n := 0
+	for len(p) > 0 {
+		if !z.inFrame {
+			z.enc.Reset(z.w)
+			z.inFrame = true
+			z.frameStart = z.w.n
+			z.frameLength = 0
+		}
+
+		size := int64(len(p))
+		if z.frameLength+size > z.maxSize {
+			size = z.maxSize - z.frameLength
+		}
+
+		nw, err := z.enc.Write(p[:size])
+		n += nw
+		z.frameLength += int64(nw)
+		if err != nil {
+			return n, err
+		}
+		p = p[size:]
+
+		if z.frameLength >= z.maxSize {
+			if err := z.endFrame(); err != nil {
+				return n, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// endFrame closes the current frame and adds it to the seek table.
+func (z *ZstdSeekableWriter) endFrame() error {
+	if !z.inFrame {
+		return nil
+	}
+	z.inFrame = false
+
+	err := z.enc.Close()
+	if err != nil {
+		return err
+	}
+
+	var decompressedOffset int64
+	if len(z.frames) > 0 {
+		last := z.frames[len(z.frames)-1]
+		decompressedOffset = last.DecompressedOffset + last.DecompressedSize
+	}
+
+	z.frames = append(z.frames, ZstdSeekableFrame{
+		CompressedOffset:   z.frameStart,
+		CompressedSize:     z.w.n - z.frameStart,
+		DecompressedOffset: decompressedOffset,
+		DecompressedSize:   z.frameLength,
+	})
+
+	return nil
+}
+
+// BeginEntry starts a new frame if the current frame reaches the
+// frame size.
+func (z *ZstdSeekableWriter) BeginEntry() error {
+	if z.inFrame && z.frameLength >= z.frameSize {
+		return z.endFrame()
+	}
+	return nil
+}
+
+// Frames returns the frames written.
+func (z *ZstdSeekableWriter) Frames() []ZstdSeekableFrame {
+	return z.frames
+}
+
+// Close writes the last frame and the seek table. The underlying
+// writer is not closed.
+func (z *ZstdSeekableWriter) Close() error {
+	if z.closed {
+		return nil
+	}
+	z.closed = true
+
+	err := z.endFrame()
+	if err != nil {
+		return err
+	}
+
+	tableSize := len(z.frames)*8 + zstdSeekableFooterSize
+	table := make([]byte, 0, 8+tableSize)
+	table = binary.LittleEndian.AppendUint32(table, zstdSkippableMagicSeekTable)
+	table = binary.LittleEndian.AppendUint32(table, uint32(tableSize))
+	for _, f := range z.frames {
+		table = binary.LittleEndian.AppendUint32(table, uint32(f.CompressedSize))
+		table = binary.LittleEndian.AppendUint32(table, uint32(f.DecompressedSize))
+	}
+	table = binary.LittleEndian.AppendUint32(table, uint32(len(z.frames)))
+	// Descriptor without checksums: every frame has the checksum
+	// of the zstd format.
+	table = append(table, 0)
+	table = binary.LittleEndian.AppendUint32(table, zstdSeekableMagicNumber)
+
+	_, err = z.w.Write(table)
+	return err
+}
+
+// ZstdSeekableReader reads the decompressed data of a zstd seekable
+// stream at any offset decompressing only the frames needed.
+type ZstdSeekableReader struct {
+	r      io.ReaderAt
+	dec    *zstd.Decoder
+	frames []ZstdSeekableFrame
+	size   int64
+	offset int64
+
+	// Last frame decompressed
+	mutex      sync.Mutex
+	cacheFrame int
+	cache      []byte
+}
+
+// NewZstdSeekableReader returns a reader of the zstd seekable stream
+// of the size in input. The seek table is read from the end of the
+// stream.
+func NewZstdSeekableReader(r io.ReaderAt, size int64) (*ZstdSeekableReader, error) {
+	frames, err := ReadZstdSeekTable(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+
+	z := &ZstdSeekableReader{
+		r:          r,
+		dec:        dec,
+		frames:     frames,
+		cacheFrame: -1,
+	}
+	if len(frames) > 0 {
+		last := frames[len(frames)-1]
+		z.size = last.DecompressedOffset + last.DecompressedSize
+	}
+
+	return z, nil
+}
+
+// ReadZstdSeekTable returns the frames of the seek table of the zstd
+// seekable stream of the size in input.
+func ReadZstdSeekTable(r io.ReaderAt, size int64) ([]ZstdSeekableFrame, error) {
+	if size < zstdSeekableFooterSize+8 {
+		return nil, errors.New("zstd: seek table not found")
+	}
+
+	footer := make([]byte, zstdSeekableFooterSize)
+	if _, err := r.ReadAt(footer, size-zstdSeekableFooterSize); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(footer[5:]) != zstdSeekableMagicNumber {
+		return nil, errors.New("zstd: seek table not found")
+	}
+
+	nFrames := int64(binary.LittleEndian.Uint32(footer))
+	entrySize := int64(8)
+	if footer[4]&zstdSeekableChecksumFlag != 0 {
+		entrySize = 12
+	}
+	if footer[4]&0x7c != 0 {
+		return nil, errors.New("zstd: invalid seek table descriptor")
+	}
+
+	tableSize := nFrames*entrySize + zstdSeekableFooterSize
+	if tableSize+8 > size {
+		return nil, errors.New("zstd: invalid seek table size")
+	}
+
+	table := make([]byte, tableSize+8)
+	if _, err := r.ReadAt(table, size-tableSize-8); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(table) != zstdSkippableMagicSeekTable ||
+		int64(binary.LittleEndian.Uint32(table[4:])) != tableSize {
+		return nil, errors.New("zstd: invalid seek table frame")
+	}
+
+	frames := make([]ZstdSeekableFrame, nFrames)
+	var cOffset, dOffset int64
+	for i := range frames {
+		entry := table[8+int64(i)*entrySize:]
+		frames[i] = ZstdSeekableFrame{
+			CompressedOffset:   cOffset,
+			CompressedSize:     int64(binary.LittleEndian.Uint32(entry)),
+			DecompressedOffset: dOffset,
+			DecompressedSize:   int64(binary.LittleEndian.Uint32(entry[4:])),
+		}
+		cOffset += frames[i].CompressedSize
+		dOffset += frames[i].DecompressedSize
+	}
+
+	if cOffset != size-tableSize-8 {
+		return nil, errors.New("zstd: seek table doesn't match the frames")
+	}
+
+	return frames, nil
+}
+
+// Frames returns the frames of the seek table.
+func (z *ZstdSeekableReader) Frames() []ZstdSeekableFrame {
+	return z.frames
+}
+
+// Size returns the size of the decompressed data.
+func (z *ZstdSeekableReader) Size() int64 {
+	return z.size
+}
+
+// frameAt returns the index of the frame with the offset of the
+// decompressed data.
+func (z *ZstdSeekableReader) frameAt(off int64) int {
+	return sort.Search(len(z.frames), func(i int) bool {
+		f := z.frames[i]
+		return f.DecompressedOffset+f.DecompressedSize > off
+	})
+}
+
+func (z *ZstdSeekableReader) readFrame(i int) ([]byte, error) {
+	if i == z.cacheFrame {
+		return z.cache, nil
+	}
+
+	f := z.frames[i]
+	z.cacheFrame = -1
+	data := make([]byte, f.CompressedSize)
+	if _, err := z.r.ReadAt(data, f.CompressedOffset); err != nil {
+		return nil, err
+	}
+
+	out, err := z.dec.DecodeAll(data, z.cache[:0])
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) != f.DecompressedSize {
+		return nil, errors.New("zstd: frame size doesn't match the seek table")
+	}
+
+	z.cacheFrame = i
+	z.cache = out
+
+	return out, nil
+}
+
+// ReadAt reads the decompressed data at the offset in input. It's
+// safe to call ReadAt from more goroutines.
+func (z *ZstdSeekableReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("zstd: negative offset")
+	}
+
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+
+	n := 0
+	for n < len(p) {
+		i := z.frameAt(off)
+		if i >= len(z.frames) {
+			return n, io.EOF
+		}
+
+		data, err := z.readFrame(i)
+		if err != nil {
+			return n, err
+		}
+
+		c := copy(p[n:], data[off-z.frames[i].DecompressedOffset:])
+		n += c
+		off += int64(c)
+	}
+
+	return n, nil
+}
+
+func (z *ZstdSeekableReader) Read(p []byte) (int, error) {
+	n, err := z.ReadAt(p, z.offset)
+	z.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (z *ZstdSeekableReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += z.offset
+	case io.SeekEnd:
+		offset += z.size
+	default:
+		return 0, errors.New("zstd: invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("zstd: negative position")
+	}
+	z.offset = offset
+
+	return offset, nil
+}
+
+func (z *ZstdSeekableReader) Close() error {
+	z.dec.Close()
+	z.cache = nil
+	return nil
+}
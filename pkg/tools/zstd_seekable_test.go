@@ -0,0 +1,273 @@
+/*
+Copyright (C) 2021-2024  Daniele Rondina <geaaru@funtoo.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package tools_test
+
+import (
+	"bytes"
+	"io"
+
+	. "github.com/geaaru/tar-formers/pkg/tools"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+const zstdTestFrameSize = 64 << 10
+
+// compressZstdSeekable compresses the data with a new entry every
+// entrySize bytes and returns the stream and the frames written.
+func compressZstdSeekable(data []byte, entrySize int) ([]byte, []ZstdSeekableFrame) {
+	buf := bytes.NewBuffer(nil)
+	zw, err := NewZstdSeekableWriter(buf, zstdTestFrameSize)
+	Expect(err).ToNot(HaveOccurred())
+
+	for len(data) > 0 {
+		Expect(zw.BeginEntry()).To(Succeed())
+		size := entrySize
+		if size > len(data) {
+			size = len(data)
+		}
+		_, err = zw.Write(data[:size])
+		Expect(err).ToNot(HaveOccurred())
+		data = data[size:]
+	}
+	Expect(zw.Close()).To(Succeed())
+
+	return buf.Bytes(), zw.Frames()
+}
+
+func newTestZstdSeekableReader(compressed []byte) *ZstdSeekableReader {
+	zr, err := NewZstdSeekableReader(bytes.NewReader(compressed), int64(len(compressed)))
+	Expect(err).ToNot(HaveOccurred())
+	DeferCleanup(zr.Close)
+	return zr
+}
+
+var _ = Describe("Zstd Seekable", func() {
+
+	Context("Round-trip", func() {
+		for name, size := range testSizes {
+			name, size := name, size
+
+			It("compresses and decompresses "+name+" data", func() {
+				data := newTestData(size)
+				compressed, frames := compressZstdSeekable(data, 10<<10)
+
+				zr := newTestZstdSeekableReader(compressed)
+				Expect(zr.Size()).To(Equal(int64(len(data))))
+				Expect(zr.Frames()).To(Equal(frames))
+
+				out, err := io.ReadAll(zr)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(bytes.Equal(out, data)).To(BeTrue())
+			})
+
+			It("is decompressed by zstd with "+name+" data", func() {
+				data := newTestData(size)
+				compressed, _ := compressZstdSeekable(data, 10<<10)
+
+				out := pipeCommand(compressed, "zstd", "-d", "-c")
+				Expect(bytes.Equal(out, data)).To(BeTrue())
+			})
+		}
+
+		It("writes no frames with empty data", func() {
+			compressed, frames := compressZstdSeekable(nil, 10<<10)
+			Expect(frames).To(BeEmpty())
+
+			zr := newTestZstdSeekableReader(compressed)
+			Expect(zr.Size()).To(Equal(int64(0)))
+
+			n, err := zr.ReadAt(make([]byte, 1), 0)
+			Expect(n).To(Equal(0))
+			Expect(err).To(Equal(io.EOF))
+		})
+
+		It("rejects a frame size too big for the seek table", func() {
+			_, err := NewZstdSeekableWriter(bytes.NewBuffer(nil), 1<<30)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("Frames", func() {
+
+		It("splits the frames at the entries", func() {
+			data := newTestData(700 << 10)
+			_, frames := compressZstdSeekable(data, 10<<10)
+			Expect(len(frames)).To(BeNumerically(">", 1))
+
+			var compressedOffset, decompressedOffset int64
+			for i, f := range frames {
+				Expect(f.CompressedOffset).To(Equal(compressedOffset), "frame %d", i)
+				Expect(f.DecompressedOffset).To(Equal(decompressedOffset), "frame %d", i)
+				// Every frame contains whole entries.
+				Expect(f.DecompressedSize%(10<<10)).To(BeZero(), "frame %d", i)
+				if i < len(frames)-1 {
+					Expect(f.DecompressedSize).To(
+						BeNumerically(">=", zstdTestFrameSize), "frame %d", i)
+				}
+				compressedOffset += f.CompressedSize
+				decompressedOffset += f.DecompressedSize
+			}
+			Expect(decompressedOffset).To(Equal(int64(len(data))))
+		})
+
+		It("splits the entries bigger than the frame size", func() {
+			data := newTestData(700 << 10)
+			_, frames := compressZstdSeekable(data, len(data))
+			Expect(len(frames)).To(BeNumerically(">", 1))
+
+			for i, f := range frames[:len(frames)-1] {
+				Expect(f.DecompressedSize).To(
+					Equal(int64(4*zstdTestFrameSize)), "frame %d", i)
+			}
+		})
+
+		It("reads the seek table", func() {
+			compressed, frames := compressZstdSeekable(newTestData(700<<10), 10<<10)
+
+			table, err := ReadZstdSeekTable(bytes.NewReader(compressed), int64(len(compressed)))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(table).To(Equal(frames))
+		})
+
+		It("fails without the seek table", func() {
+			data := newTestData(1000)
+			compressed := pipeCommand(data, "zstd", "-c")
+
+			_, err := NewZstdSeekableReader(bytes.NewReader(compressed), int64(len(compressed)))
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("fails with the truncated seek table", func() {
+			compressed, _ := compressZstdSeekable(newTestData(700<<10), 10<<10)
+			compressed = compressed[:len(compressed)-1]
+
+			_, err := NewZstdSeekableReader(bytes.NewReader(compressed), int64(len(compressed)))
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("fails with a seek table that doesn't match the frames", func() {
+			compressed, frames := compressZstdSeekable(newTestData(700<<10), 10<<10)
+			// The compressed size of the first frame in the seek table.
+			compressed[len(compressed)-9-8*len(frames)] ^= 0x01
+
+			_, err := NewZstdSeekableReader(bytes.NewReader(compressed), int64(len(compressed)))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("Random access", func() {
+		var data []byte
+		var frames []ZstdSeekableFrame
+		var zr *ZstdSeekableReader
+
+		BeforeEach(func() {
+			var compressed []byte
+			data = newTestData(700 << 10)
+			compressed, frames = compressZstdSeekable(data, 10<<10)
+			Expect(len(frames)).To(BeNumerically(">", 2))
+			zr = newTestZstdSeekableReader(compressed)
+		})
+
+		It("reads across the frame boundaries", func() {
+			for _, f := range frames[1:] {
+				off := f.DecompressedOffset - 50
+				p := make([]byte, 100)
+
+				n, err := zr.ReadAt(p, off)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(n).To(Equal(100))
+				Expect(bytes.Equal(p, data[off:off+100])).To(BeTrue(),
+					"offset %d", off)
+			}
+		})
+
+		It("reads more frames at once", func() {
+			off := frames[0].DecompressedOffset + 10
+			end := frames[2].DecompressedOffset + 10
+			p := make([]byte, end-off)
+
+			n, err := zr.ReadAt(p, off)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(len(p)))
+			Expect(bytes.Equal(p, data[off:end])).To(BeTrue())
+		})
+
+		It("returns EOF at the end of the data", func() {
+			p := make([]byte, 100)
+
+			n, err := zr.ReadAt(p, int64(len(data)-50))
+			Expect(err).To(Equal(io.EOF))
+			Expect(n).To(Equal(50))
+			Expect(bytes.Equal(p[:n], data[len(data)-50:])).To(BeTrue())
+
+			n, err = zr.ReadAt(p, int64(len(data)+10))
+			Expect(err).To(Equal(io.EOF))
+			Expect(n).To(Equal(0))
+
+			_, err = zr.ReadAt(p, -1)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("seeks and reads", func() {
+			off := frames[1].DecompressedOffset - 10
+			pos, err := zr.Seek(off, io.SeekStart)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pos).To(Equal(off))
+
+			p := make([]byte, 20)
+			_, err = io.ReadFull(zr, p)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(bytes.Equal(p, data[off:off+20])).To(BeTrue())
+
+			pos, err = zr.Seek(-20, io.SeekCurrent)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pos).To(Equal(off))
+
+			pos, err = zr.Seek(-100, io.SeekEnd)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pos).To(Equal(int64(len(data) - 100)))
+
+			out, err := io.ReadAll(zr)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(bytes.Equal(out, data[len(data)-100:])).To(BeTrue())
+
+			_, err = zr.Seek(-1, io.SeekStart)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("reads from more goroutines", func() {
+			done := make(chan error, len(frames))
+			for _, f := range frames {
+				go func(f ZstdSeekableFrame) {
+					defer GinkgoRecover()
+					p := make([]byte, f.DecompressedSize)
+					_, err := zr.ReadAt(p, f.DecompressedOffset)
+					if err == nil && !bytes.Equal(p,
+						data[f.DecompressedOffset:f.DecompressedOffset+f.DecompressedSize]) {
+						err = io.ErrUnexpectedEOF
+					}
+					done <- err
+				}(f)
+			}
+
+			for range frames {
+				Expect(<-done).ToNot(HaveOccurred())
+			}
+		})
+	})
+})